@@ -0,0 +1,340 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/share"
+)
+
+const (
+	// lowestLatency and highestLatency are the range of latencies in microseconds tracked by histograms.
+	lowestLatency  = 1
+	highestLatency = int64(time.Hour / time.Microsecond)
+	// significantFigures is the precision of histograms.
+	significantFigures = 3
+)
+
+// DefaultPercentiles are percentiles of latencies in results.
+var DefaultPercentiles = []float64{50, 75, 90, 95, 99, 99.9, 99.99}
+
+// Benchmark drives a XClient to call a method, and measures latencies and errors.
+//
+// Requests are sent as fast as Concurrency callers can if QPS is 0, or at the rate of QPS otherwise.
+// Latencies are measured from the time requests are sent, so a slow server also slows down requests
+// and hides its latencies, which is known as coordinated omission.
+// With OpenLoop, requests are scheduled at the rate of QPS regardless of responses,
+// and latencies are measured from the time they are scheduled, including the time waiting for callers.
+type Benchmark struct {
+	XClient       client.XClient
+	ServiceMethod string
+	Args          interface{}
+	// NewReply returns a reply of a request. Replies are discarded.
+	NewReply func() interface{}
+	// Metadata is the metadata of requests.
+	Metadata map[string]string
+
+	// Concurrency is the number of callers, 1 is used if it is not positive.
+	Concurrency int
+	// QPS is the rate of requests, 0 means no limit.
+	QPS float64
+	// OpenLoop schedules requests at the rate of QPS independent of responses.
+	OpenLoop bool
+
+	// Requests is the number of measured requests, 0 means until Duration.
+	Requests int64
+	// Duration is the duration of measurements, 0 means until Requests.
+	Duration time.Duration
+	// Warmup is the duration before measurements. Requests in warmup are not measured.
+	Warmup time.Duration
+	// Timeout is the timeout of each request, 0 means no timeout.
+	Timeout time.Duration
+
+	// Percentiles are percentiles of latencies in results, DefaultPercentiles are used if it is empty.
+	Percentiles []float64
+}
+
+// Result is the result of a benchmark. Durations are in nanoseconds in JSON.
+type Result struct {
+	ServiceMethod string        `json:"service_method"`
+	Concurrency   int           `json:"concurrency"`
+	QPS           float64       `json:"qps,omitempty"`
+	OpenLoop      bool          `json:"open_loop,omitempty"`
+	Warmup        time.Duration `json:"warmup,omitempty"`
+
+	Requests  int64 `json:"requests"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	// Elapsed is the duration of measurements.
+	Elapsed time.Duration `json:"elapsed"`
+	// Throughput is measured requests per second.
+	Throughput float64 `json:"throughput"`
+
+	// Latency is the latency of succeeded requests.
+	Latency Latency `json:"latency"`
+	// Histogram contains non-empty buckets of latencies of succeeded requests.
+	Histogram []Bucket `json:"histogram"`
+	// Errors are numbers of failed requests by errors.
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+// Latency is the statistics of latencies.
+type Latency struct {
+	Min         time.Duration `json:"min"`
+	Mean        time.Duration `json:"mean"`
+	Max         time.Duration `json:"max"`
+	StdDev      time.Duration `json:"stddev"`
+	Percentiles []Percentile  `json:"percentiles"`
+}
+
+// Percentile is the latency of a percentile.
+type Percentile struct {
+	Percentile float64       `json:"percentile"`
+	Latency    time.Duration `json:"latency"`
+}
+
+// Bucket is the number of latencies in [From, To].
+type Bucket struct {
+	From  time.Duration `json:"from"`
+	To    time.Duration `json:"to"`
+	Count int64         `json:"count"`
+}
+
+// WriteJSON writes the result as indented JSON.
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// caller is a caller of benchmarks, which records its own histogram and errors without locks.
+type caller struct {
+	histogram *hdrhistogram.Histogram
+	errors    map[string]int64
+}
+
+// ticket is a request to send.
+type ticket struct {
+	// scheduled is the time the request is scheduled in open loops.
+	scheduled time.Time
+	measured  bool
+}
+
+// Run runs the benchmark until Requests or Duration is reached.
+// If ctx is done before, it returns the result so far with the error of ctx.
+func (b *Benchmark) Run(ctx context.Context) (*Result, error) {
+	if b.XClient == nil {
+		return nil, errors.New("bench: XClient is nil")
+	}
+	if b.Requests <= 0 && b.Duration <= 0 {
+		return nil, errors.New("bench: either Requests or Duration must be positive")
+	}
+	if b.OpenLoop && b.QPS <= 0 {
+		return nil, errors.New("bench: QPS must be positive in open loops")
+	}
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	measureStart := start.Add(b.Warmup)
+	var measureEnd time.Time
+	if b.Duration > 0 {
+		measureEnd = measureStart.Add(b.Duration)
+	}
+
+	// next returns the next ticket of the time t, and false if the benchmark is finished.
+	var issued int64
+	next := func(t time.Time) (ticket, bool) {
+		if ctx.Err() != nil || (!measureEnd.IsZero() && !t.Before(measureEnd)) {
+			return ticket{}, false
+		}
+		if t.Before(measureStart) {
+			return ticket{scheduled: t}, true
+		}
+		if b.Requests > 0 && atomic.AddInt64(&issued, 1) > b.Requests {
+			return ticket{}, false
+		}
+		return ticket{scheduled: t, measured: true}, true
+	}
+
+	tickets := make(chan ticket, concurrency)
+	if b.QPS > 0 {
+		go b.schedule(ctx, start, tickets, next)
+	}
+
+	callers := make([]*caller, concurrency)
+	var wg sync.WaitGroup
+	for i := range callers {
+		c := &caller{
+			histogram: hdrhistogram.New(lowestLatency, highestLatency, significantFigures),
+			errors:    make(map[string]int64),
+		}
+		callers[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var t ticket
+				var ok bool
+				if b.QPS > 0 {
+					t, ok = <-tickets
+				} else {
+					t, ok = next(time.Now())
+				}
+				if !ok {
+					return
+				}
+				b.call(ctx, c, t)
+			}
+		}()
+	}
+	wg.Wait()
+	end := time.Now()
+
+	r := &Result{
+		ServiceMethod: b.ServiceMethod,
+		Concurrency:   concurrency,
+		QPS:           b.QPS,
+		OpenLoop:      b.OpenLoop,
+		Warmup:        b.Warmup,
+		Errors:        make(map[string]int64),
+	}
+	if end.After(measureStart) {
+		r.Elapsed = end.Sub(measureStart)
+	}
+	histogram := hdrhistogram.New(lowestLatency, highestLatency, significantFigures)
+	for _, c := range callers {
+		histogram.Merge(c.histogram)
+		for msg, n := range c.errors {
+			r.Errors[msg] += n
+			r.Failed += n
+		}
+	}
+	r.Succeeded = histogram.TotalCount()
+	r.Requests = r.Succeeded + r.Failed
+	if r.Elapsed > 0 {
+		r.Throughput = float64(r.Requests) / r.Elapsed.Seconds()
+	}
+	b.fillLatency(r, histogram)
+	return r, parent.Err()
+}
+
+// schedule sends tickets at the rate of QPS, and closes tickets when the benchmark is finished.
+// Scheduled times don't depend on when tickets are received, so that delays of callers are measured in open loops.
+func (b *Benchmark) schedule(ctx context.Context, start time.Time, tickets chan<- ticket, next func(time.Time) (ticket, bool)) {
+	defer close(tickets)
+
+	interval := time.Duration(float64(time.Second) / b.QPS)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for i := int64(0); ; i++ {
+		scheduled := start.Add(time.Duration(i) * interval)
+		if d := time.Until(scheduled); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+		}
+		t, ok := next(scheduled)
+		if !ok {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case tickets <- t:
+		}
+	}
+}
+
+// call sends a request of the ticket and records its latency or error.
+func (b *Benchmark) call(ctx context.Context, c *caller, t ticket) {
+	if b.Metadata != nil {
+		meta := make(map[string]string, len(b.Metadata))
+		for k, v := range b.Metadata {
+			meta[k] = v
+		}
+		ctx = context.WithValue(ctx, share.ReqMetaDataKey, meta)
+	}
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+
+	var reply interface{}
+	if b.NewReply != nil {
+		reply = b.NewReply()
+	}
+	sent := time.Now()
+	err := b.XClient.Call(ctx, b.ServiceMethod, b.Args, reply)
+	done := time.Now()
+	if !t.measured {
+		return
+	}
+	if err != nil {
+		c.errors[err.Error()]++
+		return
+	}
+
+	from := sent
+	if b.OpenLoop {
+		from = t.scheduled
+	}
+	latency := int64(done.Sub(from) / time.Microsecond)
+	if latency < lowestLatency {
+		latency = lowestLatency
+	} else if latency > highestLatency {
+		latency = highestLatency
+	}
+	c.histogram.RecordValue(latency)
+}
+
+func (b *Benchmark) fillLatency(r *Result, h *hdrhistogram.Histogram) {
+	percentiles := b.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	percentiles = append([]float64(nil), percentiles...)
+	sort.Float64s(percentiles)
+
+	r.Latency.Percentiles = make([]Percentile, 0, len(percentiles))
+	for _, p := range percentiles {
+		r.Latency.Percentiles = append(r.Latency.Percentiles, Percentile{Percentile: p, Latency: microseconds(h.ValueAtPercentile(p))})
+	}
+	r.Histogram = []Bucket{}
+	if h.TotalCount() == 0 {
+		return
+	}
+
+	r.Latency.Min = microseconds(h.Min())
+	r.Latency.Mean = time.Duration(h.Mean() * float64(time.Microsecond))
+	r.Latency.Max = microseconds(h.Max())
+	r.Latency.StdDev = time.Duration(h.StdDev() * float64(time.Microsecond))
+	for _, bar := range h.Distribution() {
+		if bar.Count > 0 {
+			r.Histogram = append(r.Histogram, Bucket{From: microseconds(bar.From), To: microseconds(bar.To), Count: bar.Count})
+		}
+	}
+}
+
+func microseconds(v int64) time.Duration {
+	return time.Duration(v) * time.Microsecond
+}
@@ -0,0 +1,218 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/server"
+)
+
+type Args struct {
+	A int
+	B int
+	// Sleep is the duration the server sleeps.
+	Sleep time.Duration
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Mul(ctx context.Context, args *Args, reply *Reply) error {
+	time.Sleep(args.Sleep)
+	reply.C = args.A * args.B
+	return nil
+}
+
+func startXClient(t *testing.T) (client.XClient, func()) {
+	s := server.NewServer()
+	if err := s.RegisterName("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve("tcp", "127.0.0.1:0")
+	for i := 0; i < 50 && s.Address() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Address() == nil {
+		t.Fatal("server is not started")
+	}
+
+	d, _ := client.NewPeer2PeerDiscovery("tcp@"+s.Address().String(), "")
+	xclient := client.NewXClient("Arith", client.Failfast, client.RandomSelect, d, client.DefaultOption)
+	return xclient, func() {
+		xclient.Close()
+		s.Close()
+	}
+}
+
+func newReply() interface{} {
+	return &Reply{}
+}
+
+func TestBenchmark_Requests(t *testing.T) {
+	xclient, stop := startXClient(t)
+	defer stop()
+
+	b := &Benchmark{
+		XClient:       xclient,
+		ServiceMethod: "Mul",
+		Args:          &Args{A: 10, B: 20},
+		NewReply:      newReply,
+		Concurrency:   4,
+		Requests:      200,
+		Percentiles:   []float64{99, 50},
+	}
+	r, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Requests != 200 || r.Succeeded != 200 || r.Failed != 0 || r.Throughput <= 0 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if len(r.Latency.Percentiles) != 2 || r.Latency.Percentiles[0].Percentile != 50 ||
+		r.Latency.Percentiles[0].Latency > r.Latency.Percentiles[1].Latency || r.Latency.Min > r.Latency.Max {
+		t.Errorf("unexpected latency %+v", r.Latency)
+	}
+	var count int64
+	for _, bucket := range r.Histogram {
+		count += bucket.Count
+	}
+	if count != 200 {
+		t.Errorf("expect 200 latencies in the histogram but got %d", count)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Result
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || decoded.Succeeded != 200 || decoded.Latency.Max != r.Latency.Max {
+		t.Errorf("unexpected JSON %s: %v", buf.String(), err)
+	}
+}
+
+func TestBenchmark_QPS(t *testing.T) {
+	xclient, stop := startXClient(t)
+	defer stop()
+
+	b := &Benchmark{
+		XClient:       xclient,
+		ServiceMethod: "Mul",
+		Args:          &Args{A: 10, B: 20},
+		NewReply:      newReply,
+		Concurrency:   2,
+		QPS:           200,
+		Warmup:        100 * time.Millisecond,
+		Duration:      250 * time.Millisecond,
+	}
+	r, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// about 50 requests are measured after 20 requests of warmup
+	if r.Succeeded < 30 || r.Succeeded > 70 {
+		t.Errorf("expect about 50 requests but got %d", r.Succeeded)
+	}
+}
+
+func TestBenchmark_OpenLoop(t *testing.T) {
+	xclient, stop := startXClient(t)
+	defer stop()
+
+	// the server takes 20ms but requests are scheduled every 10ms
+	b := &Benchmark{
+		XClient:       xclient,
+		ServiceMethod: "Mul",
+		Args:          &Args{A: 10, B: 20, Sleep: 20 * time.Millisecond},
+		NewReply:      newReply,
+		Concurrency:   1,
+		QPS:           100,
+		Requests:      20,
+	}
+	closed, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.OpenLoop = true
+	open, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if closed.Latency.Max > 100*time.Millisecond {
+		t.Errorf("expect latencies of closed loops are about 20ms but got %v", closed.Latency.Max)
+	}
+	// the last request waits for about 19 * 10ms in the open loop
+	if open.Latency.Max < 100*time.Millisecond {
+		t.Errorf("expect open loops measure waiting but got %v", open.Latency.Max)
+	}
+}
+
+func TestBenchmark_Errors(t *testing.T) {
+	xclient, stop := startXClient(t)
+	defer stop()
+
+	b := &Benchmark{
+		XClient:       xclient,
+		ServiceMethod: "Missing",
+		Args:          &Args{},
+		NewReply:      newReply,
+		Concurrency:   2,
+		Requests:      10,
+	}
+	r, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Failed != 10 || r.Succeeded != 0 || len(r.Errors) != 1 || len(r.Histogram) != 0 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	for msg := range r.Errors {
+		if !strings.Contains(msg, "Missing") {
+			t.Errorf("unexpected error %s", msg)
+		}
+	}
+
+	b.ServiceMethod = "Mul"
+	b.Args = &Args{Sleep: 50 * time.Millisecond}
+	b.Timeout = 10 * time.Millisecond
+	if r, err = b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r.Failed != 10 {
+		t.Errorf("expect timeouts but got %+v", r)
+	}
+}
+
+func TestBenchmark_Cancel(t *testing.T) {
+	xclient, stop := startXClient(t)
+	defer stop()
+
+	b := &Benchmark{
+		XClient:       xclient,
+		ServiceMethod: "Mul",
+		Args:          &Args{A: 1, B: 2, Sleep: time.Millisecond},
+		NewReply:      newReply,
+		Duration:      time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r, err := b.Run(ctx)
+	if err != context.DeadlineExceeded || r == nil || r.Succeeded == 0 {
+		t.Fatalf("expect results so far but got %+v: %v", r, err)
+	}
+
+	if _, err := (&Benchmark{XClient: xclient}).Run(context.Background()); err == nil {
+		t.Error("expect an error without Requests and Duration")
+	}
+	if _, err := (&Benchmark{XClient: xclient, Requests: 1, OpenLoop: true}).Run(context.Background()); err == nil {
+		t.Error("expect an error of open loops without QPS")
+	}
+}
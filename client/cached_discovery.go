@@ -0,0 +1,396 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// CacheOption contains options of CachedDiscovery.
+type CacheOption struct {
+	// Dir is the directory of snapshots. Each service path has a snapshot file in it.
+	Dir string
+	// MaxStaleness is the max age of snapshots that can be served. Zero means no limit.
+	MaxStaleness time.Duration
+	// RetryInterval is the interval of connecting the registry while snapshots are served. Default is 5s.
+	RetryInterval time.Duration
+	// Metrics registers snapshot_served gauges, backend_errors counters and updates counters of service paths.
+	Metrics metrics.Registry
+}
+
+// CacheStats contains statistics of CachedDiscovery.
+type CacheStats struct {
+	// FromSnapshot is true if servers are from the snapshot, because the registry is unreachable.
+	FromSnapshot bool
+	// SnapshotTime is when the servers of the snapshot were saved.
+	SnapshotTime time.Time
+	// BackendErrors is the number of failures to connect the registry.
+	BackendErrors uint64
+	// Updates is the number of updates of servers from the registry.
+	Updates uint64
+}
+
+// CachedDiscovery wraps a ServiceDiscovery, and persists its servers to a local snapshot file.
+// If the registry is unreachable when CachedDiscovery is created, servers of the snapshot are served
+// and the ServiceDiscovery is created again every RetryInterval. Once it is created,
+// its servers replace the snapshot ones and are pushed to watchers.
+//
+// Empty server lists are not saved, so a snapshot is never emptied by a transient failure of the registry.
+type CachedDiscovery struct {
+	servicePath string
+	newBackend  func(servicePath string) (ServiceDiscovery, error)
+	opt         CacheOption
+
+	backendMu sync.Mutex
+	backend   ServiceDiscovery
+
+	pairsMu sync.RWMutex
+	servers []*KVPair // all servers before filtering
+	pairs   []*KVPair
+	filter  ServiceDiscoveryFilter
+
+	chans []chan []*KVPair
+	mu    sync.Mutex
+
+	fromSnapshot  int32
+	snapshotTime  atomic.Value
+	backendErrors uint64
+	updates       uint64
+
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+type discoverySnapshot struct {
+	ServicePath string    `json:"service_path"`
+	Time        time.Time `json:"time"`
+	Servers     []*KVPair `json:"servers"`
+}
+
+// NewCachedDiscovery returns a new CachedDiscovery of servicePath.
+// newBackend creates the ServiceDiscovery of a service path, for example:
+//
+//	func(servicePath string) (ServiceDiscovery, error) {
+//		return NewZookeeperDiscovery(basePath, servicePath, zkAddrs, nil)
+//	}
+//
+// It returns an error only if the registry is unreachable and there is no fresh snapshot.
+func NewCachedDiscovery(servicePath string, newBackend func(servicePath string) (ServiceDiscovery, error), opt CacheOption) (ServiceDiscovery, error) {
+	if opt.Dir == "" {
+		return nil, errors.New("snapshot dir must be set")
+	}
+	if opt.RetryInterval <= 0 {
+		opt.RetryInterval = 5 * time.Second
+	}
+	if err := os.MkdirAll(opt.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &CachedDiscovery{
+		servicePath: servicePath,
+		newBackend:  newBackend,
+		opt:         opt,
+		stopCh:      make(chan struct{}),
+	}
+
+	backend, err := d.createBackend()
+	if err == nil {
+		d.setBackend(backend)
+		return d, nil
+	}
+	d.markBackendError()
+
+	snapshot, serr := d.freshSnapshot()
+	if serr != nil {
+		log.Errorf("registry of %s is unreachable and there is no snapshot to serve: %v", servicePath, serr)
+		return nil, err
+	}
+
+	log.Warnf("registry of %s is unreachable, serve the snapshot saved at %v: %v", servicePath, snapshot.Time, err)
+	d.serveSnapshot(snapshot)
+	go d.connect()
+	return d, nil
+}
+
+// createBackend creates the ServiceDiscovery, and converts its panics to errors
+// because some registries panic if they can't be listed.
+func (d *CachedDiscovery) createBackend() (backend ServiceDiscovery, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			backend, err = nil, fmt.Errorf("failed to create the discovery of %s: %v", d.servicePath, r)
+		}
+	}()
+	return d.newBackend(d.servicePath)
+}
+
+// Clone clones this ServiceDiscovery with new servicePath.
+func (d *CachedDiscovery) Clone(servicePath string) (ServiceDiscovery, error) {
+	return NewCachedDiscovery(servicePath, d.newBackend, d.opt)
+}
+
+// SetFilter sets the filer, and filters current servers by it.
+func (d *CachedDiscovery) SetFilter(filter ServiceDiscoveryFilter) {
+	d.pairsMu.Lock()
+	d.filter = filter
+	d.pairs = d.filterServers()
+	d.pairsMu.Unlock()
+}
+
+// GetServices returns the servers
+func (d *CachedDiscovery) GetServices() []*KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive changes of servers.
+func (d *CachedDiscovery) WatchService() chan []*KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *CachedDiscovery) RemoveWatcher(ch chan []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+// Stats returns statistics of this CachedDiscovery.
+func (d *CachedDiscovery) Stats() CacheStats {
+	stats := CacheStats{
+		FromSnapshot:  atomic.LoadInt32(&d.fromSnapshot) == 1,
+		BackendErrors: atomic.LoadUint64(&d.backendErrors),
+		Updates:       atomic.LoadUint64(&d.updates),
+	}
+	if t, ok := d.snapshotTime.Load().(time.Time); ok {
+		stats.SnapshotTime = t
+	}
+	return stats
+}
+
+func (d *CachedDiscovery) markBackendError() {
+	atomic.AddUint64(&d.backendErrors, 1)
+	if d.opt.Metrics != nil {
+		metrics.GetOrRegisterCounter(d.servicePath+".backend_errors", d.opt.Metrics).Inc(1)
+	}
+}
+
+func (d *CachedDiscovery) updateMetrics() {
+	if d.opt.Metrics == nil {
+		return
+	}
+	metrics.GetOrRegisterGauge(d.servicePath+".snapshot_served", d.opt.Metrics).Update(int64(atomic.LoadInt32(&d.fromSnapshot)))
+}
+
+// connect creates the ServiceDiscovery every RetryInterval until it succeeds.
+func (d *CachedDiscovery) connect() {
+	ticker := time.NewTicker(d.opt.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		backend, err := d.createBackend()
+		if err != nil {
+			d.markBackendError()
+			log.Debugf("registry of %s is still unreachable: %v", d.servicePath, err)
+			continue
+		}
+		log.Infof("registry of %s is reachable, stop serving the snapshot", d.servicePath)
+		d.setBackend(backend)
+		return
+	}
+}
+
+// setBackend replaces servers with the servers of backend, and watches its changes.
+func (d *CachedDiscovery) setBackend(backend ServiceDiscovery) {
+	d.backendMu.Lock()
+	select {
+	case <-d.stopCh:
+		d.backendMu.Unlock()
+		backend.Close()
+		return
+	default:
+	}
+	d.backend = backend
+	ch := backend.WatchService()
+	d.backendMu.Unlock()
+
+	d.update(backend.GetServices(), true)
+	if ch == nil {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-d.stopCh:
+				return
+			case pairs, ok := <-ch:
+				if !ok {
+					return
+				}
+				d.update(pairs, true)
+			}
+		}
+	}()
+}
+
+// serveSnapshot replaces servers with the servers of snapshot.
+func (d *CachedDiscovery) serveSnapshot(snapshot *discoverySnapshot) {
+	atomic.StoreInt32(&d.fromSnapshot, 1)
+	d.snapshotTime.Store(snapshot.Time)
+	d.updateMetrics()
+	d.update(snapshot.Servers, false)
+}
+
+// update replaces servers, notifies watchers and saves the snapshot if servers are from the registry.
+func (d *CachedDiscovery) update(servers []*KVPair, save bool) {
+	if save {
+		atomic.AddUint64(&d.updates, 1)
+		if d.opt.Metrics != nil {
+			metrics.GetOrRegisterCounter(d.servicePath+".updates", d.opt.Metrics).Inc(1)
+		}
+		if atomic.CompareAndSwapInt32(&d.fromSnapshot, 1, 0) {
+			d.updateMetrics()
+		}
+	}
+
+	d.pairsMu.Lock()
+	d.servers = servers
+	pairs := d.filterServers()
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		ch := ch
+		go func() {
+			defer func() {
+				recover()
+			}()
+			select {
+			case ch <- pairs:
+			case <-time.After(time.Minute):
+				log.Warn("chan is full and new change has been dropped")
+			}
+		}()
+	}
+	d.mu.Unlock()
+
+	if !save || len(servers) == 0 {
+		return
+	}
+	if err := d.saveSnapshot(servers); err != nil {
+		log.Warnf("failed to save the snapshot of %s: %v", d.servicePath, err)
+	}
+}
+
+// filterServers returns sorted servers accepted by the filter. d.pairsMu must be held.
+func (d *CachedDiscovery) filterServers() []*KVPair {
+	pairs := make([]*KVPair, 0, len(d.servers))
+	for _, pair := range d.servers {
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+func (d *CachedDiscovery) snapshotPath() string {
+	return filepath.Join(d.opt.Dir, url.PathEscape(d.servicePath)+".json")
+}
+
+func (d *CachedDiscovery) loadSnapshot() (*discoverySnapshot, error) {
+	data, err := ioutil.ReadFile(d.snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+	var snapshot discoverySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	if len(snapshot.Servers) == 0 {
+		return nil, errors.New("empty snapshot")
+	}
+	return &snapshot, nil
+}
+
+// freshSnapshot loads the snapshot, and returns an error if it is older than MaxStaleness.
+func (d *CachedDiscovery) freshSnapshot() (*discoverySnapshot, error) {
+	snapshot, err := d.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if d.opt.MaxStaleness > 0 && time.Since(snapshot.Time) > d.opt.MaxStaleness {
+		return nil, fmt.Errorf("the snapshot saved at %v is stale", snapshot.Time)
+	}
+	return snapshot, nil
+}
+
+// saveSnapshot writes a temporary file and renames it, so the snapshot is never partially written.
+func (d *CachedDiscovery) saveSnapshot(servers []*KVPair) error {
+	data, err := json.Marshal(&discoverySnapshot{ServicePath: d.servicePath, Time: time.Now(), Servers: servers})
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(d.opt.Dir, ".snapshot-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), d.snapshotPath())
+}
+
+// Close stops watching, and closes the wrapped ServiceDiscovery.
+func (d *CachedDiscovery) Close() {
+	d.closeOnce.Do(func() {
+		d.backendMu.Lock()
+		close(d.stopCh)
+		backend := d.backend
+		d.backendMu.Unlock()
+		if backend != nil {
+			backend.Close()
+		}
+	})
+}
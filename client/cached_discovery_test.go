@@ -0,0 +1,123 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachedDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpcx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var down int32
+	backend, _ := NewMultipleServersDiscovery([]*KVPair{{Key: "tcp@127.0.0.1:8972", Value: "weight=10"}})
+	newBackend := func(servicePath string) (ServiceDiscovery, error) {
+		switch atomic.LoadInt32(&down) {
+		case 1:
+			return nil, errors.New("registry is unreachable")
+		case 2:
+			panic("registry can't be listed")
+		}
+		return backend, nil
+	}
+	opt := CacheOption{Dir: dir, RetryInterval: 50 * time.Millisecond}
+
+	// no snapshot
+	atomic.StoreInt32(&down, 1)
+	if _, err := NewCachedDiscovery("Arith", newBackend, opt); err == nil {
+		t.Fatal("expect an error without the registry and the snapshot")
+	}
+
+	// save the snapshot
+	atomic.StoreInt32(&down, 0)
+	d, err := NewCachedDiscovery("Arith", newBackend, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.(*MultipleServersDiscovery).Update([]*KVPair{{Key: "tcp@127.0.0.1:8973"}, {Key: "tcp@127.0.0.1:8972"}})
+	time.Sleep(100 * time.Millisecond)
+	if pairs := d.GetServices(); len(pairs) != 2 || pairs[0].Key != "tcp@127.0.0.1:8972" {
+		t.Fatalf("expect servers of the registry but got %v", pairs)
+	}
+	d.Close()
+
+	// serve the snapshot
+	atomic.StoreInt32(&down, 1)
+	d, err = NewCachedDiscovery("Arith", newBackend, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if pairs := d.GetServices(); len(pairs) != 2 || pairs[1].Key != "tcp@127.0.0.1:8973" {
+		t.Fatalf("expect servers of the snapshot but got %v", pairs)
+	}
+	stats := d.(*CachedDiscovery).Stats()
+	if !stats.FromSnapshot || stats.SnapshotTime.IsZero() || stats.BackendErrors != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// reconcile with the registry
+	ch := d.WatchService()
+	backend.(*MultipleServersDiscovery).Update([]*KVPair{{Key: "tcp@127.0.0.1:8974"}})
+	atomic.StoreInt32(&down, 0)
+	select {
+	case pairs := <-ch:
+		if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8974" {
+			t.Fatalf("expect servers of the registry but got %v", pairs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("servers are not reconciled with the registry")
+	}
+	if d.(*CachedDiscovery).Stats().FromSnapshot {
+		t.Error("expect servers are not from the snapshot")
+	}
+
+	// an empty list of the registry is respected
+	backend.(*MultipleServersDiscovery).Update(nil)
+	select {
+	case pairs := <-ch:
+		if len(pairs) != 0 {
+			t.Fatalf("expect no servers but got %v", pairs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("servers are not updated")
+	}
+	if d.(*CachedDiscovery).Stats().FromSnapshot {
+		t.Error("expect servers are not from the snapshot")
+	}
+	backend.(*MultipleServersDiscovery).Update([]*KVPair{{Key: "tcp@127.0.0.1:8975"}})
+	select {
+	case pairs := <-ch:
+		if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8975" {
+			t.Fatalf("expect servers of the registry but got %v", pairs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("servers are not updated")
+	}
+
+	// the registry panics
+	time.Sleep(100 * time.Millisecond)
+	atomic.StoreInt32(&down, 2)
+	d2, err := NewCachedDiscovery("Arith", newBackend, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs := d2.GetServices(); len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8975" {
+		t.Fatalf("expect servers of the snapshot but got %v", pairs)
+	}
+	d2.Close()
+
+	// stale snapshot
+	atomic.StoreInt32(&down, 1)
+	opt.MaxStaleness = time.Nanosecond
+	if _, err := NewCachedDiscovery("Arith", newBackend, opt); err == nil {
+		t.Fatal("expect an error with the stale snapshot")
+	}
+}
@@ -50,3 +50,116 @@ func TestConsecCircuitBreaker(t *testing.T) {
 
 	}
 }
+
+func TestStateCircuitBreaker(t *testing.T) {
+	cb := NewStateCircuitBreaker(StateCircuitBreakerOption{
+		Window:         time.Second,
+		MinRequests:    10,
+		ErrorRate:      0.5,
+		OpenTimeout:    100 * time.Millisecond,
+		HalfOpenProbes: 2,
+	})
+
+	var changes []string
+	cb.OnStateChange(func(from, to BreakerState) {
+		changes = append(changes, from.String()+"->"+to.String())
+	})
+
+	testErr := errors.New("test error")
+	fail := func() error { return testErr }
+	ok := func() error { return nil }
+
+	// below the minimum volume
+	for i := 0; i < 9; i++ {
+		cb.Call(fail, 0)
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expect closed but got %s", cb.State())
+	}
+
+	cb.Call(fail, 0)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expect open but got %s", cb.State())
+	}
+	if err := cb.Call(ok, 0); err != ErrBreakerOpen {
+		t.Fatalf("expect %v but got %v", ErrBreakerOpen, err)
+	}
+
+	// half-open allows limited probes and opens again on failure
+	time.Sleep(150 * time.Millisecond)
+	if !cb.Ready() || !cb.Ready() || cb.Ready() {
+		t.Fatalf("expect 2 probes in half-open state")
+	}
+	cb.Fail()
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expect open but got %s", cb.State())
+	}
+
+	// closes after all probes succeed
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := cb.Call(ok, 0); err != nil {
+			t.Fatalf("expect success but got %v", err)
+		}
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expect closed but got %s", cb.State())
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(changes) != len(expected) {
+		t.Fatalf("expect %v but got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("expect %v but got %v", expected, changes)
+		}
+	}
+}
+
+func TestStateCircuitBreaker_SlowCall(t *testing.T) {
+	cb := NewStateCircuitBreaker(StateCircuitBreakerOption{
+		MinRequests:      4,
+		SlowCallRate:     0.5,
+		SlowCallDuration: 10 * time.Millisecond,
+	})
+
+	for i := 0; i < 4; i++ {
+		d := time.Millisecond
+		if i%2 == 0 {
+			d = 20 * time.Millisecond
+		}
+		cb.Done(nil, d)
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expect open but got %s", cb.State())
+	}
+}
+
+func TestStateCircuitBreaker_ProbeTimeout(t *testing.T) {
+	cb := NewStateCircuitBreaker(StateCircuitBreakerOption{
+		MinRequests:    1,
+		OpenTimeout:    10 * time.Millisecond,
+		HalfOpenProbes: 1,
+		ProbeTimeout:   50 * time.Millisecond,
+	})
+
+	cb.Fail()
+	time.Sleep(20 * time.Millisecond)
+	if !cb.Ready() {
+		t.Fatalf("expect a probe in half-open state")
+	}
+	// the result of the probe is never reported
+	if cb.Ready() {
+		t.Fatalf("expect no more probes before the probe timeout")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Ready() {
+		t.Fatalf("expect a new probe after the probe timeout")
+	}
+	cb.Success()
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expect closed but got %s", cb.State())
+	}
+}
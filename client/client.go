@@ -141,6 +141,12 @@ type Option struct {
 	// If it is empty, clients will ignore group.
 	Group string
 
+	// Locality is the zone and region of the client, used by ZoneAware select mode.
+	Locality LocalityOption
+
+	// Router routes calls to subsets of servers by rules, for example for canary releases.
+	Router *Router
+
 	// Retries retries to send
 	Retries int
 
@@ -160,6 +166,9 @@ type Option struct {
 
 	// Breaker is used to config CircuitBreaker
 	GenBreaker func() Breaker
+	// GenMethodBreaker creates a breaker for each method of each server, which is checked around every call.
+	// Use StatefulBreakers such as StateCircuitBreaker to record latencies and to get notified of state changes.
+	GenMethodBreaker func() Breaker
 
 	SerializeType protocol.SerializeType
 	CompressType  protocol.CompressType
@@ -225,6 +234,13 @@ func (client *Client) IsShutdown() bool {
 	return client.shutdown
 }
 
+// PendingCalls returns the number of calls waiting for responses.
+func (client *Client) PendingCalls() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return len(client.pending)
+}
+
 // Go invokes the function asynchronously. It returns the Call structure representing
 // the invocation. The done channel will signal when the call is complete by returning
 // the same Call object. If done is nil, Go will allocate a new channel.
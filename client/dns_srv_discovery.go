@@ -0,0 +1,338 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/miekg/dns"
+)
+
+// DNSSRVOption contains options of DNSSRVDiscovery.
+type DNSSRVOption struct {
+	// Name is the SRV name, for example _rpcx._tcp.arith.service.consul.
+	Name string
+	// Network of servers. Default is tcp.
+	Network string
+	// Resolvers are addresses of DNS servers, for example 127.0.0.1:8600. Default is nameservers in /etc/resolv.conf.
+	Resolvers []string
+	// Timeout of each query. Default is 2s.
+	Timeout time.Duration
+	// MinRefresh and MaxRefresh bound the refresh interval, which is the minimum TTL of records.
+	// Default are 1s and 5m. Failed lookups are retried with backoff from MinRefresh to MaxRefresh.
+	MinRefresh time.Duration
+	MaxRefresh time.Duration
+}
+
+// DNSSRVDiscovery is based on DNS SRV records.
+// Servers have metadata priority, weight, port and target from their SRV records,
+// so they work with WeightedRoundRobin and the priority of ZoneAware select modes.
+// Servers are refreshed when their records expire, and kept if lookups fail.
+// Watchers are notified only if refreshed servers differ from the previous ones.
+type DNSSRVDiscovery struct {
+	opt DNSSRVOption
+
+	pairsMu sync.RWMutex
+	servers []*KVPair // all servers before filtering
+	pairs   []*KVPair
+	chans   []chan []*KVPair
+
+	mu sync.Mutex
+
+	filter ServiceDiscoveryFilter
+
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDNSSRVDiscovery returns a new DNSSRVDiscovery.
+// It returns an error if the first lookup fails.
+func NewDNSSRVDiscovery(opt DNSSRVOption) (ServiceDiscovery, error) {
+	if opt.Name == "" {
+		return nil, errors.New("SRV name must be set")
+	}
+	if opt.Network == "" {
+		opt.Network = "tcp"
+	}
+	if len(opt.Resolvers) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range conf.Servers {
+			opt.Resolvers = append(opt.Resolvers, net.JoinHostPort(s, conf.Port))
+		}
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	if opt.MinRefresh <= 0 {
+		opt.MinRefresh = time.Second
+	}
+	if opt.MaxRefresh <= 0 {
+		opt.MaxRefresh = 5 * time.Minute
+	}
+
+	d := &DNSSRVDiscovery{opt: opt, stopCh: make(chan struct{})}
+	ttl, err := d.lookup()
+	if err != nil {
+		return nil, err
+	}
+	go d.watch(ttl)
+	return d, nil
+}
+
+// Clone clones this ServiceDiscovery with new servicePath.
+func (d *DNSSRVDiscovery) Clone(servicePath string) (ServiceDiscovery, error) {
+	return NewDNSSRVDiscovery(d.opt)
+}
+
+// SetFilter sets the filer, and filters current servers by it.
+func (d *DNSSRVDiscovery) SetFilter(filter ServiceDiscoveryFilter) {
+	d.pairsMu.Lock()
+	d.filter = filter
+	d.pairs = d.filterServers()
+	d.pairsMu.Unlock()
+}
+
+// GetServices returns the servers
+func (d *DNSSRVDiscovery) GetServices() []*KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive changes of servers.
+func (d *DNSSRVDiscovery) WatchService() chan []*KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *DNSSRVDiscovery) RemoveWatcher(ch chan []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+// exchange queries name of type t from resolvers in order, and returns the first successful response.
+func (d *DNSSRVDiscovery) exchange(name string, t uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), t)
+	m.RecursionDesired = true
+
+	err := errors.New("no resolvers")
+	for _, resolver := range d.opt.Resolvers {
+		c := &dns.Client{Timeout: d.opt.Timeout}
+		var r *dns.Msg
+		r, _, err = c.Exchange(m, resolver)
+		if err == nil && r.Truncated {
+			c.Net = "tcp"
+			r, _, err = c.Exchange(m, resolver)
+		}
+		if err != nil {
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("lookup %s: %s", name, dns.RcodeToString[r.Rcode])
+			continue
+		}
+		return r, nil
+	}
+	return nil, err
+}
+
+// lookup resolves SRV records and addresses of their targets, and returns the minimum TTL of records.
+func (d *DNSSRVDiscovery) lookup() (time.Duration, error) {
+	r, err := d.exchange(d.opt.Name, dns.TypeSRV)
+	if err != nil {
+		return 0, err
+	}
+
+	ttl := d.opt.MaxRefresh
+	updateTTL := func(rr dns.RR) {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+
+	// addresses in the additional section
+	addrs := make(map[string][]string)
+	for _, rr := range r.Extra {
+		switch a := rr.(type) {
+		case *dns.A:
+			addrs[a.Hdr.Name] = append(addrs[a.Hdr.Name], a.A.String())
+			updateTTL(rr)
+		case *dns.AAAA:
+			addrs[a.Hdr.Name] = append(addrs[a.Hdr.Name], a.AAAA.String())
+			updateTTL(rr)
+		}
+	}
+
+	var servers []*KVPair
+	seen := make(map[string]bool)
+	for _, rr := range r.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		updateTTL(rr)
+
+		ips, ok := addrs[srv.Target]
+		if !ok {
+			// a target which can't be resolved is skipped, so it doesn't fail other targets
+			for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				ar, err := d.exchange(srv.Target, t)
+				if err != nil {
+					log.Warnf("cannot resolve %s of %s: %v", dns.TypeToString[t], srv.Target, err)
+					continue
+				}
+				for _, rr := range ar.Answer {
+					switch a := rr.(type) {
+					case *dns.A:
+						ips = append(ips, a.A.String())
+						updateTTL(rr)
+					case *dns.AAAA:
+						ips = append(ips, a.AAAA.String())
+						updateTTL(rr)
+					}
+				}
+			}
+			addrs[srv.Target] = ips
+		}
+
+		// weight 0 means a very small chance to be selected, but WeightedRoundRobin never selects weight 0
+		weight := srv.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		meta := fmt.Sprintf("priority=%d&weight=%d&port=%d&target=%s", srv.Priority, weight, srv.Port, srv.Target)
+		for _, ip := range ips {
+			key := d.opt.Network + "@" + net.JoinHostPort(ip, strconv.Itoa(int(srv.Port)))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			servers = append(servers, &KVPair{Key: key, Value: meta})
+		}
+	}
+	if len(servers) == 0 {
+		return 0, fmt.Errorf("lookup %s: no servers", d.opt.Name)
+	}
+
+	d.pairsMu.Lock()
+	d.servers = servers
+	pairs := d.filterServers()
+	changed := !samePairs(d.pairs, pairs)
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	// records are refreshed every TTL, so watchers are only notified of changes
+	if !changed {
+		return ttl, nil
+	}
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		ch := ch
+		go func() {
+			defer func() {
+				recover()
+			}()
+			select {
+			case ch <- pairs:
+			case <-time.After(time.Minute):
+				log.Warn("chan is full and new change has been dropped")
+			}
+		}()
+	}
+	d.mu.Unlock()
+
+	return ttl, nil
+}
+
+// filterServers returns sorted servers accepted by the filter. d.pairsMu must be held.
+func (d *DNSSRVDiscovery) filterServers() []*KVPair {
+	pairs := make([]*KVPair, 0, len(d.servers))
+	for _, pair := range d.servers {
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+// samePairs returns whether sorted servers a and b have the same keys and metadata.
+func samePairs(a, b []*KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DNSSRVDiscovery) watch(ttl time.Duration) {
+	var backoff time.Duration
+	for {
+		wait := ttl
+		if backoff > 0 {
+			wait = backoff
+		}
+		if wait < d.opt.MinRefresh {
+			wait = d.opt.MinRefresh
+		}
+		if wait > d.opt.MaxRefresh {
+			wait = d.opt.MaxRefresh
+		}
+
+		select {
+		case <-d.stopCh:
+			return
+		case <-time.After(wait):
+		}
+
+		var err error
+		ttl, err = d.lookup()
+		if err == nil {
+			backoff = 0
+			continue
+		}
+
+		// keep the last known servers
+		if backoff == 0 {
+			backoff = d.opt.MinRefresh
+		} else {
+			backoff *= 2
+		}
+		log.Warnf("failed to lookup %s, keep last known servers and retry in %v: %v", d.opt.Name, backoff, err)
+	}
+}
+
+func (d *DNSSRVDiscovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stopCh)
+	})
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeSRVServer serves SRV records of _rpcx._tcp.arith. and A records of their targets.
+// Addresses of the target broken.arith. can't be resolved.
+type fakeSRVServer struct {
+	mu       sync.Mutex
+	srvs     []*dns.SRV
+	servfail bool
+}
+
+func (s *fakeSRVServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if s.servfail {
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	if q.Name == "broken.arith." && q.Qtype != dns.TypeSRV {
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	switch q.Qtype {
+	case dns.TypeSRV:
+		for _, srv := range s.srvs {
+			m.Answer = append(m.Answer, srv)
+		}
+		// only the first target has its address in the additional section
+		if len(s.srvs) > 0 {
+			m.Extra = append(m.Extra, &dns.A{
+				Hdr: dns.RR_Header{Name: s.srvs[0].Target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			})
+		}
+	case dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("127.0.0.2"),
+		})
+	}
+	w.WriteMsg(m)
+}
+
+func (s *fakeSRVServer) set(servfail bool, srvs ...*dns.SRV) {
+	s.mu.Lock()
+	s.servfail = servfail
+	if srvs != nil {
+		s.srvs = srvs
+	}
+	s.mu.Unlock()
+}
+
+func newSRV(target string, priority, weight, port uint16, ttl uint32) *dns.SRV {
+	return &dns.SRV{
+		Hdr:      dns.RR_Header{Name: "_rpcx._tcp.arith.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+		Priority: priority,
+		Weight:   weight,
+		Port:     port,
+		Target:   target,
+	}
+}
+
+func TestDNSSRVDiscovery(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeSRVServer{}
+	fake.set(false, newSRV("a.arith.", 0, 10, 8972, 1), newSRV("b.arith.", 1, 0, 8973, 1))
+	server := &dns.Server{PacketConn: pc, Handler: fake}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	d, err := NewDNSSRVDiscovery(DNSSRVOption{
+		Name:       "_rpcx._tcp.arith",
+		Resolvers:  []string{pc.LocalAddr().String()},
+		MinRefresh: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pairs := d.GetServices()
+	if len(pairs) != 2 {
+		t.Fatalf("expect 2 servers but got %v", pairs)
+	}
+	if pairs[0].Key != "tcp@127.0.0.1:8972" || pairs[0].Value != "priority=0&weight=10&port=8972&target=a.arith." {
+		t.Errorf("unexpected server %s: %s", pairs[0].Key, pairs[0].Value)
+	}
+	if pairs[1].Key != "tcp@127.0.0.2:8973" || pairs[1].Value != "priority=1&weight=1&port=8973&target=b.arith." {
+		t.Errorf("unexpected server %s: %s", pairs[1].Key, pairs[1].Value)
+	}
+
+	// refreshed after the TTL
+	ch := d.WatchService()
+	fake.set(false, newSRV("a.arith.", 0, 10, 8974, 1))
+	select {
+	case pairs = <-ch:
+	case <-time.After(3 * time.Second):
+		t.Fatal("servers are not refreshed after the TTL")
+	}
+	if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8974" {
+		t.Fatalf("expect the refreshed server but got %v", pairs)
+	}
+
+	// unchanged servers are not pushed to watchers
+	select {
+	case pairs = <-ch:
+		t.Fatalf("expect no changes but got %v", pairs)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// targets which can't be resolved are skipped
+	fake.set(false, newSRV("a.arith.", 0, 10, 8976, 1), newSRV("broken.arith.", 0, 10, 8975, 1))
+	select {
+	case pairs = <-ch:
+	case <-time.After(3 * time.Second):
+		t.Fatal("servers are not refreshed after the TTL")
+	}
+	if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8976" {
+		t.Fatalf("expect the resolved server but got %v", pairs)
+	}
+
+	// lookup failures keep the last known servers
+	fake.set(true)
+	time.Sleep(1500 * time.Millisecond)
+	pairs = d.GetServices()
+	if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8976" {
+		t.Fatalf("expect the last known server but got %v", pairs)
+	}
+
+	d.SetFilter(func(kvp *KVPair) bool { return false })
+	if len(d.GetServices()) != 0 {
+		t.Errorf("expect servers are filtered")
+	}
+
+	// closing twice doesn't panic
+	d.Close()
+}
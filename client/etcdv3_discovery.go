@@ -0,0 +1,338 @@
+// +build etcd
+
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdV3Discovery is a etcd v3 service discovery.
+// It always returns the registered servers in etcd, and watches changes from the revision it has read,
+// so no changes are missed between reading and watching. After the revision is compacted, it reads all servers again.
+type EtcdV3Discovery struct {
+	basePath string
+	client   *clientv3.Client
+	// ownClient is true if the client is created by this discovery, and closed by it.
+	ownClient bool
+
+	pairsMu sync.RWMutex
+	servers map[string]string // all servers before filtering
+	pairs   []*KVPair
+	filter  ServiceDiscoveryFilter
+
+	chans []chan []*KVPair
+	mu    sync.Mutex
+
+	// -1 means it always retry to watch until etcd is ok, 0 means no retry.
+	RetriesAfterWatchFailed int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewEtcdV3Discovery returns a new EtcdV3Discovery.
+// config is used to connect etcd, for example to set TLS and authentication, and its Endpoints is replaced by etcdAddr.
+func NewEtcdV3Discovery(basePath string, servicePath string, etcdAddr []string, config *clientv3.Config) (ServiceDiscovery, error) {
+	client, err := newEtcdV3Client(etcdAddr, config)
+	if err != nil {
+		log.Infof("cannot create etcd client: %v", err)
+		return nil, err
+	}
+
+	d, err := newEtcdV3Discovery(strings.TrimSuffix(basePath, "/")+"/"+servicePath, client, true)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewEtcdV3DiscoveryTemplate returns a new EtcdV3Discovery template, which is cloned for services.
+func NewEtcdV3DiscoveryTemplate(basePath string, etcdAddr []string, config *clientv3.Config) (ServiceDiscovery, error) {
+	client, err := newEtcdV3Client(etcdAddr, config)
+	if err != nil {
+		log.Infof("cannot create etcd client: %v", err)
+		return nil, err
+	}
+
+	d, err := newEtcdV3Discovery(basePath, client, true)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewEtcdV3DiscoveryClient returns a new EtcdV3Discovery with specified client.
+// The client is not closed by the discovery.
+func NewEtcdV3DiscoveryClient(basePath string, client *clientv3.Client) (ServiceDiscovery, error) {
+	return newEtcdV3Discovery(basePath, client, false)
+}
+
+func newEtcdV3Client(etcdAddr []string, config *clientv3.Config) (*clientv3.Client, error) {
+	cfg := clientv3.Config{DialTimeout: 5 * time.Second}
+	if config != nil {
+		cfg = *config
+	}
+	cfg.Endpoints = etcdAddr
+	return clientv3.New(cfg)
+}
+
+func newEtcdV3Discovery(basePath string, client *clientv3.Client, ownClient bool) (*EtcdV3Discovery, error) {
+	if !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	if len(basePath) > 1 && strings.HasSuffix(basePath, "/") {
+		basePath = basePath[:len(basePath)-1]
+	}
+
+	d := &EtcdV3Discovery{
+		basePath:                basePath,
+		client:                  client,
+		ownClient:               ownClient,
+		RetriesAfterWatchFailed: -1,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	rev, err := d.load()
+	if err != nil {
+		log.Infof("cannot get services of %s from registry: %v", basePath, err)
+		d.cancel()
+		return nil, err
+	}
+
+	go d.watch(rev)
+	return d, nil
+}
+
+// Clone clones this ServiceDiscovery with new servicePath. Clones share the etcd client.
+func (d *EtcdV3Discovery) Clone(servicePath string) (ServiceDiscovery, error) {
+	return newEtcdV3Discovery(d.basePath+"/"+servicePath, d.client, false)
+}
+
+// SetFilter sets the filer, and filters current servers by it.
+func (d *EtcdV3Discovery) SetFilter(filter ServiceDiscoveryFilter) {
+	d.pairsMu.Lock()
+	d.filter = filter
+	d.pairs = d.filterServers()
+	d.pairsMu.Unlock()
+}
+
+// GetServices returns the servers
+func (d *EtcdV3Discovery) GetServices() []*KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive changes of servers.
+func (d *EtcdV3Discovery) WatchService() chan []*KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *EtcdV3Discovery) RemoveWatcher(ch chan []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+// load reads all servers and returns the revision of them.
+func (d *EtcdV3Discovery) load() (int64, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+	resp, err := d.client.Get(ctx, d.basePath+"/", clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	servers := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if k := d.serverKey(kv.Key); k != "" {
+			servers[k] = string(kv.Value)
+		}
+	}
+	d.update(servers)
+	return resp.Header.Revision, nil
+}
+
+// serverKey returns the server of a key, or "" if the key is not a server of the service.
+func (d *EtcdV3Discovery) serverKey(key []byte) string {
+	k := strings.TrimPrefix(string(key), d.basePath+"/")
+	if k == "" || strings.Contains(k, "/") {
+		return ""
+	}
+	return k
+}
+
+// filterServers returns sorted servers accepted by the filter. d.pairsMu must be held.
+func (d *EtcdV3Discovery) filterServers() []*KVPair {
+	pairs := make([]*KVPair, 0, len(d.servers))
+	for k, v := range d.servers {
+		pair := &KVPair{Key: k, Value: v}
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+// update replaces servers and notifies watchers.
+func (d *EtcdV3Discovery) update(servers map[string]string) {
+	d.pairsMu.Lock()
+	d.servers = servers
+	pairs := d.filterServers()
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		ch := ch
+		go func() {
+			defer func() {
+				recover()
+			}()
+			select {
+			case ch <- pairs:
+			case <-time.After(time.Minute):
+				log.Warn("chan is full and new change has been dropped")
+			}
+		}()
+	}
+	d.mu.Unlock()
+}
+
+func (d *EtcdV3Discovery) watch(rev int64) {
+	var tempDelay time.Duration
+	retry := d.RetriesAfterWatchFailed
+	for {
+		var err error
+		rev, err = d.watchFrom(rev)
+		if d.ctx.Err() != nil {
+			log.Info("discovery has been closed")
+			return
+		}
+
+		if err == rpctypes.ErrCompacted {
+			log.Warnf("revision %d of %s has been compacted, will reload", rev, d.basePath)
+			if rev, err = d.load(); err == nil {
+				continue
+			}
+		}
+		if err == nil {
+			// the watch chan is closed, for example because the cluster has lost its leader
+			select {
+			case <-time.After(time.Second):
+			case <-d.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if d.RetriesAfterWatchFailed >= 0 {
+			if retry <= 0 {
+				log.Errorf("can't watch %s: %v", d.basePath, err)
+				return
+			}
+			retry--
+		}
+		if tempDelay == 0 {
+			tempDelay = time.Second
+		} else {
+			tempDelay *= 2
+		}
+		if max := 30 * time.Second; tempDelay > max {
+			tempDelay = max
+		}
+		log.Warnf("can not watch (with retry %d, sleep %v): %s: %v", retry, tempDelay, d.basePath, err)
+		select {
+		case <-time.After(tempDelay):
+		case <-d.ctx.Done():
+			return
+		}
+		if rev, err = d.load(); err != nil {
+			rev = 0
+		}
+	}
+}
+
+// watchFrom watches changes after rev until the watch fails, and returns the last revision it has seen.
+// rpctypes.ErrCompacted is returned if rev has been compacted.
+func (d *EtcdV3Discovery) watchFrom(rev int64) (int64, error) {
+	if rev == 0 {
+		var err error
+		if rev, err = d.load(); err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(d.ctx))
+	defer cancel()
+	wch := d.client.Watch(ctx, d.basePath+"/", clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for resp := range wch {
+		if resp.CompactRevision != 0 {
+			return rev, rpctypes.ErrCompacted
+		}
+		if err := resp.Err(); err != nil {
+			return rev, err
+		}
+		if len(resp.Events) == 0 {
+			continue
+		}
+
+		d.pairsMu.RLock()
+		servers := make(map[string]string, len(d.servers))
+		for k, v := range d.servers {
+			servers[k] = v
+		}
+		d.pairsMu.RUnlock()
+
+		for _, ev := range resp.Events {
+			k := d.serverKey(ev.Kv.Key)
+			if k == "" {
+				continue
+			}
+			if ev.Type == mvccpb.DELETE {
+				delete(servers, k)
+			} else {
+				servers[k] = string(ev.Kv.Value)
+			}
+		}
+		d.update(servers)
+		rev = resp.Header.Revision
+	}
+	return rev, nil
+}
+
+// Close stops watching, and closes the etcd client if it is created by this discovery.
+func (d *EtcdV3Discovery) Close() {
+	d.cancel()
+	if d.ownClient {
+		d.client.Close()
+	}
+}
@@ -0,0 +1,115 @@
+// +build etcd
+
+package client
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEmbeddedEtcd starts an etcd server for tests and returns its client address.
+func startEmbeddedEtcd(t *testing.T) (string, func()) {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://" + freeAddr(t))
+	peerURL, _ := url.Parse("http://" + freeAddr(t))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + peerURL.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("etcd is not ready")
+	}
+	return clientURL.Host, e.Close
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestEtcdV3Discovery(t *testing.T) {
+	addr, stop := startEmbeddedEtcd(t)
+	defer stop()
+
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{addr}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx := context.Background()
+	cli.Put(ctx, "/rpcx_test/Arith/tcp@127.0.0.1:8972", "weight=1")
+	cli.Put(ctx, "/rpcx_test/Arith/tcp@127.0.0.1:8973", "weight=2&state=inactive")
+	cli.Put(ctx, "/rpcx_test/Echo/tcp@127.0.0.1:8974", "")
+
+	template, err := NewEtcdV3DiscoveryTemplate("/rpcx_test", []string{addr}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer template.Close()
+	d, err := template.Clone("Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if pairs := d.GetServices(); len(pairs) != 2 || pairs[0].Key != "tcp@127.0.0.1:8972" {
+		t.Fatalf("expected 2 servers of Arith, got %+v", pairs)
+	}
+	d.SetFilter(func(kvp *KVPair) bool { return kvp.Value == "weight=1" })
+	if pairs := d.GetServices(); len(pairs) != 1 {
+		t.Fatalf("expected 1 server accepted by the filter, got %+v", pairs)
+	}
+	d.SetFilter(nil)
+
+	ch := d.WatchService()
+	defer d.RemoveWatcher(ch)
+	cli.Put(ctx, "/rpcx_test/Arith/tcp@127.0.0.1:8975", "")
+	select {
+	case pairs := <-ch:
+		if len(pairs) != 3 {
+			t.Fatalf("expected 3 servers after put, got %+v", pairs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes are watched")
+	}
+
+	// recover from compaction
+	ed := d.(*EtcdV3Discovery)
+	rev, err := ed.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Delete(ctx, "/rpcx_test/Arith/tcp@127.0.0.1:8973")
+	resp, _ := cli.Put(ctx, "/rpcx_test/Other/tcp@127.0.0.1:8976", "")
+	if _, err := cli.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ed.watchFrom(rev); err == nil {
+		t.Fatal("expected watching a compacted revision to fail")
+	}
+	if _, err := ed.load(); err != nil {
+		t.Fatal(err)
+	}
+	if pairs := d.GetServices(); len(pairs) != 2 {
+		t.Fatalf("expected 2 servers after reloading, got %+v", pairs)
+	}
+}
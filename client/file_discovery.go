@@ -0,0 +1,244 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"gopkg.in/yaml.v2"
+)
+
+// FileServer is a server in the file of FileDiscovery.
+type FileServer struct {
+	// Address is the server address, for example tcp@127.0.0.1:8972.
+	Address string `yaml:"address" json:"address"`
+	// Metadata is the metadata of the server, for example weight and group.
+	Metadata map[string]string `yaml:"metadata" json:"metadata"`
+}
+
+// FileDiscovery is a service discovery based on a YAML or JSON file, which maps service paths to servers:
+//
+//	Arith:
+//	  - address: tcp@127.0.0.1:8972
+//	    metadata:
+//	      weight: 10
+//	  - address: tcp@127.0.0.1:8973
+//
+// The file is polled for changes. A file that fails to parse or validate, or has no servers for the service,
+// is ignored and the last known servers are kept.
+type FileDiscovery struct {
+	path        string
+	servicePath string
+	interval    time.Duration
+
+	pairsMu sync.RWMutex
+	servers []*KVPair // all servers before filtering
+	pairs   []*KVPair
+	filter  ServiceDiscoveryFilter
+
+	chans []chan []*KVPair
+	mu    sync.Mutex
+
+	content []byte
+	stopCh  chan struct{}
+}
+
+// NewFileDiscovery returns a new FileDiscovery of servicePath, which checks the file every interval.
+// Default interval is 5s.
+func NewFileDiscovery(path string, servicePath string, interval time.Duration) (ServiceDiscovery, error) {
+	return newFileDiscovery(path, servicePath, interval)
+}
+
+// NewFileDiscoveryTemplate returns a new FileDiscovery template, which is cloned for services.
+func NewFileDiscoveryTemplate(path string, interval time.Duration) (ServiceDiscovery, error) {
+	return newFileDiscovery(path, "", interval)
+}
+
+func newFileDiscovery(path string, servicePath string, interval time.Duration) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	d := &FileDiscovery{
+		path:        path,
+		servicePath: servicePath,
+		interval:    interval,
+		stopCh:      make(chan struct{}),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	go d.watch()
+	return d, nil
+}
+
+// Clone clones this ServiceDiscovery with new servicePath.
+func (d *FileDiscovery) Clone(servicePath string) (ServiceDiscovery, error) {
+	return newFileDiscovery(d.path, servicePath, d.interval)
+}
+
+// SetFilter sets the filer, and filters current servers by it.
+func (d *FileDiscovery) SetFilter(filter ServiceDiscoveryFilter) {
+	d.pairsMu.Lock()
+	d.filter = filter
+	d.pairs = d.filterServers()
+	d.pairsMu.Unlock()
+}
+
+// GetServices returns the servers
+func (d *FileDiscovery) GetServices() []*KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive changes of servers.
+func (d *FileDiscovery) WatchService() chan []*KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *FileDiscovery) RemoveWatcher(ch chan []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+// ParseServersFile parses and validates the content of a FileDiscovery file.
+func ParseServersFile(data []byte) (map[string][]*KVPair, error) {
+	var services map[string][]FileServer
+	// JSON is a subset of YAML
+	if err := yaml.Unmarshal(data, &services); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]*KVPair, len(services))
+	for servicePath, servers := range services {
+		seen := make(map[string]bool, len(servers))
+		pairs := make([]*KVPair, 0, len(servers))
+		for _, s := range servers {
+			i := strings.Index(s.Address, "@")
+			if i <= 0 || i == len(s.Address)-1 {
+				return nil, fmt.Errorf("invalid address %q of %s, expect network@address", s.Address, servicePath)
+			}
+			if seen[s.Address] {
+				return nil, fmt.Errorf("duplicated address %q of %s", s.Address, servicePath)
+			}
+			seen[s.Address] = true
+
+			v := make(url.Values, len(s.Metadata))
+			for key, value := range s.Metadata {
+				v.Set(key, value)
+			}
+			pairs = append(pairs, &KVPair{Key: s.Address, Value: v.Encode()})
+		}
+		result[servicePath] = pairs
+	}
+	return result, nil
+}
+
+// load reads the file and updates servers if it has been changed.
+func (d *FileDiscovery) load() error {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	if d.content != nil && bytes.Equal(data, d.content) {
+		return nil
+	}
+
+	services, err := ParseServersFile(data)
+	if err != nil {
+		return err
+	}
+	servers := services[d.servicePath]
+	if d.servicePath != "" && len(servers) == 0 {
+		return errors.New("no servers of " + d.servicePath)
+	}
+	d.content = data
+
+	d.pairsMu.Lock()
+	d.servers = servers
+	pairs := d.filterServers()
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		ch := ch
+		go func() {
+			defer func() {
+				recover()
+			}()
+			select {
+			case ch <- pairs:
+			case <-time.After(time.Minute):
+				log.Warn("chan is full and new change has been dropped")
+			}
+		}()
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// filterServers returns sorted servers accepted by the filter. d.pairsMu must be held.
+func (d *FileDiscovery) filterServers() []*KVPair {
+	pairs := make([]*KVPair, 0, len(d.servers))
+	for _, pair := range d.servers {
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+func (d *FileDiscovery) watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	var lastErr string
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		// log the same error only once, because the file is checked repeatedly before it is fixed
+		if err := d.load(); err != nil {
+			if err.Error() != lastErr {
+				log.Errorf("ignore invalid servers file %s, keep last known servers: %v", d.path, err)
+			}
+			lastErr = err.Error()
+			continue
+		}
+		lastErr = ""
+	}
+}
+
+func (d *FileDiscovery) Close() {
+	close(d.stopCh)
+}
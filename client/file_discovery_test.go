@@ -0,0 +1,83 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpcx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers.yaml")
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+Arith:
+  - address: tcp@127.0.0.1:8973
+  - address: tcp@127.0.0.1:8972
+    metadata:
+      weight: 10
+      group: test
+`)
+
+	template, err := NewFileDiscoveryTemplate(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer template.Close()
+	d, err := template.Clone("Arith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pairs := d.GetServices()
+	if len(pairs) != 2 {
+		t.Fatalf("expect 2 servers but got %v", pairs)
+	}
+	if pairs[0].Key != "tcp@127.0.0.1:8972" || pairs[0].Value != "group=test&weight=10" {
+		t.Errorf("unexpected server %s: %s", pairs[0].Key, pairs[0].Value)
+	}
+
+	// JSON
+	ch := d.WatchService()
+	write(`{"Arith": [{"address": "tcp@127.0.0.1:8974", "metadata": {"weight": "5"}}]}`)
+	select {
+	case pairs = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("servers are not reloaded")
+	}
+	if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8974" || pairs[0].Value != "weight=5" {
+		t.Fatalf("expect the reloaded server but got %v", pairs)
+	}
+
+	// bad edits keep the last known servers
+	for _, content := range []string{
+		`Arith: [`,
+		`Arith: []`,
+		`Other: [{address: tcp@127.0.0.1:8972}]`,
+		`Arith: [{address: 127.0.0.1:8972}]`,
+		`Arith: [{address: tcp@127.0.0.1:8972}, {address: tcp@127.0.0.1:8972}]`,
+	} {
+		write(content)
+		time.Sleep(150 * time.Millisecond)
+		pairs = d.GetServices()
+		if len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:8974" {
+			t.Fatalf("expect the last known server after %q but got %v", content, pairs)
+		}
+	}
+
+	if _, err := NewFileDiscovery(path, "Arith", 0); err == nil {
+		t.Error("expect an error of the invalid file")
+	}
+}
@@ -0,0 +1,306 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcCodec encodes messages by the protobuf codec of rpcx, so gogo and golang protobuf messages both work.
+// Raw payloads ([]byte) are sent as is.
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case *[]byte:
+		return *data, nil
+	}
+	return share.Codecs[protocol.ProtoBuffer].Encode(v)
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	if p, ok := v.(*[]byte); ok {
+		*p = append((*p)[:0], data...)
+		return nil
+	}
+	return share.Codecs[protocol.ProtoBuffer].Decode(data, v)
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+// GRPCClient is a RPCClient that calls services by the gRPC protocol.
+// It can call rpcx services served with gRPC enabled and gRPC services implemented by grpc-go.
+// Args and replies must be protobuf messages.
+type GRPCClient struct {
+	option Option
+
+	mu      sync.Mutex
+	conn    *grpc.ClientConn
+	address string
+	closing bool
+}
+
+// NewGRPCClient returns a new GRPCClient with the option.
+func NewGRPCClient(option Option) *GRPCClient {
+	return &GRPCClient{
+		option: option,
+	}
+}
+
+// Connect connects the server via specified network.
+// The network is ignored because gRPC always runs over tcp.
+func (c *GRPCClient) Connect(network, address string) error {
+	opts := []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})),
+	}
+	if c.option.TLSConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(c.option.TLSConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	ctx := context.Background()
+	if c.option.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.option.ConnectTimeout)
+		defer cancel()
+	}
+
+	conn, err := grpc.DialContext(ctx, address, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to dial grpc server %s: %w", address, err)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.address = address
+	c.mu.Unlock()
+	return nil
+}
+
+// Go invokes the function asynchronously.
+func (c *GRPCClient) Go(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := &Call{
+		ServicePath:   servicePath,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+	}
+	if done == nil {
+		done = make(chan *Call, 10) // buffered.
+	} else if cap(done) == 0 {
+		log.Panic("rpc: done channel is unbuffered")
+	}
+	call.Done = done
+
+	go func() {
+		call.ResMetadata, call.Error = c.invoke(ctx, servicePath, serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// Call invokes the named function, waits for it to complete, and returns its error status.
+func (c *GRPCClient) Call(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}) error {
+	resMetadata, err := c.invoke(ctx, servicePath, serviceMethod, args, reply)
+	if m, ok := ctx.Value(share.ResMetaDataKey).(map[string]string); ok {
+		for k, v := range resMetadata {
+			m[k] = v
+		}
+	}
+	return err
+}
+
+// SendRaw sends raw messages. The payload of r must be serialized by protobuf.
+func (c *GRPCClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]string, []byte, error) {
+	if r.SerializeType() != protocol.ProtoBuffer {
+		return nil, nil, fmt.Errorf("rpcx: grpc only supports ProtoBuffer but got %d", r.SerializeType())
+	}
+	if len(r.Metadata) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpcxMetadataToGRPCPairs(r.Metadata)...)
+	}
+
+	var reply []byte
+	resMetadata, err := c.invoke(ctx, r.ServicePath, r.ServiceMethod, r.Payload, &reply)
+	return resMetadata, reply, err
+}
+
+func (c *GRPCClient) invoke(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}) (map[string]string, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, ErrShutdown
+	}
+
+	if m, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok && len(m) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpcxMetadataToGRPCPairs(m)...)
+	}
+
+	var header metadata.MD
+	err := conn.Invoke(ctx, "/"+servicePath+"/"+serviceMethod, args, reply, grpc.Header(&header))
+
+	var resMetadata map[string]string
+	if len(header) > 0 {
+		resMetadata = make(map[string]string, len(header))
+		for k, v := range header {
+			if len(v) > 0 && k != "content-type" {
+				resMetadata[k] = v[0]
+			}
+		}
+	}
+	return resMetadata, convertGRPCError(err)
+}
+
+// convertGRPCError converts errors returned by services to ServiceError,
+// so that xclient doesn't drop the connection for them.
+func convertGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	case codes.Unavailable:
+		return err
+	}
+	return ServiceError(st.Message())
+}
+
+func rpcxMetadataToGRPCPairs(m map[string]string) []string {
+	kv := make([]string, 0, len(m)*2)
+	for k, v := range m {
+		if k == share.AuthKey {
+			kv = append(kv, "authorization", v)
+			continue
+		}
+		kv = append(kv, strings.ToLower(k), v)
+	}
+	return kv
+}
+
+// Close closes the grpc connection.
+func (c *GRPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return ErrShutdown
+	}
+	c.closing = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// RemoteAddr returns the remote address.
+func (c *GRPCClient) RemoteAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.address
+}
+
+// RegisterServerMessageChan is not supported by gRPC so it is a noop.
+func (c *GRPCClient) RegisterServerMessageChan(ch chan<- *protocol.Message) {}
+
+// UnregisterServerMessageChan is not supported by gRPC so it is a noop.
+func (c *GRPCClient) UnregisterServerMessageChan() {}
+
+// IsClosing client is closing or not.
+func (c *GRPCClient) IsClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// IsShutdown client is shutdown or not.
+func (c *GRPCClient) IsShutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn == nil || c.conn.GetState() == connectivity.Shutdown
+}
+
+// GetConn returns nil because the connections are managed by grpc.
+func (c *GRPCClient) GetConn() net.Conn {
+	return nil
+}
+
+// GRPCCacheClientBuilder generates and caches GRPCClients for xclients.
+// It is not registered by default. Register it for the "grpc" network with your option,
+// so servers can be discovered as "grpc@host:port":
+//
+//	client.RegisterCacheClientBuilder("grpc", client.NewGRPCCacheClientBuilder(opt))
+type GRPCCacheClientBuilder struct {
+	option Option
+
+	mu      sync.RWMutex
+	clients map[string]RPCClient
+}
+
+// NewGRPCCacheClientBuilder returns a GRPCCacheClientBuilder.
+func NewGRPCCacheClientBuilder(option Option) *GRPCCacheClientBuilder {
+	return &GRPCCacheClientBuilder{
+		option:  option,
+		clients: make(map[string]RPCClient),
+	}
+}
+
+// SetCachedClient caches the client for the server k.
+func (b *GRPCCacheClientBuilder) SetCachedClient(client RPCClient, k, servicePath, serviceMethod string) {
+	b.mu.Lock()
+	b.clients[k] = client
+	b.mu.Unlock()
+}
+
+// FindCachedClient returns the cached client of the server k.
+func (b *GRPCCacheClientBuilder) FindCachedClient(k, servicePath, serviceMethod string) RPCClient {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.clients[k]
+}
+
+// DeleteCachedClient removes the cached client of the server k.
+func (b *GRPCCacheClientBuilder) DeleteCachedClient(client RPCClient, k, servicePath, serviceMethod string) {
+	b.mu.Lock()
+	if b.clients[k] == client {
+		delete(b.clients, k)
+	}
+	b.mu.Unlock()
+}
+
+// GenerateClient creates a GRPCClient connected to the server k.
+func (b *GRPCCacheClientBuilder) GenerateClient(k, servicePath, serviceMethod string) (RPCClient, error) {
+	network, addr := splitNetworkAndAddress(k)
+	if network != "grpc" {
+		return nil, errors.New("rpcx: not a grpc server: " + k)
+	}
+	client := NewGRPCClient(b.option)
+	if err := client.Connect(network, addr); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
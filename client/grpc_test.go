@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	testutils "github.com/caser789/rpcj/_testutils"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCClient(t *testing.T) {
+	RegisterCacheClientBuilder("grpc", NewGRPCCacheClientBuilder(DefaultOption))
+
+	s := server.NewServer()
+	s.RegisterName("PBArith", new(PBArith), "")
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	addr := s.Address().String()
+
+	// call by xclient
+	d, _ := NewPeer2PeerDiscovery("grpc@"+addr, "")
+	xclient := NewXClient("PBArith", Failfast, RandomSelect, d, DefaultOption)
+	defer xclient.Close()
+
+	reply := &testutils.ProtoReply{}
+	err := xclient.Call(context.Background(), "Mul", &testutils.ProtoArgs{A: 10, B: 20}, reply)
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if reply.C != 200 {
+		t.Fatalf("expect 200 but got %d", reply.C)
+	}
+
+	// rpcx calls still work on the same port
+	rpcxClient := NewClient(DefaultOption)
+	if err := rpcxClient.Connect("tcp", addr); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer rpcxClient.Close()
+	r := &Reply{}
+	if err := rpcxClient.Call(context.Background(), "Arith", "Mul", &Args{A: 2, B: 3}, r); err != nil || r.C != 6 {
+		t.Fatalf("failed to call by rpcx: %v, %d", err, r.C)
+	}
+
+	// call by grpc-go with a package name
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	reply = &testutils.ProtoReply{}
+	err = conn.Invoke(context.Background(), "/testutils.PBArith/Mul", &testutils.ProtoArgs{A: 3, B: 4}, reply)
+	if err != nil {
+		t.Fatalf("failed to invoke: %v", err)
+	}
+	if reply.C != 12 {
+		t.Fatalf("expect 12 but got %d", reply.C)
+	}
+
+	err = conn.Invoke(context.Background(), "/PBArith/Div", &testutils.ProtoArgs{A: 3, B: 4}, reply)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expect Unimplemented but got %v", err)
+	}
+}
+
+func TestGRPCClient_Auth(t *testing.T) {
+	RegisterCacheClientBuilder("grpc", NewGRPCCacheClientBuilder(DefaultOption))
+
+	s := server.NewServer()
+	s.AuthFunc = func(ctx context.Context, req *protocol.Message, token string) error {
+		if token == "bearer tGzv3JOkF0XG5Qx2TlKWIA" {
+			return nil
+		}
+		return errors.New("invalid token")
+	}
+	s.RegisterName("PBArith", new(PBArith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := NewPeer2PeerDiscovery("grpc@"+s.Address().String(), "")
+	xclient := NewXClient("PBArith", Failfast, RandomSelect, d, DefaultOption)
+	defer xclient.Close()
+
+	reply := &testutils.ProtoReply{}
+	err := xclient.Call(context.Background(), "Mul", &testutils.ProtoArgs{A: 10, B: 20}, reply)
+	if _, ok := err.(ServiceError); !ok {
+		t.Fatalf("expect auth error but got %v", err)
+	}
+
+	xclient.Auth("bearer tGzv3JOkF0XG5Qx2TlKWIA")
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{})
+	err = xclient.Call(ctx, "Mul", &testutils.ProtoArgs{A: 10, B: 20}, reply)
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+}
+
+type slowPBArith int
+
+func (t *slowPBArith) Mul(ctx context.Context, args *testutils.ProtoArgs, reply *testutils.ProtoReply) error {
+	time.Sleep(200 * time.Millisecond)
+	reply.C = args.A * args.B
+	return nil
+}
+
+func TestGRPCClient_Shutdown(t *testing.T) {
+	RegisterCacheClientBuilder("grpc", NewGRPCCacheClientBuilder(DefaultOption))
+
+	s := server.NewServer()
+	s.RegisterName("PBArith", new(slowPBArith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := NewPeer2PeerDiscovery("grpc@"+s.Address().String(), "")
+	xclient := NewXClient("PBArith", Failfast, RandomSelect, d, DefaultOption)
+	defer xclient.Close()
+
+	done := make(chan error, 1)
+	reply := &testutils.ProtoReply{}
+	go func() {
+		done <- xclient.Call(context.Background(), "Mul", &testutils.ProtoArgs{A: 10, B: 20}, reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the call in flight is finished before the grpc server is stopped
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+	if err := <-done; err != nil || reply.C != 200 {
+		t.Fatalf("expect the call in flight finished but got %v, %d", err, reply.C)
+	}
+}
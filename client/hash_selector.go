@@ -0,0 +1,311 @@
+package client
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/caser789/rpcj/share"
+)
+
+type hashKeyCtxKey struct{}
+
+// WithHashKey returns a context whose calls are routed by key in hash based select modes,
+// instead of the hash of service path, method and args.
+// The key can also be set by share.HashKey in the metadata of requests.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+// hashKey returns the hash of the key set by WithHashKey or share.HashKey,
+// or the hash of servicePath, serviceMethod and args if no key is set.
+func hashKey(ctx context.Context, servicePath, serviceMethod string, args interface{}) uint64 {
+	if ctx != nil {
+		if key, ok := ctx.Value(hashKeyCtxKey{}).(string); ok {
+			return HashString(key)
+		}
+		if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+			if key, ok := meta[share.HashKey]; ok {
+				return HashString(key)
+			}
+		}
+	}
+	return genKey(servicePath, serviceMethod, args)
+}
+
+// mix64 is the finalizer of splitmix64, which spreads fnv hashes of similar strings.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// HashSelectorOption contains options of ring-hash and Maglev selectors.
+type HashSelectorOption struct {
+	// VirtualNodes is the number of virtual nodes on the ring for each unit of weight. Default is 100.
+	VirtualNodes int
+	// TableSize is the size of the Maglev lookup table.
+	// It should be much larger than the number of servers, and is rounded up to a prime. Default is 65537.
+	TableSize int
+	// LoadFactor bounds in-flight calls of each server to LoadFactor times its weighted share of all in-flight calls.
+	// Keys of overloaded servers move to next servers on the ring or in the table.
+	// It should be larger than 1, and zero disables bounded load.
+	LoadFactor float64
+}
+
+// DefaultHashSelectorOption is used by RingHash and Maglev select modes.
+var DefaultHashSelectorOption = HashSelectorOption{
+	VirtualNodes: 100,
+	TableSize:    65537,
+	LoadFactor:   1.25,
+}
+
+// loadAwareSelector is a selector that balances by in-flight calls of servers.
+// XClient sets load to a function returning the number of in-flight calls of a server.
+type loadAwareSelector interface {
+	setLoad(load func(server string) int)
+}
+
+// boundedLoad checks loads of servers against their capacities.
+type boundedLoad struct {
+	factor      float64
+	load        func(server string) int
+	weights     map[string]int
+	totalWeight int
+}
+
+func newBoundedLoad(factor float64, servers map[string]string) boundedLoad {
+	bl := boundedLoad{factor: factor, weights: make(map[string]int, len(servers))}
+	for _, w := range createWeighted(servers) {
+		if w.Weight <= 0 {
+			w.Weight = 1
+		}
+		bl.weights[w.Server] = w.Weight
+		bl.totalWeight += w.Weight
+	}
+	return bl
+}
+
+func (bl *boundedLoad) setLoad(load func(server string) int) {
+	bl.load = load
+}
+
+func (bl *boundedLoad) enabled() bool {
+	return bl.factor > 0 && bl.load != nil && bl.totalWeight > 0
+}
+
+// capacities returns loads of servers and their capacities including the call being selected.
+func (bl *boundedLoad) capacities() (loads map[string]int, capacity func(server string) int) {
+	loads = make(map[string]int, len(bl.weights))
+	total := 1
+	for s := range bl.weights {
+		l := bl.load(s)
+		loads[s] = l
+		total += l
+	}
+	return loads, func(server string) int {
+		return int(math.Ceil(bl.factor * float64(total) * float64(bl.weights[server]) / float64(bl.totalWeight)))
+	}
+}
+
+// ringHashSelector selects servers by a hash ring with virtual nodes weighted by metadata "weight".
+type ringHashSelector struct {
+	opt     HashSelectorOption
+	hashes  []uint64
+	servers []string // servers[i] owns hashes[i]
+	boundedLoad
+}
+
+// NewRingHashSelector returns a ring-hash selector. It can be set by XClient.SetSelector.
+func NewRingHashSelector(servers map[string]string, opt HashSelectorOption) Selector {
+	if opt.VirtualNodes <= 0 {
+		opt.VirtualNodes = DefaultHashSelectorOption.VirtualNodes
+	}
+	s := &ringHashSelector{opt: opt}
+	s.UpdateServer(servers)
+	return s
+}
+
+func newRingHashSelector(servers map[string]string) Selector {
+	return NewRingHashSelector(servers, DefaultHashSelectorOption)
+}
+
+func (s *ringHashSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	if len(s.hashes) == 0 {
+		return ""
+	}
+
+	h := mix64(hashKey(ctx, servicePath, serviceMethod, args))
+	i := sort.Search(len(s.hashes), func(i int) bool { return s.hashes[i] >= h })
+	if i == len(s.hashes) {
+		i = 0
+	}
+	if !s.enabled() {
+		return s.servers[i]
+	}
+
+	loads, capacity := s.capacities()
+	for n := 0; n < len(s.hashes); n++ {
+		server := s.servers[(i+n)%len(s.hashes)]
+		if loads[server] < capacity(server) {
+			return server
+		}
+	}
+	return s.servers[i]
+}
+
+func (s *ringHashSelector) UpdateServer(servers map[string]string) {
+	load := s.load
+	s.boundedLoad = newBoundedLoad(s.opt.LoadFactor, servers)
+	s.boundedLoad.load = load
+
+	type node struct {
+		hash   uint64
+		server string
+	}
+	var nodes []node
+	for server, weight := range s.weights {
+		for i := 0; i < weight*s.opt.VirtualNodes; i++ {
+			nodes = append(nodes, node{mix64(HashString(server + "#" + strconv.Itoa(i))), server})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].hash == nodes[j].hash {
+			return nodes[i].server < nodes[j].server
+		}
+		return nodes[i].hash < nodes[j].hash
+	})
+
+	s.hashes = make([]uint64, len(nodes))
+	s.servers = make([]string, len(nodes))
+	for i, n := range nodes {
+		s.hashes[i] = n.hash
+		s.servers[i] = n.server
+	}
+}
+
+// maglevSelector selects servers by a Maglev lookup table weighted by metadata "weight".
+type maglevSelector struct {
+	opt     HashSelectorOption
+	table   []int // indexes of servers
+	servers []string
+	boundedLoad
+}
+
+// NewMaglevSelector returns a Maglev selector. It can be set by XClient.SetSelector.
+func NewMaglevSelector(servers map[string]string, opt HashSelectorOption) Selector {
+	if opt.TableSize <= 1 {
+		opt.TableSize = DefaultHashSelectorOption.TableSize
+	}
+	// servers can't fill the table if their skips share a factor with its size
+	opt.TableSize = nextPrime(opt.TableSize)
+	s := &maglevSelector{opt: opt}
+	s.UpdateServer(servers)
+	return s
+}
+
+// nextPrime returns the smallest prime not less than n.
+func nextPrime(n int) int {
+	for ; ; n++ {
+		prime := n > 1
+		for d := 2; d*d <= n; d++ {
+			if n%d == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
+
+func newMaglevSelector(servers map[string]string) Selector {
+	return NewMaglevSelector(servers, DefaultHashSelectorOption)
+}
+
+func (s *maglevSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	if len(s.servers) == 0 {
+		return ""
+	}
+
+	i := int(mix64(hashKey(ctx, servicePath, serviceMethod, args)) % uint64(len(s.table)))
+	if !s.enabled() {
+		return s.servers[s.table[i]]
+	}
+
+	loads, capacity := s.capacities()
+	for n := 0; n < len(s.table); n++ {
+		server := s.servers[s.table[(i+n)%len(s.table)]]
+		if loads[server] < capacity(server) {
+			return server
+		}
+	}
+	return s.servers[s.table[i]]
+}
+
+func (s *maglevSelector) UpdateServer(servers map[string]string) {
+	load := s.load
+	s.boundedLoad = newBoundedLoad(s.opt.LoadFactor, servers)
+	s.boundedLoad.load = load
+
+	s.servers = make([]string, 0, len(servers))
+	for server := range servers {
+		s.servers = append(s.servers, server)
+	}
+	sort.Strings(s.servers)
+	s.table = nil
+	if len(s.servers) == 0 {
+		return
+	}
+
+	m := uint64(s.opt.TableSize)
+	offsets := make([]uint64, len(s.servers))
+	skips := make([]uint64, len(s.servers))
+	next := make([]uint64, len(s.servers))
+	weights := make([]float64, len(s.servers))
+	targets := make([]float64, len(s.servers))
+	var maxWeight float64
+	for i, server := range s.servers {
+		offsets[i] = mix64(HashString(server)) % m
+		skips[i] = mix64(HashString(server+"#skip"))%(m-1) + 1
+		weights[i] = float64(s.weights[server]) / float64(s.totalWeight)
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
+		}
+	}
+
+	// Servers take turns to fill their preferred empty entries.
+	// A server skips its turns until its share of the table catches up with its weight.
+	table := make([]int, m)
+	for i := range table {
+		table[i] = -1
+	}
+	var filled uint64
+	for round := 1.0; filled < m; round++ {
+		for i := range s.servers {
+			if filled == m {
+				break
+			}
+			if round*weights[i] < targets[i] {
+				continue
+			}
+			targets[i] += maxWeight
+
+			for {
+				c := (offsets[i] + next[i]*skips[i]) % m
+				next[i]++
+				if table[c] < 0 {
+					table[c] = i
+					filled++
+					break
+				}
+			}
+		}
+	}
+	s.table = table
+}
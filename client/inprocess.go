@@ -0,0 +1,30 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/caser789/rpcj/util"
+)
+
+func init() {
+	ConnFactories[util.InprocessNetwork] = newInprocessConn
+}
+
+// newInprocessConn connects to a server in the process, which serves on the network "inprocess".
+func newInprocessConn(c *Client, network, address string) (net.Conn, error) {
+	conn, err := util.DialInprocess(address, c.option.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if c.option.TLSConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, c.option.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
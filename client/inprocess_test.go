@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/util"
+)
+
+func TestXClient_Inprocess(t *testing.T) {
+	ln, err := util.ListenInprocess("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	go s.ServeListener(util.InprocessNetwork, ln)
+	defer s.Close()
+
+	d, _ := NewPeer2PeerDiscovery("inprocess@"+ln.Addr().String(), "")
+	xclient := NewXClient("Arith", Failfast, RandomSelect, d, DefaultOption)
+	defer xclient.Close()
+
+	reply := &Reply{}
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if reply.C != 200 {
+		t.Fatalf("expect 200 but got %d", reply.C)
+	}
+
+	c := NewClient(DefaultOption)
+	if err := c.Connect("inprocess", "missing"); err == nil {
+		t.Fatal("expect an error of missing servers")
+	}
+}
@@ -0,0 +1,575 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+)
+
+// KubernetesDiscoveryOption contains options of KubernetesDiscovery.
+type KubernetesDiscoveryOption struct {
+	// APIServer is the URL of the Kubernetes API server, for example https://kubernetes.default.svc.
+	APIServer string
+	// Token is the bearer token to access the API server.
+	Token string
+	// HTTPClient is used to access the API server, for example with TLS configured. Default is http.DefaultClient.
+	HTTPClient *http.Client
+
+	Namespace string
+	// Service is the name of the Kubernetes service whose EndpointSlices are watched.
+	Service string
+	// PortName selects the port of EndpointSlices. Default is the first port.
+	PortName string
+	// Network of servers. Default is tcp.
+	Network string
+	// MetadataPrefix selects labels and annotations of pods as metadata of servers, without the prefix.
+	// For example, annotation rpcx.io/weight: "10" is metadata weight=10. Annotations override labels.
+	// Default is "rpcx.io/".
+	MetadataPrefix string
+	// PodSelector is a label selector of pods of the service, such as app=arith.
+	// Pods are listed for their metadata, and all pods in the namespace are listed if it is empty.
+	PodSelector string
+}
+
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesDiscovery watches EndpointSlices of a Kubernetes service.
+// Servers are endpoints of the service, and endpoints which are not ready, including terminating ones,
+// are in state=inactive so xclients stop sending calls to them.
+// Like kube-proxy, terminating endpoints which are still serving are used if no endpoints are ready.
+// Servers have metadata zone of the endpoint, and metadata from labels and annotations of their pods.
+type KubernetesDiscovery struct {
+	opt KubernetesDiscoveryOption
+
+	slices map[string]*k8sEndpointSlice // name -> slice
+	pods   map[string]map[string]string // uid -> metadata of pod
+
+	pairsMu sync.RWMutex
+	servers []*KVPair // all servers before filtering
+	pairs   []*KVPair
+	chans   []chan []*KVPair
+
+	mu sync.Mutex
+
+	filter ServiceDiscoveryFilter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewKubernetesDiscovery returns a new KubernetesDiscovery.
+func NewKubernetesDiscovery(opt KubernetesDiscoveryOption) (ServiceDiscovery, error) {
+	if opt.APIServer == "" || opt.Namespace == "" || opt.Service == "" {
+		return nil, errors.New("APIServer, Namespace and Service of kubernetes discovery must be set")
+	}
+	if opt.HTTPClient == nil {
+		opt.HTTPClient = http.DefaultClient
+	}
+	if opt.Network == "" {
+		opt.Network = "tcp"
+	}
+	if opt.MetadataPrefix == "" {
+		opt.MetadataPrefix = "rpcx.io/"
+	}
+	opt.APIServer = strings.TrimSuffix(opt.APIServer, "/")
+
+	d := &KubernetesDiscovery{opt: opt, pods: make(map[string]map[string]string)}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	rv, err := d.list()
+	if err != nil {
+		log.Infof("cannot get endpointslices of %s/%s: %v", opt.Namespace, opt.Service, err)
+		d.cancel()
+		return nil, err
+	}
+	go d.watch(rv)
+	return d, nil
+}
+
+// NewKubernetesInClusterDiscovery returns a new KubernetesDiscovery of a service,
+// which accesses the API server with the service account of the pod.
+// If namespace is empty, it is the namespace of the pod.
+func NewKubernetesInClusterDiscovery(namespace, service, portName string) (ServiceDiscovery, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster")
+	}
+
+	token, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	return NewKubernetesDiscovery(KubernetesDiscoveryOption{
+		APIServer: "https://" + net.JoinHostPort(host, port),
+		Token:     strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+		Namespace: namespace,
+		Service:   service,
+		PortName:  portName,
+	})
+}
+
+// Clone clones this ServiceDiscovery with new servicePath.
+// All services are served by the same kubernetes service, so the clone watches the same EndpointSlices.
+func (d *KubernetesDiscovery) Clone(servicePath string) (ServiceDiscovery, error) {
+	return NewKubernetesDiscovery(d.opt)
+}
+
+// SetFilter sets the filer, and filters current servers by it.
+func (d *KubernetesDiscovery) SetFilter(filter ServiceDiscoveryFilter) {
+	d.pairsMu.Lock()
+	d.filter = filter
+	d.pairs = d.filterServers()
+	d.pairsMu.Unlock()
+}
+
+// GetServices returns the servers
+func (d *KubernetesDiscovery) GetServices() []*KVPair {
+	d.pairsMu.RLock()
+	defer d.pairsMu.RUnlock()
+	return d.pairs
+}
+
+// WatchService returns a chan to receive changes of servers.
+func (d *KubernetesDiscovery) WatchService() chan []*KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *KubernetesDiscovery) RemoveWatcher(ch chan []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var chans []chan []*KVPair
+	for _, c := range d.chans {
+		if c == ch {
+			continue
+		}
+
+		chans = append(chans, c)
+	}
+
+	d.chans = chans
+}
+
+// Close stops watching.
+func (d *KubernetesDiscovery) Close() {
+	d.cancel()
+}
+
+type k8sObjectMeta struct {
+	Name            string            `json:"name"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+}
+
+type k8sEndpointSlice struct {
+	Metadata    k8sObjectMeta     `json:"metadata"`
+	AddressType string            `json:"addressType"`
+	Endpoints   []k8sEndpoint     `json:"endpoints"`
+	Ports       []k8sEndpointPort `json:"ports"`
+}
+
+type k8sEndpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready       *bool `json:"ready"`
+		Serving     *bool `json:"serving"`
+		Terminating *bool `json:"terminating"`
+	} `json:"conditions"`
+	TargetRef *struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+		UID  string `json:"uid"`
+	} `json:"targetRef"`
+	Zone *string `json:"zone"`
+}
+
+// ready returns whether the endpoint is ready. nil ready means ready.
+func (ep *k8sEndpoint) ready() bool {
+	return ep.Conditions.Ready == nil || *ep.Conditions.Ready
+}
+
+// servingTerminating returns whether the endpoint is terminating but still serving.
+func (ep *k8sEndpoint) servingTerminating() bool {
+	return ep.Conditions.Terminating != nil && *ep.Conditions.Terminating &&
+		ep.Conditions.Serving != nil && *ep.Conditions.Serving
+}
+
+type k8sEndpointPort struct {
+	Name *string `json:"name"`
+	Port *int32  `json:"port"`
+}
+
+type k8sEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*k8sEndpointSlice `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type k8sStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type k8sPod struct {
+	Metadata k8sObjectMeta `json:"metadata"`
+}
+
+type k8sPodList struct {
+	Items []*k8sPod `json:"items"`
+}
+
+// errGone is returned if the resource version to watch is too old.
+var errGone = errors.New("resource version is too old")
+
+func (d *KubernetesDiscovery) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, d.opt.APIServer+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if d.opt.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.opt.Token)
+	}
+
+	resp, err := d.opt.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		return nil, fmt.Errorf("kubernetes api server returns %s: %s", resp.Status, body)
+	}
+	return resp, nil
+}
+
+func (d *KubernetesDiscovery) slicesPath() string {
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", d.opt.Namespace)
+}
+
+func (d *KubernetesDiscovery) selector() url.Values {
+	return url.Values{"labelSelector": []string{"kubernetes.io/service-name=" + d.opt.Service}}
+}
+
+// list reads all EndpointSlices of the service and returns their resource version.
+func (d *KubernetesDiscovery) list() (string, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+	resp, err := d.get(ctx, d.slicesPath(), d.selector())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list k8sEndpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	d.slices = make(map[string]*k8sEndpointSlice, len(list.Items))
+	for _, slice := range list.Items {
+		d.slices[slice.Metadata.Name] = slice
+	}
+	d.update()
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (d *KubernetesDiscovery) watch(rv string) {
+	var tempDelay time.Duration
+	for {
+		var err error
+		rv, err = d.watchFrom(rv)
+		if d.ctx.Err() != nil {
+			log.Info("discovery has been closed")
+			return
+		}
+		if err == nil {
+			// the api server ends watches periodically
+			tempDelay = 0
+			continue
+		}
+
+		if err != errGone {
+			if tempDelay == 0 {
+				tempDelay = time.Second
+			} else {
+				tempDelay *= 2
+			}
+			if max := 30 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			log.Warnf("can not watch endpointslices (sleep %v): %s/%s: %v", tempDelay, d.opt.Namespace, d.opt.Service, err)
+			select {
+			case <-time.After(tempDelay):
+			case <-d.ctx.Done():
+				return
+			}
+		}
+		if newRV, err := d.list(); err == nil {
+			rv = newRV
+		}
+	}
+}
+
+// watchFrom watches changes after rv until the watch ends, and returns the last resource version it has seen.
+func (d *KubernetesDiscovery) watchFrom(rv string) (string, error) {
+	query := d.selector()
+	query.Set("watch", "1")
+	query.Set("resourceVersion", rv)
+	query.Set("allowWatchBookmarks", "true")
+	resp, err := d.get(d.ctx, d.slicesPath(), query)
+	if err != nil {
+		return rv, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev k8sWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			return rv, nil
+		}
+
+		if ev.Type == "ERROR" {
+			var status k8sStatus
+			json.Unmarshal(ev.Object, &status)
+			if status.Code == http.StatusGone {
+				return rv, errGone
+			}
+			return rv, fmt.Errorf("watch error: %s", status.Message)
+		}
+
+		var slice k8sEndpointSlice
+		if err := json.Unmarshal(ev.Object, &slice); err != nil {
+			return rv, err
+		}
+		if slice.Metadata.ResourceVersion != "" {
+			rv = slice.Metadata.ResourceVersion
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			d.slices[slice.Metadata.Name] = &slice
+		case "DELETED":
+			delete(d.slices, slice.Metadata.Name)
+		default: // BOOKMARK
+			continue
+		}
+		d.update()
+	}
+}
+
+// update converts endpoints to servers and notifies watchers.
+func (d *KubernetesDiscovery) update() {
+	pods := d.podsMetadata()
+	anyReady := false
+	for _, slice := range d.slices {
+		for _, ep := range slice.Endpoints {
+			if ep.ready() {
+				anyReady = true
+			}
+		}
+	}
+
+	var servers []*KVPair
+	seen := make(map[string]bool)
+	for _, slice := range d.slices {
+		port, ok := d.port(slice)
+		if !ok || (slice.AddressType != "IPv4" && slice.AddressType != "IPv6") {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			meta := url.Values{}
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				for k, v := range pods[ep.TargetRef.UID] {
+					meta.Set(k, v)
+				}
+			}
+			if ep.Zone != nil && meta.Get("zone") == "" {
+				meta.Set("zone", *ep.Zone)
+			}
+			if !ep.ready() && (anyReady || !ep.servingTerminating()) {
+				meta.Set("state", "inactive")
+			}
+
+			for _, addr := range ep.Addresses {
+				key := d.opt.Network + "@" + net.JoinHostPort(addr, strconv.Itoa(port))
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				servers = append(servers, &KVPair{Key: key, Value: meta.Encode()})
+			}
+		}
+	}
+	d.pairsMu.Lock()
+	d.servers = servers
+	pairs := d.filterServers()
+	d.pairs = pairs
+	d.pairsMu.Unlock()
+
+	d.mu.Lock()
+	for _, ch := range d.chans {
+		ch := ch
+		go func() {
+			defer func() {
+				recover()
+			}()
+			select {
+			case ch <- pairs:
+			case <-time.After(time.Minute):
+				log.Warn("chan is full and new change has been dropped")
+			}
+		}()
+	}
+	d.mu.Unlock()
+}
+
+// port returns the port of a slice selected by PortName.
+func (d *KubernetesDiscovery) port(slice *k8sEndpointSlice) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if d.opt.PortName == "" || (p.Name != nil && *p.Name == d.opt.PortName) {
+			return int(*p.Port), true
+		}
+	}
+	return 0, false
+}
+
+// podsMetadata returns metadata of pods of endpoints by their uid.
+// Pods which are not cached are listed in one call, and pods which can't be listed are not cached,
+// so they are listed again in the next update.
+func (d *KubernetesDiscovery) podsMetadata() map[string]map[string]string {
+	pods := make(map[string]map[string]string)
+	missing := false
+	for _, slice := range d.slices {
+		for _, ep := range slice.Endpoints {
+			if ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" || ep.TargetRef.UID == "" {
+				continue
+			}
+			uid := ep.TargetRef.UID
+			if meta, ok := d.pods[uid]; ok {
+				pods[uid] = meta
+			} else {
+				pods[uid] = nil
+				missing = true
+			}
+		}
+	}
+	if !missing {
+		d.pods = pods
+		return pods
+	}
+
+	listed, err := d.listPods()
+	if err != nil {
+		log.Warnf("cannot list pods of %s/%s: %v", d.opt.Namespace, d.opt.Service, err)
+	}
+	for uid, meta := range pods {
+		if meta != nil {
+			continue
+		}
+		if meta, ok := listed[uid]; ok {
+			pods[uid] = meta
+		} else {
+			delete(pods, uid)
+		}
+	}
+	d.pods = pods
+	return pods
+}
+
+// listPods returns metadata from labels and annotations of pods by their uid.
+func (d *KubernetesDiscovery) listPods() (map[string]map[string]string, error) {
+	var query url.Values
+	if d.opt.PodSelector != "" {
+		query = url.Values{"labelSelector": []string{d.opt.PodSelector}}
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+	resp, err := d.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods", d.opt.Namespace), query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list k8sPodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	pods := make(map[string]map[string]string, len(list.Items))
+	for _, pod := range list.Items {
+		meta := make(map[string]string)
+		for _, m := range []map[string]string{pod.Metadata.Labels, pod.Metadata.Annotations} {
+			for k, v := range m {
+				if strings.HasPrefix(k, d.opt.MetadataPrefix) {
+					meta[strings.TrimPrefix(k, d.opt.MetadataPrefix)] = v
+				}
+			}
+		}
+		pods[pod.Metadata.UID] = meta
+	}
+	return pods, nil
+}
+
+// filterServers returns sorted servers accepted by the filter. d.pairsMu must be held.
+func (d *KubernetesDiscovery) filterServers() []*KVPair {
+	pairs := make([]*KVPair, 0, len(d.servers))
+	for _, pair := range d.servers {
+		if d.filter != nil && !d.filter(pair) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
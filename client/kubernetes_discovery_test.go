@@ -0,0 +1,167 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes is a fake api server serving EndpointSlices and pods.
+type fakeKubernetes struct {
+	events chan string
+	// podLists counts lists of pods, and lists fail while failPods is set.
+	podLists int32
+	failPods int32
+}
+
+const fakeSlice = `{"metadata": {"name": "arith-abc", "resourceVersion": "%s"}, "addressType": "IPv4",
+	"ports": [{"name": "rpcx", "port": 8972}, {"name": "metrics", "port": 9090}],
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "zone": "a", "targetRef": {"kind": "Pod", "name": "arith-1", "uid": "u1"}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": %v, "serving": true, "terminating": true}, "zone": "b", "targetRef": {"kind": "Pod", "name": "arith-2", "uid": "u2"}}
+	]}`
+
+// fakeTerminatingSlice has only terminating endpoints, and arith-2 is still serving.
+const fakeTerminatingSlice = `{"metadata": {"name": "arith-abc", "resourceVersion": "%s"}, "addressType": "IPv4",
+	"ports": [{"name": "rpcx", "port": 8972}],
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": false, "serving": false, "terminating": true}, "targetRef": {"kind": "Pod", "name": "arith-1", "uid": "u1"}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": false, "serving": true, "terminating": true}, "targetRef": {"kind": "Pod", "name": "arith-2", "uid": "u2"}}
+	]}`
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/namespaces/default/pods":
+		atomic.AddInt32(&f.podLists, 1)
+		if atomic.LoadInt32(&f.failPods) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"items": [
+			{"metadata": {"name": "arith-1", "uid": "u1", "labels": {"app": "arith", "rpcx.io/group": "blue"}, "annotations": {"rpcx.io/weight": "10"}}},
+			{"metadata": {"name": "arith-2", "uid": "u2", "labels": {"rpcx.io/group": "green", "rpcx.io/zone": "c"}}}
+		]}`)
+	case "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices":
+		if r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=arith" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "1"}, "items": [`+fakeSlice+`]}`, "1", true)
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case ev := <-f.events:
+				fmt.Fprintln(w, ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	f := &fakeKubernetes{events: make(chan string, 1), failPods: 1}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	d, err := NewKubernetesDiscovery(KubernetesDiscoveryOption{
+		APIServer: ts.URL,
+		Token:     "token",
+		Namespace: "default",
+		Service:   "arith",
+		PortName:  "rpcx",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// pods can't be listed, so servers have no metadata of pods
+	pairs := d.GetServices()
+	if len(pairs) != 2 || pairs[0].Key != "tcp@10.0.0.1:8972" || pairs[1].Key != "tcp@10.0.0.2:8972" {
+		t.Fatalf("unexpected servers: %+v", pairs)
+	}
+	meta, _ := url.ParseQuery(pairs[0].Value)
+	if meta.Get("group") != "" || meta.Get("zone") != "a" {
+		t.Errorf("unexpected metadata without pods: %s", pairs[0].Value)
+	}
+
+	// failures are not cached, so pods are listed again in the next update
+	atomic.StoreInt32(&f.failPods, 0)
+	ch := d.WatchService()
+	f.events <- `{"type": "MODIFIED", "object": ` + fmt.Sprintf(fakeSlice, "2", true) + `}`
+	select {
+	case pairs = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes are watched")
+	}
+	if n := atomic.LoadInt32(&f.podLists); n != 2 {
+		t.Errorf("expected pods listed twice, got %d", n)
+	}
+	meta, _ = url.ParseQuery(pairs[0].Value)
+	if meta.Get("group") != "blue" || meta.Get("weight") != "10" || meta.Get("zone") != "a" || meta.Get("app") != "" {
+		t.Errorf("unexpected metadata of ready pod: %s", pairs[0].Value)
+	}
+	meta, _ = url.ParseQuery(pairs[1].Value)
+	if meta.Get("group") != "green" || meta.Get("zone") != "c" || meta.Get("state") != "" {
+		t.Errorf("unexpected metadata of pod arith-2: %s", pairs[1].Value)
+	}
+
+	f.events <- `{"type": "MODIFIED", "object": ` + fmt.Sprintf(fakeSlice, "3", false) + `}`
+	select {
+	case pairs = <-ch:
+		meta, _ = url.ParseQuery(pairs[1].Value)
+		if meta.Get("state") != "inactive" {
+			t.Errorf("expected the terminating pod to be inactive: %s", pairs[1].Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes are watched")
+	}
+
+	servers := map[string]string{pairs[0].Key: pairs[0].Value, pairs[1].Key: pairs[1].Value}
+	filterByStateAndGroup("", servers)
+	if len(servers) != 1 {
+		t.Errorf("expected the inactive pod filtered out, got %v", servers)
+	}
+	if n := atomic.LoadInt32(&f.podLists); n != 2 {
+		t.Errorf("expected pods cached, got %d lists", n)
+	}
+
+	// terminating endpoints which are still serving are used if no endpoints are ready
+	f.events <- `{"type": "MODIFIED", "object": ` + fmt.Sprintf(fakeTerminatingSlice, "4") + `}`
+	select {
+	case pairs = <-ch:
+		servers = map[string]string{pairs[0].Key: pairs[0].Value, pairs[1].Key: pairs[1].Value}
+		filterByStateAndGroup("", servers)
+		if len(servers) != 1 || servers["tcp@10.0.0.2:8972"] == "" {
+			t.Errorf("expected the serving pod used, got %+v", pairs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes are watched")
+	}
+
+	f.events <- `{"type": "DELETED", "object": ` + fmt.Sprintf(fakeSlice, "5", false) + `}`
+	select {
+	case pairs = <-ch:
+		if len(pairs) != 0 {
+			t.Errorf("expected no servers after the slice is deleted, got %+v", pairs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes are watched")
+	}
+}
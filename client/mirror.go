@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+// MirrorOption contains options of MirrorPlugin.
+type MirrorOption struct {
+	// Percent is the percentage of calls to mirror, in [0, 100].
+	Percent float64
+	// Methods overrides Percent for methods. Set 0 to stop mirroring a method.
+	Methods map[string]float64
+	// Timeout of mirrored calls. Default is 5s.
+	Timeout time.Duration
+	// MaxConcurrency limits mirrored calls in flight. Calls beyond it are not mirrored. Default is 100.
+	MaxConcurrency int
+	// SerializeType is used to copy args, so that callers can reuse args after calls return.
+	// Default is the SerializeType of DefaultOption.
+	SerializeType protocol.SerializeType
+}
+
+// MirrorPlugin mirrors calls to a shadow XClient as fire-and-forget copies, for example to validate new versions.
+// Responses and errors of shadow calls are discarded and never affect primary calls.
+// Shadow calls carry share.MirrorKey in their metadata, so servers can skip side effects.
+//
+// Args are copied while primary calls are sent, and calls are mirrored after their first attempts complete,
+// once for each call even if it is retried on other servers by FailMode.
+// Calls sent by SendRaw and Go are not mirrored.
+type MirrorPlugin struct {
+	shadow XClient
+	opt    MirrorOption
+
+	inflight int32
+	mirrored uint64
+	dropped  uint64
+}
+
+// NewMirrorPlugin creates a MirrorPlugin that mirrors calls to shadow.
+// The shadow XClient can use a separate ServiceDiscovery, or be selected by metadata with NewMirrorXClient.
+func NewMirrorPlugin(shadow XClient, opt MirrorOption) *MirrorPlugin {
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Second
+	}
+	if opt.MaxConcurrency <= 0 {
+		opt.MaxConcurrency = 100
+	}
+	if opt.SerializeType == protocol.SerializeNone {
+		opt.SerializeType = DefaultOption.SerializeType
+	}
+	return &MirrorPlugin{shadow: shadow, opt: opt}
+}
+
+// NewMirrorXClient creates a XClient of servers in d whose metadata contain labels, such as version=v2.
+func NewMirrorXClient(servicePath string, d ServiceDiscovery, labels map[string]string, option Option) XClient {
+	d = &filteredDiscovery{ServiceDiscovery: d, filter: LabelFilter(labels), chans: make(map[chan []*KVPair]filteredWatcher)}
+	return NewXClient(servicePath, Failfast, RandomSelect, d, option)
+}
+
+// filteredDiscovery filters servers of a ServiceDiscovery without changing its filter,
+// so the ServiceDiscovery can be shared with other xclients.
+type filteredDiscovery struct {
+	ServiceDiscovery
+	filter ServiceDiscoveryFilter
+
+	mu    sync.Mutex
+	chans map[chan []*KVPair]filteredWatcher
+}
+
+type filteredWatcher struct {
+	original chan []*KVPair
+	done     chan struct{}
+}
+
+func (d *filteredDiscovery) filterPairs(pairs []*KVPair) []*KVPair {
+	var filtered []*KVPair
+	for _, p := range pairs {
+		if d.filter(p) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+func (d *filteredDiscovery) GetServices() []*KVPair {
+	return d.filterPairs(d.ServiceDiscovery.GetServices())
+}
+
+func (d *filteredDiscovery) WatchService() chan []*KVPair {
+	ch := d.ServiceDiscovery.WatchService()
+	if ch == nil {
+		return nil
+	}
+
+	filtered := make(chan []*KVPair, 10)
+	w := filteredWatcher{original: ch, done: make(chan struct{})}
+	d.mu.Lock()
+	d.chans[filtered] = w
+	d.mu.Unlock()
+	go func() {
+		defer func() {
+			recover() // filtered is closed by the watcher
+		}()
+		for {
+			select {
+			case pairs, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case filtered <- d.filterPairs(pairs):
+				case <-w.done:
+					return
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return filtered
+}
+
+func (d *filteredDiscovery) RemoveWatcher(ch chan []*KVPair) {
+	d.mu.Lock()
+	w, ok := d.chans[ch]
+	delete(d.chans, ch)
+	d.mu.Unlock()
+	if ok {
+		close(w.done)
+		d.ServiceDiscovery.RemoveWatcher(w.original)
+	}
+}
+
+// Close only stops watching, because the ServiceDiscovery is shared.
+func (d *filteredDiscovery) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for filtered, w := range d.chans {
+		close(w.done)
+		d.ServiceDiscovery.RemoveWatcher(w.original)
+		delete(d.chans, filtered)
+	}
+}
+
+// LabelFilter returns a ServiceDiscoveryFilter that accepts servers whose metadata contain labels.
+func LabelFilter(labels map[string]string) ServiceDiscoveryFilter {
+	return func(kvp *KVPair) bool {
+		v, err := url.ParseQuery(kvp.Value)
+		if err != nil {
+			return false
+		}
+		for label, value := range labels {
+			if v.Get(label) != value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Stats returns the number of mirrored calls and the number of calls dropped by MaxConcurrency.
+func (p *MirrorPlugin) Stats() (mirrored, dropped uint64) {
+	return atomic.LoadUint64(&p.mirrored), atomic.LoadUint64(&p.dropped)
+}
+
+func (p *MirrorPlugin) percent(serviceMethod string) float64 {
+	if percent, ok := p.opt.Methods[serviceMethod]; ok {
+		return percent
+	}
+	return p.opt.Percent
+}
+
+// mirroredCall is a call being mirrored. Its args are copied while the primary call is sent.
+// skipped calls are not sampled or dropped by MaxConcurrency.
+type mirroredCall struct {
+	once    sync.Once
+	copied  chan struct{}
+	skipped bool
+	args    interface{}
+	err     error
+}
+
+// PreCall starts to copy args of the first attempt of a call if the call is sampled.
+// Later attempts of the call, retried by FailMode or sent to other servers by Broadcast and Fork, are not mirrored again.
+func (p *MirrorPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, args interface{}) error {
+	state := getCallState(ctx)
+	if state == nil || args == nil {
+		return nil
+	}
+	// attempts of Broadcast and Fork run concurrently, so only the first one decides
+	mc := &mirroredCall{copied: make(chan struct{})}
+	if _, loaded := state.mirrors.LoadOrStore(p, mc); loaded {
+		return nil
+	}
+	if percent := p.percent(serviceMethod); percent <= 0 || rand.Float64()*100 >= percent {
+		mc.skip()
+		return nil
+	}
+	if atomic.AddInt32(&p.inflight, 1) > int32(p.opt.MaxConcurrency) {
+		atomic.AddInt32(&p.inflight, -1)
+		atomic.AddUint64(&p.dropped, 1)
+		mc.skip()
+		return nil
+	}
+
+	go func() {
+		defer close(mc.copied)
+		mc.args, mc.err = p.copyArgs(args)
+	}()
+	return nil
+}
+
+func (mc *mirroredCall) skip() {
+	mc.skipped = true
+	close(mc.copied)
+}
+
+// PostCall mirrors the call in a new goroutine after its first attempt completes.
+// It waits until args are copied, so that callers can reuse args after calls return.
+func (p *MirrorPlugin) PostCall(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}, err error) error {
+	state := getCallState(ctx)
+	if state == nil {
+		return nil
+	}
+	v, _ := state.mirrors.Load(p)
+	mc, _ := v.(*mirroredCall)
+	if mc == nil {
+		return nil
+	}
+	<-mc.copied
+	if mc.skipped {
+		return nil
+	}
+	mc.once.Do(func() {
+		p.mirror(ctx, mc, servicePath, serviceMethod, reply)
+	})
+	return nil
+}
+
+// mirror sends the copied args to the shadow XClient, and releases the slot of MaxConcurrency when it is done.
+func (p *MirrorPlugin) mirror(ctx context.Context, mc *mirroredCall, servicePath, serviceMethod string, reply interface{}) {
+	if mc.err != nil || reply == nil || reflect.TypeOf(reply).Kind() != reflect.Ptr {
+		atomic.AddInt32(&p.inflight, -1)
+		if mc.err != nil {
+			log.Debugf("failed to copy args of %s.%s for mirroring: %v", servicePath, serviceMethod, mc.err)
+		}
+		return
+	}
+	shadowArgs := mc.args
+	shadowReply := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+
+	meta := map[string]string{share.MirrorKey: "true"}
+	if reqMeta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+		for k, v := range reqMeta {
+			if k != share.ServerTimeout {
+				meta[k] = v
+			}
+		}
+	}
+
+	atomic.AddUint64(&p.mirrored, 1)
+	go func() {
+		defer atomic.AddInt32(&p.inflight, -1)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("mirrored call %s.%s panics: %v", servicePath, serviceMethod, r)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.opt.Timeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, share.ReqMetaDataKey, meta)
+		if err := p.shadow.Call(ctx, serviceMethod, shadowArgs, shadowReply); err != nil && share.TraceEnabled() {
+			log.Debugf("mirrored call %s.%s failed: %v", servicePath, serviceMethod, err)
+		}
+	}()
+}
+
+// copyArgs deep copies args by encoding and decoding it.
+func (p *MirrorPlugin) copyArgs(args interface{}) (interface{}, error) {
+	t := reflect.TypeOf(args)
+	if t.Kind() != reflect.Ptr {
+		return args, nil
+	}
+
+	codec := share.Codecs[p.opt.SerializeType]
+	if codec == nil {
+		return nil, fmt.Errorf("codec %d is not registered", p.opt.SerializeType)
+	}
+	data, err := codec.Encode(args)
+	if err != nil {
+		return nil, err
+	}
+	copied := reflect.New(t.Elem()).Interface()
+	if err := codec.Decode(data, copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
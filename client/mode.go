@@ -1,5 +1,8 @@
 package client
 
+//go:generate enumer -type=FailMode
+//go:generate enumer -type=SelectMode
+
 //FailMode decides how clients action when clients fail to invoke services
 type FailMode int
 
@@ -30,6 +33,12 @@ const (
 	ConsistentHash
 	//Closest is selecting the closest server
 	Closest
+	//RingHash is selecting by a weighted hash ring with bounded load
+	RingHash
+	//Maglev is selecting by a weighted Maglev table with bounded load
+	Maglev
+	//ZoneAware is selecting servers in the same zone first, configured by Option.Locality
+	ZoneAware
 
 	// SelectByUser is selecting by implementation of users
 	SelectByUser = 1000
@@ -155,6 +155,15 @@ func (p *pluginContainer) DoWrapSelect(fn SelectFunc) SelectFunc {
 	return rt
 }
 
+// DoBreakerStateChange is called when the state of a breaker changes.
+func (p *pluginContainer) DoBreakerStateChange(servicePath, serviceMethod, server string, from, to BreakerState) {
+	for i := range p.plugins {
+		if plugin, ok := p.plugins[i].(BreakerStateChangePlugin); ok {
+			plugin.BreakerStateChange(servicePath, serviceMethod, server, from, to)
+		}
+	}
+}
+
 type (
 	// PreCallPlugin is invoked before the client calls a server.
 	PreCallPlugin interface {
@@ -196,6 +205,12 @@ type (
 		WrapSelect(SelectFunc) SelectFunc
 	}
 
+	// BreakerStateChangePlugin is invoked when the state of a StatefulBreaker changes.
+	// serviceMethod is empty for breakers of servers.
+	BreakerStateChangePlugin interface {
+		BreakerStateChange(servicePath, serviceMethod, server string, from, to BreakerState)
+	}
+
 	//PluginContainer represents a plugin container that defines all methods to manage plugins.
 	//And it also defines all extension points.
 	PluginContainer interface {
@@ -215,4 +230,10 @@ type (
 
 		DoWrapSelect(SelectFunc) SelectFunc
 	}
+
+	// BreakerStateChangeNotifier is implemented by plugin containers which notify plugins of state changes of breakers.
+	// The default plugin container implements it, and customized ones may implement it optionally.
+	BreakerStateChangeNotifier interface {
+		DoBreakerStateChange(servicePath, serviceMethod, server string, from, to BreakerState)
+	}
 )
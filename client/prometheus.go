@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type prometheusStartKey struct{}
+
+// PrometheusPlugin collects metrics of rpc calls and exposes them in the Prometheus format.
+// Calls are labeled by service, method and code ("OK" or "Error").
+type PrometheusPlugin struct {
+	Registry *prometheus.Registry
+
+	calls        *prometheus.CounterVec
+	latency      *prometheus.HistogramVec
+	inflight     *prometheus.GaugeVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	connections  prometheus.Gauge
+	breakers     *breakerCollector
+}
+
+// NewPrometheusPlugin creates a new PrometheusPlugin and registers its collectors in registry.
+// If registry is nil, a new registry is created.
+func NewPrometheusPlugin(namespace string, registry *prometheus.Registry) *PrometheusPlugin {
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+
+	p := &PrometheusPlugin{
+		Registry: registry,
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "calls_total",
+			Help:      "Total number of calls sent by the client.",
+		}, []string{"service", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "call_seconds",
+			Help:      "Latency of calls sent by the client.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service", "method", "code"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "inflight_calls",
+			Help:      "Number of calls waiting for responses.",
+		}, []string{"service", "method"}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "request_size_bytes",
+			Help:      "Payload size of requests sent by the client.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"service", "method"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "response_size_bytes",
+			Help:      "Payload size of responses received by the client.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"service", "method"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "client",
+			Name:      "connections",
+			Help:      "Number of open connections to servers.",
+		}),
+		breakers: &breakerCollector{
+			desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "client", "breaker_state"),
+				"State of circuit breakers: closed (0), half-open (1) or open (2). The method is empty for breakers of servers.",
+				[]string{"service", "server", "method"}, nil),
+		},
+	}
+
+	registry.MustRegister(p.calls, p.latency, p.inflight, p.requestSize, p.responseSize, p.connections, p.breakers)
+
+	return p
+}
+
+// Handler returns a http.Handler that serves the collected metrics.
+func (p *PrometheusPlugin) Handler() http.Handler {
+	return promhttp.HandlerFor(p.Registry, promhttp.HandlerOpts{})
+}
+
+// WatchXClient exports states of breakers of xc.
+func (p *PrometheusPlugin) WatchXClient(xc XClient) {
+	if c, ok := xc.(*xClient); ok {
+		p.breakers.add(c)
+	}
+}
+
+// PreCall marks the start time of calls and counts them as in flight.
+func (p *PrometheusPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, args interface{}) error {
+	if rpcxContext, ok := ctx.(*share.Context); ok {
+		rpcxContext.SetValue(prometheusStartKey{}, time.Now())
+		p.inflight.WithLabelValues(servicePath, serviceMethod).Inc()
+	}
+	return nil
+}
+
+// PostCall counts calls and their latency.
+// Calls are only removed from in-flight calls if PreCall of this plugin counted them,
+// since PreCall of plugins after a failed one is skipped while PostCall is always called.
+func (p *PrometheusPlugin) PostCall(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}, err error) error {
+	code := "OK"
+	if err != nil {
+		code = "Error"
+	}
+	p.calls.WithLabelValues(servicePath, serviceMethod, code).Inc()
+
+	if start, ok := ctx.Value(prometheusStartKey{}).(time.Time); ok {
+		p.inflight.WithLabelValues(servicePath, serviceMethod).Dec()
+		p.latency.WithLabelValues(servicePath, serviceMethod, code).Observe(time.Since(start).Seconds())
+		if rpcxContext, ok := ctx.(*share.Context); ok {
+			rpcxContext.SetValue(prometheusStartKey{}, nil)
+		}
+	}
+	return nil
+}
+
+// ConnCreated counts connections to servers.
+func (p *PrometheusPlugin) ConnCreated(conn net.Conn) (net.Conn, error) {
+	p.connections.Inc()
+	return conn, nil
+}
+
+// ClientConnectionClose counts closed connections.
+func (p *PrometheusPlugin) ClientConnectionClose(conn net.Conn) error {
+	p.connections.Dec()
+	return nil
+}
+
+// ClientBeforeEncode observes sizes of requests.
+func (p *PrometheusPlugin) ClientBeforeEncode(req *protocol.Message) error {
+	if req.ServicePath == "" {
+		return nil
+	}
+	p.requestSize.WithLabelValues(req.ServicePath, req.ServiceMethod).Observe(float64(len(req.Payload)))
+	return nil
+}
+
+// ClientAfterDecode observes sizes of responses.
+func (p *PrometheusPlugin) ClientAfterDecode(res *protocol.Message) error {
+	if res.ServicePath == "" || res.MessageType() != protocol.Response {
+		return nil
+	}
+	p.responseSize.WithLabelValues(res.ServicePath, res.ServiceMethod).Observe(float64(len(res.Payload)))
+	return nil
+}
+
+// breakerCollector reports states of breakers of xclients when metrics are scraped.
+type breakerCollector struct {
+	desc *prometheus.Desc
+
+	mu       sync.Mutex
+	xclients []*xClient
+}
+
+func (bc *breakerCollector) add(c *xClient) {
+	bc.mu.Lock()
+	bc.xclients = append(bc.xclients, c)
+	bc.mu.Unlock()
+}
+
+func (bc *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bc.desc
+}
+
+func (bc *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	bc.mu.Lock()
+	xclients := bc.xclients
+	bc.mu.Unlock()
+
+	for _, c := range xclients {
+		c.breakers.Range(func(k, v interface{}) bool {
+			state := float64(breakerState(v.(Breaker)))
+			ch <- prometheus.MustNewConstMetric(bc.desc, prometheus.GaugeValue, state, c.servicePath, k.(string), "")
+			return true
+		})
+		c.methodBreakers.Range(func(k, v interface{}) bool {
+			mk := k.(methodBreakerKey)
+			state := float64(breakerState(v.(Breaker)))
+			ch <- prometheus.MustNewConstMetric(bc.desc, prometheus.GaugeValue, state, c.servicePath, mk.server, mk.serviceMethod)
+			return true
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type failingPreCallPlugin struct{}
+
+func (failingPreCallPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, args interface{}) error {
+	return errors.New("failed")
+}
+
+func TestPrometheusPlugin(t *testing.T) {
+	s := server.NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	p := NewPrometheusPlugin("rpcx", nil)
+	plugins := NewPluginContainer()
+	// PreCall of p is skipped since the first plugin fails, but PostCall of p is called
+	plugins.Add(failingPreCallPlugin{})
+	plugins.Add(p)
+
+	d, _ := NewPeer2PeerDiscovery("tcp@"+s.Address().String(), "")
+	xclient := NewXClient("Arith", Failfast, RandomSelect, d, DefaultOption)
+	xclient.SetPlugins(plugins)
+	defer xclient.Close()
+
+	reply := &Reply{}
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if v := testutil.ToFloat64(p.inflight.WithLabelValues("Arith", "Mul")); v != 0 {
+		t.Errorf("expect no inflight calls but got %v", v)
+	}
+
+	plugins = NewPluginContainer()
+	plugins.Add(p)
+	plugins.Add(failingPreCallPlugin{})
+	xclient.SetPlugins(plugins)
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if err := xclient.Call(context.Background(), "Missing", &Args{}, reply); err == nil {
+		t.Fatal("expect an error of the missing method")
+	}
+
+	if v := testutil.ToFloat64(p.inflight.WithLabelValues("Arith", "Mul")); v != 0 {
+		t.Errorf("expect no inflight calls but got %v", v)
+	}
+	if v := testutil.ToFloat64(p.calls.WithLabelValues("Arith", "Mul", "OK")); v != 2 {
+		t.Errorf("expect 2 succeeded calls but got %v", v)
+	}
+	if v := testutil.ToFloat64(p.calls.WithLabelValues("Arith", "Missing", "Error")); v != 1 {
+		t.Errorf("expect 1 failed call but got %v", v)
+	}
+	if n := testutil.CollectAndCount(p.latency); n != 2 {
+		t.Errorf("expect latencies of Mul and Missing but got %d series", n)
+	}
+	if n := testutil.CollectAndCount(p.requestSize); n != 2 {
+		t.Errorf("expect sizes of requests of Mul and Missing but got %d series", n)
+	}
+}
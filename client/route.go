@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/share"
+)
+
+// RouteRule routes calls matched by Match to subsets of servers.
+// For example, the following rule sends 5% of calls of Arith.Mul to servers with "version=v2" in their metadata:
+//
+//	{
+//		"name": "mul-canary",
+//		"match": {"service_path": "Arith", "service_method": "Mul"},
+//		"splits": [
+//			{"labels": {"version": "v1"}, "weight": 95},
+//			{"labels": {"version": "v2"}, "weight": 5}
+//		]
+//	}
+type RouteRule struct {
+	Name   string        `json:"name"`
+	Match  RouteMatch    `json:"match"`
+	Splits []*RouteSplit `json:"splits"`
+}
+
+// RouteMatch matches calls. Empty fields match all calls.
+type RouteMatch struct {
+	ServicePath   string `json:"service_path,omitempty"`
+	ServiceMethod string `json:"service_method,omitempty"`
+	// Metadata matches values of request metadata. "*" matches any present value.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// RouteSplit is a subset of servers with labels in their metadata, which receives calls in proportion to Weight.
+type RouteSplit struct {
+	Labels map[string]string `json:"labels"`
+	Weight int               `json:"weight"`
+}
+
+func (m *RouteMatch) match(ctx context.Context, servicePath, serviceMethod string) bool {
+	if m.ServicePath != "" && m.ServicePath != servicePath {
+		return false
+	}
+	if m.ServiceMethod != "" && m.ServiceMethod != serviceMethod {
+		return false
+	}
+	if len(m.Metadata) == 0 {
+		return true
+	}
+
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	for k, v := range m.Metadata {
+		value, ok := meta[k]
+		if !ok || (v != "*" && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// pick selects a split by weight, or returns nil if the rule has no splits with positive weights.
+func (r *RouteRule) pick() *RouteSplit {
+	total := 0
+	for _, s := range r.Splits {
+		if s.Weight > 0 {
+			total += s.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for _, s := range r.Splits {
+		if s.Weight <= 0 {
+			continue
+		}
+		n -= s.Weight
+		if n < 0 {
+			return s
+		}
+	}
+	return nil
+}
+
+// subset returns servers with all labels of the split.
+func (s *RouteSplit) subset(servers map[string]string) map[string]string {
+	subset := make(map[string]string)
+	for k, metadata := range servers {
+		v, err := url.ParseQuery(metadata)
+		if err != nil {
+			continue
+		}
+		matched := true
+		for label, value := range s.Labels {
+			if v.Get(label) != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			subset[k] = metadata
+		}
+	}
+	return subset
+}
+
+// Router routes calls of xclients by rules. It is set by Option.Router and can be shared by xclients.
+// The first rule matching a call decides the subset of servers to select from.
+// Calls not matched by any rule, and calls routed to empty subsets, select from all servers.
+type Router struct {
+	mu      sync.RWMutex
+	rules   []*RouteRule
+	version uint64
+
+	discovery ServiceDiscovery
+	ch        chan []*KVPair
+}
+
+// NewRouter returns a Router with rules.
+func NewRouter(rules []*RouteRule) *Router {
+	return &Router{rules: rules}
+}
+
+// NewRouterFromDiscovery returns a Router which loads rules from values of d in JSON,
+// and reloads them when d changes. Values of all keys are concatenated in the order of keys.
+// Invalid rules are logged and ignored.
+func NewRouterFromDiscovery(d ServiceDiscovery) *Router {
+	r := &Router{discovery: d}
+	r.load(d.GetServices())
+
+	ch := d.WatchService()
+	if ch != nil {
+		r.ch = ch
+		go func() {
+			for pairs := range ch {
+				r.load(pairs)
+			}
+		}()
+	}
+	return r
+}
+
+func (r *Router) load(pairs []*KVPair) {
+	pairs = append([]*KVPair(nil), pairs...)
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	var rules []*RouteRule
+	for _, p := range pairs {
+		var rs []*RouteRule
+		if err := json.Unmarshal([]byte(p.Value), &rs); err != nil {
+			log.Errorf("failed to parse route rules of %s: %v", p.Key, err)
+			continue
+		}
+		rules = append(rules, rs...)
+	}
+	r.Update(rules)
+}
+
+// Update replaces rules of the router.
+func (r *Router) Update(rules []*RouteRule) {
+	r.mu.Lock()
+	r.rules = rules
+	r.version++
+	r.mu.Unlock()
+}
+
+// Rules returns current rules.
+func (r *Router) Rules() []*RouteRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rules
+}
+
+// Close stops watching the discovery of rules.
+func (r *Router) Close() {
+	if r.discovery != nil && r.ch != nil {
+		r.discovery.RemoveWatcher(r.ch)
+	}
+}
+
+// route returns the split selected for the call and the version of rules, or nil if no rule matches.
+func (r *Router) route(ctx context.Context, servicePath, serviceMethod string) (*RouteSplit, uint64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.Match.match(ctx, servicePath, serviceMethod) {
+			return rule.pick(), r.version
+		}
+	}
+	return nil, r.version
+}
+
+// routeSelector returns the selector of the subset of servers routed by Option.Router, or the selector of all servers.
+// c.mu must be held.
+func (c *xClient) routeSelector(ctx context.Context, servicePath, serviceMethod string) Selector {
+	router := c.option.Router
+	if router == nil {
+		return c.selector
+	}
+
+	split, version := router.route(ctx, servicePath, serviceMethod)
+	if version != c.routeVersion {
+		c.routeSelectors = nil
+		c.routeVersion = version
+	}
+	if split == nil {
+		return c.selector
+	}
+
+	s, ok := c.routeSelectors[split]
+	if !ok {
+		if subset := split.subset(c.servers); len(subset) > 0 {
+			selectMode := c.selectMode
+			if selectMode == Closest || selectMode == SelectByUser {
+				selectMode = RandomSelect
+			}
+			s = newSelector(selectMode, subset, c.option)
+			c.bindSelector(s)
+		}
+		if c.routeSelectors == nil {
+			c.routeSelectors = make(map[*RouteSplit]Selector)
+		}
+		c.routeSelectors[split] = s
+	}
+	if s == nil {
+		return c.selector
+	}
+	return s
+}
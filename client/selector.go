@@ -22,7 +22,7 @@ type Selector interface {
 	UpdateServer(servers map[string]string)
 }
 
-func newSelector(selectMode SelectMode, servers map[string]string) Selector {
+func newSelector(selectMode SelectMode, servers map[string]string, option Option) Selector {
 	switch selectMode {
 	case RandomSelect:
 		return newRandomSelector(servers)
@@ -34,6 +34,12 @@ func newSelector(selectMode SelectMode, servers map[string]string) Selector {
 		return newWeightedICMPSelector(servers)
 	case ConsistentHash:
 		return newConsistentHashSelector(servers)
+	case RingHash:
+		return newRingHashSelector(servers)
+	case Maglev:
+		return newMaglevSelector(servers)
+	case ZoneAware:
+		return NewZoneAwareSelector(servers, option.Locality)
 	case SelectByUser:
 		return nil
 	default:
@@ -259,7 +265,7 @@ func (s consistentHashSelector) Select(ctx context.Context, servicePath, service
 		return ""
 	}
 
-	key := genKey(servicePath, serviceMethod, args)
+	key := hashKey(ctx, servicePath, serviceMethod, args)
 	selected, _ := s.h.Get(key).(string)
 	return selected
 }
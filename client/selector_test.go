@@ -1,7 +1,11 @@
 package client
 
 import (
+	"context"
+	"strconv"
 	"testing"
+
+	"github.com/caser789/rpcj/share"
 )
 
 func Test_consistentHashSelector_Select(t *testing.T) {
@@ -21,3 +25,202 @@ func Test_consistentHashSelector_Select(t *testing.T) {
 		}
 	}
 }
+
+func TestHashSelectors(t *testing.T) {
+	servers := map[string]string{
+		"tcp@192.168.1.16:9392": "weight=1",
+		"tcp@192.168.1.16:9393": "weight=3",
+		"tcp@192.168.1.16:9394": "",
+	}
+	opt := HashSelectorOption{VirtualNodes: 100, TableSize: 1021}
+
+	for name, s := range map[string]Selector{
+		"ringhash": NewRingHashSelector(servers, opt),
+		"maglev":   NewMaglevSelector(servers, opt),
+	} {
+		counts := make(map[string]int)
+		selected := make(map[string]string)
+		for i := 0; i < 10000; i++ {
+			key := strconv.Itoa(i)
+			server := s.Select(WithHashKey(context.Background(), key), "Arith", "Mul", i)
+			counts[server]++
+			selected[key] = server
+		}
+		if rate := float64(counts["tcp@192.168.1.16:9393"]) / 10000; rate < 0.5 || rate > 0.7 {
+			t.Errorf("%s: expected about 60%% of keys on the server with weight 3, got %v", name, counts)
+		}
+
+		// the hash key overrides args
+		ctx := WithHashKey(context.Background(), "42")
+		if s.Select(ctx, "Arith", "Mul", 1) != selected["42"] || s.Select(ctx, "Arith", "Add", 2) != selected["42"] {
+			t.Errorf("%s: expected calls with the same hash key to select the same server", name)
+		}
+		ctx = context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{share.HashKey: "42"})
+		if s.Select(ctx, "Arith", "Mul", 1) != selected["42"] {
+			t.Errorf("%s: expected the hash key in metadata to select %s", name, selected["42"])
+		}
+
+		// keys of remaining servers stay
+		s.UpdateServer(map[string]string{
+			"tcp@192.168.1.16:9392": "weight=1",
+			"tcp@192.168.1.16:9393": "weight=3",
+		})
+		moved := 0
+		for key, server := range selected {
+			if server == "tcp@192.168.1.16:9394" {
+				continue
+			}
+			if s.Select(WithHashKey(context.Background(), key), "Arith", "Mul", nil) != server {
+				moved++
+			}
+		}
+		if moved > 500 {
+			t.Errorf("%s: expected few keys to move after removing a server, but %d moved", name, moved)
+		}
+	}
+}
+
+func TestMaglevSelector_TableSize(t *testing.T) {
+	servers := map[string]string{
+		"tcp@192.168.1.16:9392": "",
+		"tcp@192.168.1.16:9393": "",
+		"tcp@192.168.1.16:9394": "",
+	}
+	// skips sharing a factor with a non-prime size would never fill the table
+	s := NewMaglevSelector(servers, HashSelectorOption{TableSize: 1000}).(*maglevSelector)
+	if len(s.table) != 1009 {
+		t.Fatalf("expect the table size rounded up to 1009 but got %d", len(s.table))
+	}
+	for i, server := range s.table {
+		if server < 0 {
+			t.Fatalf("expect the table is filled but entry %d is empty", i)
+		}
+	}
+}
+
+func TestHashSelectors_BoundedLoad(t *testing.T) {
+	servers := map[string]string{
+		"tcp@192.168.1.16:9392": "",
+		"tcp@192.168.1.16:9393": "",
+		"tcp@192.168.1.16:9394": "",
+	}
+	opt := HashSelectorOption{VirtualNodes: 100, TableSize: 1021, LoadFactor: 1.25}
+
+	for name, s := range map[string]Selector{
+		"ringhash": NewRingHashSelector(servers, opt),
+		"maglev":   NewMaglevSelector(servers, opt),
+	} {
+		loads := make(map[string]int)
+		s.(loadAwareSelector).setLoad(func(server string) int { return loads[server] })
+
+		ctx := WithHashKey(context.Background(), "hot")
+		hot := s.Select(ctx, "Arith", "Mul", nil)
+		for i := 0; i < 30; i++ {
+			loads[s.Select(ctx, "Arith", "Mul", nil)]++
+		}
+		for server, load := range loads {
+			if load > 13 { // ceil(1.25 * 30 / 3)
+				t.Errorf("%s: expected bounded load of %s, got %d", name, server, load)
+			}
+		}
+		if loads[hot] < 10 {
+			t.Errorf("%s: expected the hot key to stay on %s until it is full, got %v", name, hot, loads)
+		}
+
+		loads = make(map[string]int)
+		if s.Select(ctx, "Arith", "Mul", nil) != hot {
+			t.Errorf("%s: expected the hot key to return to %s", name, hot)
+		}
+	}
+}
+
+func TestZoneAwareSelector(t *testing.T) {
+	servers := map[string]string{
+		"tcp@10.0.1.1:8972": "zone=a&region=r1",
+		"tcp@10.0.1.2:8972": "zone=a&region=r1",
+		"tcp@10.0.2.1:8972": "zone=b&region=r1",
+		"tcp@10.1.1.1:8972": "zone=c&region=r2&priority=1",
+	}
+	s := NewZoneAwareSelector(servers, LocalityOption{Zone: "a", Region: "r1"})
+	unhealthy := make(map[string]bool)
+	s.(healthAwareSelector).setHealthy(func(server string) bool { return !unhealthy[server] })
+
+	selectN := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			counts[s.Select(context.Background(), "Arith", "Mul", nil)]++
+		}
+		return counts
+	}
+
+	counts := selectN(1000)
+	if counts["tcp@10.0.1.1:8972"]+counts["tcp@10.0.1.2:8972"] != 1000 {
+		t.Errorf("expected all calls in the same zone, got %v", counts)
+	}
+
+	// half of the zone is healthy, about 0.5/0.7 of calls stay
+	unhealthy["tcp@10.0.1.1:8972"] = true
+	counts = selectN(1000)
+	if counts["tcp@10.0.1.1:8972"] != 0 || counts["tcp@10.1.1.1:8972"] != 0 {
+		t.Errorf("expected no calls to unhealthy servers or the DR region, got %v", counts)
+	}
+	if n := counts["tcp@10.0.1.2:8972"]; n < 600 || n > 820 {
+		t.Errorf("expected about 714 calls in the same zone, got %v", counts)
+	}
+
+	// fail over to the DR region
+	unhealthy["tcp@10.0.1.2:8972"] = true
+	unhealthy["tcp@10.0.2.1:8972"] = true
+	counts = selectN(100)
+	if counts["tcp@10.1.1.1:8972"] != 100 {
+		t.Errorf("expected all calls to the DR region, got %v", counts)
+	}
+
+	filter := ChainFilters(RegionFilter("r1"), func(kvp *KVPair) bool { return kvp.Key != "tcp@10.0.2.1:8972" })
+	var accepted []string
+	for k, v := range servers {
+		if filter(&KVPair{Key: k, Value: v}) {
+			accepted = append(accepted, k)
+		}
+	}
+	if len(accepted) != 2 {
+		t.Errorf("expected 2 servers in zone a accepted by filters, got %v", accepted)
+	}
+}
+
+func TestZoneAwareSelector_ZoneWeights(t *testing.T) {
+	servers := map[string]string{
+		"tcp@10.0.1.1:8972": "zone=a&region=r1",
+		"tcp@10.0.1.2:8972": "zone=a&region=r1",
+		"tcp@10.0.1.3:8972": "zone=a&region=r1&state=inactive",
+		"tcp@10.0.1.4:8972": "zone=a&region=r1&state=inactive",
+		"tcp@10.0.2.1:8972": "zone=b&region=r1",
+	}
+	// servers are filtered by xclient before they are updated to selectors
+	filterByStateAndGroup("", servers)
+	// no breakers, so all servers are healthy
+	s := NewZoneAwareSelector(servers, LocalityOption{Zone: "a", Region: "r1", ZoneWeights: map[string]int{"a": 4}})
+
+	// half of the expected weight of the zone is active, about 0.5/0.7 of calls stay
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[s.Select(context.Background(), "Arith", "Mul", nil)]++
+	}
+	if n := counts["tcp@10.0.1.1:8972"] + counts["tcp@10.0.1.2:8972"]; n < 600 || n > 820 {
+		t.Errorf("expected about 714 calls in the same zone, got %v", counts)
+	}
+	if counts["tcp@10.0.2.1:8972"] == 0 {
+		t.Errorf("expected calls spilled over to zone b, got %v", counts)
+	}
+
+	// registered weights larger than expected ones are used
+	s.UpdateServer(map[string]string{
+		"tcp@10.0.1.1:8972": "zone=a&region=r1&weight=4",
+		"tcp@10.0.2.1:8972": "zone=b&region=r1",
+	})
+	for i := 0; i < 100; i++ {
+		if server := s.Select(context.Background(), "Arith", "Mul", nil); server != "tcp@10.0.1.1:8972" {
+			t.Fatalf("expected all calls in the same zone, got %s", server)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a StateCircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls pass and records their results.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a limited number of probe calls pass.
+	BreakerHalfOpen
+	// BreakerOpen rejects all calls.
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// StatefulBreaker is a Breaker that exposes its state and records latencies of calls.
+type StatefulBreaker interface {
+	Breaker
+	State() BreakerState
+	// Done records the result of a call admitted by Ready.
+	Done(err error, d time.Duration)
+	// OnStateChange sets a function to call when the state changes.
+	OnStateChange(fn func(from, to BreakerState))
+}
+
+// StateCircuitBreakerOption contains options of StateCircuitBreaker.
+// Zero values are replaced by defaults.
+type StateCircuitBreakerOption struct {
+	// Window is the length of the rolling window for counting calls. Default is 10s.
+	Window time.Duration
+	// Buckets is the number of buckets of the window. Default is 10.
+	Buckets int
+	// MinRequests is the minimum number of calls in the window before the breaker can trip. Default is 20.
+	MinRequests uint64
+	// ErrorRate trips the breaker if the rate of failed calls reaches it. Default is 0.5.
+	ErrorRate float64
+	// SlowCallRate trips the breaker if the rate of slow calls reaches it. Zero disables it.
+	SlowCallRate float64
+	// SlowCallDuration is the duration above which calls are slow. Default is 1s.
+	SlowCallDuration time.Duration
+	// OpenTimeout is how long the breaker stays open before probing. Default is 5s.
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of probe calls allowed in the half-open state.
+	// The breaker closes after all of them succeed, and opens again after any of them fails. Default is 3.
+	HalfOpenProbes int
+	// ProbeTimeout is how long admitted probes may go unreported in the half-open state.
+	// After it, their reservations are released so that new probes are admitted. Default is OpenTimeout.
+	ProbeTimeout time.Duration
+}
+
+type breakerBucket struct {
+	start    time.Time
+	total    uint64
+	failures uint64
+	slow     uint64
+}
+
+// StateCircuitBreaker is a circuit breaker with closed, open and half-open states.
+// It trips by the error rate or the slow call rate over a rolling bucketed window.
+type StateCircuitBreaker struct {
+	opt StateCircuitBreakerOption
+
+	mu            sync.Mutex
+	state         BreakerState
+	buckets       []breakerBucket
+	openedAt      time.Time
+	probes        int // admitted probes in half-open state
+	probeSuccess  int
+	probeAt       time.Time // when the last probe was admitted
+	onStateChange func(from, to BreakerState)
+}
+
+// NewStateCircuitBreaker returns a new StateCircuitBreaker.
+func NewStateCircuitBreaker(opt StateCircuitBreakerOption) *StateCircuitBreaker {
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.Buckets <= 0 {
+		opt.Buckets = 10
+	}
+	if opt.MinRequests == 0 {
+		opt.MinRequests = 20
+	}
+	if opt.ErrorRate <= 0 {
+		opt.ErrorRate = 0.5
+	}
+	if opt.SlowCallDuration <= 0 {
+		opt.SlowCallDuration = time.Second
+	}
+	if opt.OpenTimeout <= 0 {
+		opt.OpenTimeout = 5 * time.Second
+	}
+	if opt.HalfOpenProbes <= 0 {
+		opt.HalfOpenProbes = 3
+	}
+	if opt.ProbeTimeout <= 0 {
+		opt.ProbeTimeout = opt.OpenTimeout
+	}
+
+	return &StateCircuitBreaker{
+		opt:     opt,
+		buckets: make([]breakerBucket, opt.Buckets),
+	}
+}
+
+// Call calls fn if the breaker is ready and records its result.
+// fn is called in the current goroutine. If d is positive, it overrides SlowCallDuration for this call.
+func (cb *StateCircuitBreaker) Call(fn func() error, d time.Duration) error {
+	if !cb.Ready() {
+		return ErrBreakerOpen
+	}
+
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	slow := d
+	if slow <= 0 {
+		slow = cb.opt.SlowCallDuration
+	}
+	cb.done(err != nil, elapsed >= slow)
+	return err
+}
+
+// Ready returns whether a call is allowed.
+// In the half-open state, each true result admits a probe whose result must be reported by Done, Success or Fail.
+func (cb *StateCircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.opt.OpenTimeout {
+			return false
+		}
+		cb.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if cb.probes >= cb.opt.HalfOpenProbes {
+			if time.Since(cb.probeAt) < cb.opt.ProbeTimeout {
+				return false
+			}
+			// probes whose results are never reported must not block the breaker forever
+			cb.probes = 0
+			cb.probeSuccess = 0
+		}
+		cb.probes++
+		cb.probeAt = time.Now()
+		return true
+	}
+	return true
+}
+
+// Success records a successful call.
+func (cb *StateCircuitBreaker) Success() {
+	cb.done(false, false)
+}
+
+// Fail records a failed call.
+func (cb *StateCircuitBreaker) Fail() {
+	cb.done(true, false)
+}
+
+// Done records the result of a call. Canceled calls are ignored.
+func (cb *StateCircuitBreaker) Done(err error, d time.Duration) {
+	if err == context.Canceled {
+		cb.mu.Lock()
+		if cb.state == BreakerHalfOpen && cb.probes > 0 {
+			cb.probes--
+		}
+		cb.mu.Unlock()
+		return
+	}
+	cb.done(err != nil, d >= cb.opt.SlowCallDuration)
+}
+
+// State returns the current state.
+func (cb *StateCircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.opt.OpenTimeout {
+		return BreakerHalfOpen
+	}
+	return cb.state
+}
+
+// OnStateChange sets fn to be called when the state changes.
+// fn is called with the breaker locked so it must not call methods of the breaker.
+func (cb *StateCircuitBreaker) OnStateChange(fn func(from, to BreakerState)) {
+	cb.mu.Lock()
+	cb.onStateChange = fn
+	cb.mu.Unlock()
+}
+
+func (cb *StateCircuitBreaker) done(failed, slow bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		// calls admitted before the breaker opened
+		return
+	case BreakerHalfOpen:
+		if failed || (slow && cb.opt.SlowCallRate > 0) {
+			cb.open()
+			return
+		}
+		cb.probeSuccess++
+		if cb.probeSuccess >= cb.opt.HalfOpenProbes {
+			cb.setState(BreakerClosed)
+		}
+		return
+	}
+
+	now := time.Now()
+	b := cb.bucket(now)
+	b.total++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+
+	var total, failures, slows uint64
+	for i := range cb.buckets {
+		if now.Sub(cb.buckets[i].start) < cb.opt.Window {
+			total += cb.buckets[i].total
+			failures += cb.buckets[i].failures
+			slows += cb.buckets[i].slow
+		}
+	}
+	if total < cb.opt.MinRequests {
+		return
+	}
+	if float64(failures)/float64(total) >= cb.opt.ErrorRate ||
+		(cb.opt.SlowCallRate > 0 && float64(slows)/float64(total) >= cb.opt.SlowCallRate) {
+		cb.open()
+	}
+}
+
+// bucket returns the bucket of now, and resets it if it is expired.
+func (cb *StateCircuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := cb.opt.Window / time.Duration(len(cb.buckets))
+	if width <= 0 {
+		width = 1
+	}
+	start := now.Truncate(width)
+	b := &cb.buckets[int(start.UnixNano()/int64(width))%len(cb.buckets)]
+	if !b.start.Equal(start) {
+		*b = breakerBucket{start: start}
+	}
+	return b
+}
+
+func (cb *StateCircuitBreaker) open() {
+	cb.openedAt = time.Now()
+	cb.setState(BreakerOpen)
+}
+
+func (cb *StateCircuitBreaker) setState(state BreakerState) {
+	from := cb.state
+	cb.state = state
+	cb.probes = 0
+	cb.probeSuccess = 0
+	if state != BreakerHalfOpen {
+		for i := range cb.buckets {
+			cb.buckets[i] = breakerBucket{}
+		}
+	}
+	if from != state && cb.onStateChange != nil {
+		cb.onStateChange(from, state)
+	}
+}
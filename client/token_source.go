@@ -0,0 +1,159 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+)
+
+// Token is a bearer token for authentication.
+type Token struct {
+	AccessToken string
+	// TokenType is the type of the token. Default is Bearer.
+	TokenType string
+	// Expiry is when the token expires. Zero means the token never expires.
+	Expiry time.Time
+}
+
+// TokenSource returns tokens, for example from an OAuth2 or OIDC provider.
+type TokenSource interface {
+	Token() (*Token, error)
+}
+
+// TokenSourceFunc is an adapter to use a function as a TokenSource.
+type TokenSourceFunc func() (*Token, error)
+
+// Token returns f().
+func (f TokenSourceFunc) Token() (*Token, error) {
+	return f()
+}
+
+// StaticTokenSource returns a TokenSource that always returns the token.
+func StaticTokenSource(accessToken string) TokenSource {
+	return TokenSourceFunc(func() (*Token, error) {
+		return &Token{AccessToken: accessToken}, nil
+	})
+}
+
+// TokenRefresher sets tokens of a TokenSource to XClients by XClient.Auth,
+// and refreshes them before they expire.
+type TokenRefresher struct {
+	src TokenSource
+
+	mu       sync.Mutex
+	xclients []XClient
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTokenRefresher gets a token from src, sets it to xclients, and refreshes it before it expires.
+// Tokens are refreshed 1 minute before expiry, or at the half of their lifetime if they are short-lived.
+func NewTokenRefresher(src TokenSource, xclients ...XClient) (*TokenRefresher, error) {
+	r := &TokenRefresher{
+		src:      src,
+		xclients: xclients,
+		stopCh:   make(chan struct{}),
+	}
+
+	token, err := r.refresh()
+	if err != nil {
+		return nil, err
+	}
+	go r.run(token)
+	return r, nil
+}
+
+// Add sets the current token to xc, and refreshes its token later.
+func (r *TokenRefresher) Add(xc XClient) error {
+	token, err := r.refresh()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.xclients = append(r.xclients, xc)
+	r.mu.Unlock()
+	xc.Auth(authorization(token))
+	return nil
+}
+
+func authorization(token *Token) string {
+	tokenType := token.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + token.AccessToken
+}
+
+// refresh gets a token and sets it to xclients.
+func (r *TokenRefresher) refresh() (*Token, error) {
+	token, err := r.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.AccessToken == "" {
+		return nil, errors.New("empty token")
+	}
+
+	auth := authorization(token)
+	r.mu.Lock()
+	for _, xc := range r.xclients {
+		xc.Auth(auth)
+	}
+	r.mu.Unlock()
+	return token, nil
+}
+
+// next returns when the token should be refreshed.
+func (r *TokenRefresher) next(token *Token) time.Duration {
+	lifetime := time.Until(token.Expiry)
+	if before := time.Minute; before < lifetime/2 {
+		return lifetime - before
+	}
+	return lifetime / 2
+}
+
+func (r *TokenRefresher) run(token *Token) {
+	var tempDelay time.Duration
+	for {
+		if token.Expiry.IsZero() {
+			return
+		}
+
+		wait := r.next(token)
+		if tempDelay > 0 {
+			wait = tempDelay
+		}
+		select {
+		case <-r.stopCh:
+			return
+		case <-time.After(wait):
+		}
+
+		t, err := r.refresh()
+		if err == nil {
+			token, tempDelay = t, 0
+			continue
+		}
+
+		// retry until the current token expires, and keep retrying after it, since calls fail without tokens
+		if tempDelay == 0 {
+			tempDelay = time.Second
+		} else {
+			tempDelay *= 2
+		}
+		if max := time.Minute; tempDelay > max {
+			tempDelay = max
+		}
+		log.Warnf("failed to refresh token, retry in %v: %v", tempDelay, err)
+	}
+}
+
+// Close stops refreshing tokens.
+func (r *TokenRefresher) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+}
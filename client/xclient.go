@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ex "github.com/caser789/rpcj/errors"
@@ -61,6 +62,7 @@ func (c *xClient) SetSelector(s Selector) {
 	c.mu.RLock()
 	s.UpdateServer(c.servers)
 	c.mu.RUnlock()
+	c.bindSelector(s)
 
 	c.selector = s
 }
@@ -87,24 +89,31 @@ type ServiceDiscovery interface {
 }
 
 type xClient struct {
-	failMode     FailMode
-	selectMode   SelectMode
-	cachedClient map[string]RPCClient
-	breakers     sync.Map
-	servicePath  string
-	option       Option
+	failMode       FailMode
+	selectMode     SelectMode
+	cachedClient   map[string]RPCClient
+	breakers       sync.Map
+	methodBreakers sync.Map // methodBreakerKey -> Breaker
+	stats          sync.Map // server -> *serverStats
+	servicePath    string
+	option         Option
 
 	mu        sync.RWMutex
 	servers   map[string]string
 	discovery ServiceDiscovery
 	selector  Selector
 
+	// selectors of subsets of servers routed by Option.Router
+	routeSelectors map[*RouteSplit]Selector
+	routeVersion   uint64
+
 	slGroup singleflight.Group
 
 	isShutdown bool
 
-	// auth is a string for Authentication, for example, "Bearer mF_9.B5f-4.1JqM"
-	auth string
+	// auth is a string for Authentication, for example, "Bearer mF_9.B5f-4.1JqM".
+	// It is atomic because it can be refreshed by TokenRefresher while calls are sent.
+	auth atomic.Value
 
 	Plugins PluginContainer
 
@@ -136,7 +145,8 @@ func NewXClient(servicePath string, failMode FailMode, selectMode SelectMode, di
 
 	client.servers = servers
 	if selectMode != Closest && selectMode != SelectByUser {
-		client.selector = newSelector(selectMode, servers)
+		client.selector = newSelector(selectMode, servers, option)
+		client.bindSelector(client.selector)
 	}
 
 	client.Plugins = &pluginContainer{}
@@ -173,7 +183,8 @@ func NewBidirectionalXClient(servicePath string, failMode FailMode, selectMode S
 	filterByStateAndGroup(client.option.Group, servers)
 	client.servers = servers
 	if selectMode != Closest && selectMode != SelectByUser {
-		client.selector = newSelector(selectMode, servers)
+		client.selector = newSelector(selectMode, servers, option)
+		client.bindSelector(client.selector)
 	}
 
 	client.Plugins = &pluginContainer{}
@@ -205,7 +216,7 @@ func (c *xClient) ConfigGeoSelector(latitude, longitude float64) {
 
 // Auth sets s token for Authentication.
 func (c *xClient) Auth(auth string) {
-	c.auth = auth
+	c.auth.Store(auth)
 }
 
 // watch changes of service and update cached clients.
@@ -221,12 +232,15 @@ func (c *xClient) watch(ch chan []*KVPair) {
 		c.mu.Lock()
 		filterByStateAndGroup(c.option.Group, servers)
 		c.servers = servers
+		c.routeSelectors = nil
 
 		if c.selector != nil {
 			c.selector.UpdateServer(servers)
 		}
 
 		c.mu.Unlock()
+
+		c.pruneStats(servers)
 	}
 }
 
@@ -246,7 +260,7 @@ func filterByStateAndGroup(group string, servers map[string]string) {
 // selects a client from candidates base on c.selectMode
 func (c *xClient) selectClient(ctx context.Context, servicePath, serviceMethod string, args interface{}) (string, RPCClient, error) {
 	c.mu.Lock()
-	fn := c.selector.Select
+	fn := c.routeSelector(ctx, servicePath, serviceMethod).Select
 	if c.Plugins != nil {
 		fn = c.Plugins.DoWrapSelect(fn)
 	}
@@ -255,11 +269,46 @@ func (c *xClient) selectClient(ctx context.Context, servicePath, serviceMethod s
 	if k == "" {
 		return "", nil, ErrXClientNoServer
 	}
+	c.serverStats(k).selected()
 	client, err := c.getCachedClient(k, servicePath, serviceMethod, args)
+	if err != nil {
+		c.serverStats(k).fail(err)
+	}
 	return k, client, err
 }
 
 func (c *xClient) getCachedClient(k string, servicePath, serviceMethod string, args interface{}) (RPCClient, error) {
+	// if this client is broken
+	breaker, ok := c.breakers.Load(k)
+	if ok && !breaker.(Breaker).Ready() {
+		return nil, ErrBreakerOpen
+	}
+
+	// failures of connecting are recorded in generateClient, and results of calls by doneServerBreaker
+	return c.getOrCreateCachedClient(k, servicePath, serviceMethod)
+}
+
+// doneServerBreaker records the result of a call to the server k if its breaker is a StatefulBreaker.
+// Errors returned by services are successes for the server, and calls which are not sent are ignored.
+// Other breakers only record failures of connecting.
+func (c *xClient) doneServerBreaker(k string, err error, d time.Duration) {
+	breaker, ok := c.breakers.Load(k)
+	if !ok {
+		return
+	}
+	sb, ok := breaker.(StatefulBreaker)
+	if !ok {
+		return
+	}
+	if _, ok := err.(ServiceError); ok {
+		err = nil
+	} else if err == ErrBreakerOpen {
+		err = context.Canceled
+	}
+	sb.Done(err, d)
+}
+
+func (c *xClient) getOrCreateCachedClient(k string, servicePath, serviceMethod string) (RPCClient, error) {
 	// TODO: improve the lock
 	var client RPCClient
 	var needCallPlugin bool
@@ -273,12 +322,6 @@ func (c *xClient) getCachedClient(k string, servicePath, serviceMethod string, a
 		return nil, errors.New("this xclient is closed")
 	}
 
-	// if this client is broken
-	breaker, ok := c.breakers.Load(k)
-	if ok && !breaker.(Breaker).Ready() {
-		return nil, ErrBreakerOpen
-	}
-
 	c.mu.Lock()
 	client = c.findCachedClient(k, servicePath, serviceMethod)
 	if client != nil {
@@ -379,7 +422,11 @@ func (c *xClient) generateClient(k, servicePath, serviceMethod string) (client R
 
 	var breaker interface{}
 	if c.option.GenBreaker != nil {
-		breaker, _ = c.breakers.LoadOrStore(k, c.option.GenBreaker())
+		var loaded bool
+		breaker, loaded = c.breakers.LoadOrStore(k, c.option.GenBreaker())
+		if !loaded {
+			c.watchBreaker(breaker.(Breaker), k, "")
+		}
 	}
 
 	err = client.Connect(network, addr)
@@ -435,6 +482,24 @@ func splitNetworkAndAddress(server string) (string, string) {
 	return ss[0], ss[1]
 }
 
+// callStateKey is the context key of the state of a call of XClient.
+type callStateKey struct{}
+
+// callState is shared by all attempts of a call, which may be retried on other servers by FailMode
+// or sent to servers concurrently by Broadcast and Fork, so that plugins can act once per call.
+type callState struct {
+	mirrors sync.Map // *MirrorPlugin -> *mirroredCall
+}
+
+func withCallState(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callStateKey{}, &callState{})
+}
+
+func getCallState(ctx context.Context) *callState {
+	state, _ := ctx.Value(callStateKey{}).(*callState)
+	return state
+}
+
 func setServerTimeout(ctx context.Context) context.Context {
 	if deadline, ok := ctx.Deadline(); ok {
 		metadata := ctx.Value(share.ReqMetaDataKey)
@@ -456,26 +521,28 @@ func (c *xClient) Go(ctx context.Context, serviceMethod string, args interface{}
 		return nil, ErrXClientShutdown
 	}
 
-	if c.auth != "" {
+	if auth, _ := c.auth.Load().(string); auth != "" {
 		metadata := ctx.Value(share.ReqMetaDataKey)
 		if metadata == nil {
 			metadata = map[string]string{}
 			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
 		}
 		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
+		m[share.AuthKey] = auth
 	}
 
 	ctx = setServerTimeout(ctx)
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("select a client for %s.%s, args: %+v in case of xclient Go", c.servicePath, serviceMethod, args)
 	}
-	_, client, err := c.selectClient(ctx, c.servicePath, serviceMethod, args)
+	k, client, err := c.selectClient(ctx, c.servicePath, serviceMethod, args)
 	if err != nil {
 		return nil, err
 	}
-	if share.Trace {
+	// results of asynchronous calls are not recorded, so the call is not counted by the breaker
+	c.doneServerBreaker(k, context.Canceled, 0)
+	if share.TraceEnabled() {
 		log.Debugf("selected a client %s for %s.%s, args: %+v in case of xclient Go", client.RemoteAddr(), c.servicePath, serviceMethod, args)
 	}
 	return client.Go(ctx, c.servicePath, serviceMethod, args, reply, done), nil
@@ -488,18 +555,18 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 		return ErrXClientShutdown
 	}
 
-	if c.auth != "" {
+	if auth, _ := c.auth.Load().(string); auth != "" {
 		metadata := ctx.Value(share.ReqMetaDataKey)
 		if metadata == nil {
 			metadata = map[string]string{}
 			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
 		}
 		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
+		m[share.AuthKey] = auth
 	}
-	ctx = setServerTimeout(ctx)
+	ctx = withCallState(setServerTimeout(ctx))
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("select a client for %s.%s, failMode: %v, args: %+v in case of xclient Call", c.servicePath, serviceMethod, c.failMode, args)
 	}
 
@@ -511,7 +578,7 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 		}
 	}
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		if client != nil {
 			log.Debugf("selected a client %s for %s.%s, failMode: %v, args: %+v in case of xclient Call", client.RemoteAddr(), c.servicePath, serviceMethod, c.failMode, args)
 		} else {
@@ -527,7 +594,7 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 			retries--
 
 			if client != nil {
-				err = c.wrapCall(ctx, client, serviceMethod, args, reply)
+				err = c.wrapCall(ctx, k, client, serviceMethod, args, reply)
 				if err == nil {
 					return nil
 				}
@@ -542,6 +609,10 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 			if uncoverError(err) {
 				c.removeClient(k, c.servicePath, serviceMethod, client)
 			}
+			if retries < 0 {
+				// selecting without another attempt would reserve a breaker probe that is never released
+				break
+			}
 			client, e = c.getCachedClient(k, c.servicePath, serviceMethod, args)
 		}
 		if err == nil {
@@ -554,7 +625,7 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 			retries--
 
 			if client != nil {
-				err = c.wrapCall(ctx, client, serviceMethod, args, reply)
+				err = c.wrapCall(ctx, k, client, serviceMethod, args, reply)
 				if err == nil {
 					return nil
 				}
@@ -569,6 +640,9 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 			if uncoverError(err) {
 				c.removeClient(k, c.servicePath, serviceMethod, client)
 			}
+			if retries < 0 {
+				break
+			}
 			// select another server
 			k, client, e = c.selectClient(ctx, c.servicePath, serviceMethod, args)
 		}
@@ -632,7 +706,7 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 
 		return err
 	default: // Failfast
-		err = c.wrapCall(ctx, client, serviceMethod, args, reply)
+		err = c.wrapCall(ctx, k, client, serviceMethod, args, reply)
 		if err != nil {
 			if uncoverError(err) {
 				c.removeClient(k, c.servicePath, serviceMethod, client)
@@ -648,6 +722,10 @@ func uncoverError(err error) bool {
 		return false
 	}
 
+	if err == ErrBreakerOpen {
+		return false
+	}
+
 	if err == context.DeadlineExceeded {
 		return false
 	}
@@ -676,19 +754,19 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 		return nil, nil, ErrXClientShutdown
 	}
 
-	if c.auth != "" {
+	if auth, _ := c.auth.Load().(string); auth != "" {
 		metadata := ctx.Value(share.ReqMetaDataKey)
 		if metadata == nil {
 			metadata = map[string]string{}
 			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
 		}
 		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
+		m[share.AuthKey] = auth
 	}
 
 	ctx = setServerTimeout(ctx)
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("select a client for %s.%s, failMode: %v, args: %+v in case of xclient SendRaw", r.ServicePath, r.ServiceMethod, c.failMode, r.Payload)
 	}
 
@@ -706,7 +784,7 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 		}
 	}
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("selected a client %s for %s.%s, failMode: %v, args: %+v in case of xclient Call", client.RemoteAddr(), r.ServicePath, r.ServiceMethod, c.failMode, r.Payload)
 	}
 
@@ -717,7 +795,7 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 		for retries >= 0 {
 			retries--
 			if client != nil {
-				m, payload, err := c.wrapSendRaw(ctx, client, r)
+				m, payload, err := c.wrapSendRaw(ctx, k, client, r)
 				if err == nil {
 					return m, payload, nil
 				}
@@ -732,6 +810,9 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 			if uncoverError(err) {
 				c.removeClient(k, r.ServicePath, r.ServiceMethod, client)
 			}
+			if retries < 0 {
+				break
+			}
 			client, e = c.getCachedClient(k, r.ServicePath, r.ServiceMethod, r.Payload)
 		}
 
@@ -744,7 +825,7 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 		for retries >= 0 {
 			retries--
 			if client != nil {
-				m, payload, err := c.wrapSendRaw(ctx, client, r)
+				m, payload, err := c.wrapSendRaw(ctx, k, client, r)
 				if err == nil {
 					return m, payload, nil
 				}
@@ -759,6 +840,9 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 			if uncoverError(err) {
 				c.removeClient(k, r.ServicePath, r.ServiceMethod, client)
 			}
+			if retries < 0 {
+				break
+			}
 			// select another server
 			k, client, e = c.selectClient(ctx, r.ServicePath, r.ServiceMethod, r.Payload)
 		}
@@ -769,7 +853,7 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 		return nil, nil, err
 
 	default: // Failfast
-		m, payload, err := c.wrapSendRaw(ctx, client, r)
+		m, payload, err := c.wrapSendRaw(ctx, k, client, r)
 		if err != nil {
 			if uncoverError(err) {
 				c.removeClient(k, r.ServicePath, r.ServiceMethod, client)
@@ -780,43 +864,117 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 	}
 }
 
-func (c *xClient) wrapCall(ctx context.Context, client RPCClient, serviceMethod string, args interface{}, reply interface{}) error {
+func (c *xClient) wrapCall(ctx context.Context, k string, client RPCClient, serviceMethod string, args interface{}, reply interface{}) error {
 	if client == nil {
 		return ErrServerUnavailable
 	}
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("call a client for %s.%s, args: %+v in case of xclient wrapCall", c.servicePath, serviceMethod, args)
 	}
 
+	breaker := c.methodBreaker(k, serviceMethod)
+	if breaker != nil && !breaker.Ready() {
+		c.serverStats(k).fail(ErrBreakerOpen)
+		c.doneServerBreaker(k, ErrBreakerOpen, 0)
+		return ErrBreakerOpen
+	}
+
 	ctx = share.NewContext(ctx)
 	c.Plugins.DoPreCall(ctx, c.servicePath, serviceMethod, args)
+	end := c.serverStats(k).begin()
+	start := time.Now()
 	err := client.Call(ctx, c.servicePath, serviceMethod, args, reply)
+	end()
+	doneBreaker(breaker, err, time.Since(start))
+	c.doneServerBreaker(k, err, time.Since(start))
 	c.Plugins.DoPostCall(ctx, c.servicePath, serviceMethod, args, reply, err)
+	c.serverStats(k).called(err)
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("called a client for %s.%s, args: %+v, err: %v in case of xclient wrapCall", c.servicePath, serviceMethod, args, err)
 	}
 
 	return err
 }
 
+type methodBreakerKey struct {
+	server        string
+	serviceMethod string
+}
+
+// methodBreaker returns the breaker of the method of the server k, or nil if GenMethodBreaker is not set.
+func (c *xClient) methodBreaker(k, serviceMethod string) Breaker {
+	if c.option.GenMethodBreaker == nil {
+		return nil
+	}
+	key := methodBreakerKey{k, serviceMethod}
+	if b, ok := c.methodBreakers.Load(key); ok {
+		return b.(Breaker)
+	}
+	b, loaded := c.methodBreakers.LoadOrStore(key, c.option.GenMethodBreaker())
+	if !loaded {
+		c.watchBreaker(b.(Breaker), k, serviceMethod)
+	}
+	return b.(Breaker)
+}
+
+// watchBreaker notifies plugins of state changes of the breaker.
+func (c *xClient) watchBreaker(breaker Breaker, k, serviceMethod string) {
+	if sb, ok := breaker.(StatefulBreaker); ok {
+		sb.OnStateChange(func(from, to BreakerState) {
+			if n, ok := c.Plugins.(BreakerStateChangeNotifier); ok {
+				n.DoBreakerStateChange(c.servicePath, serviceMethod, k, from, to)
+			}
+		})
+	}
+}
+
+// doneBreaker records the result of a call in the breaker.
+func doneBreaker(breaker Breaker, err error, d time.Duration) {
+	if breaker == nil {
+		return
+	}
+	if sb, ok := breaker.(StatefulBreaker); ok {
+		sb.Done(err, d)
+		return
+	}
+	if err == nil {
+		breaker.Success()
+	} else if err != context.Canceled {
+		breaker.Fail()
+	}
+}
+
 // wrapSendRaw wrap SendRaw to support client plugins
-func (c *xClient) wrapSendRaw(ctx context.Context, client RPCClient, r *protocol.Message) (map[string]string, []byte, error) {
+func (c *xClient) wrapSendRaw(ctx context.Context, k string, client RPCClient, r *protocol.Message) (map[string]string, []byte, error) {
 	if client == nil {
 		return nil, nil, ErrServerUnavailable
 	}
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("call a client for %s.%s, args: %+v in case of xclient wrapSendRaw", c.servicePath, r.ServiceMethod, r.Payload)
 	}
 
+	breaker := c.methodBreaker(k, r.ServiceMethod)
+	if breaker != nil && !breaker.Ready() {
+		c.serverStats(k).fail(ErrBreakerOpen)
+		c.doneServerBreaker(k, ErrBreakerOpen, 0)
+		return nil, nil, ErrBreakerOpen
+	}
+
 	ctx = share.NewContext(ctx)
 	c.Plugins.DoPreCall(ctx, c.servicePath, r.ServiceMethod, r.Payload)
+	end := c.serverStats(k).begin()
+	start := time.Now()
 	m, payload, err := client.SendRaw(ctx, r)
+	end()
+	doneBreaker(breaker, err, time.Since(start))
+	c.doneServerBreaker(k, err, time.Since(start))
 	c.Plugins.DoPostCall(ctx, c.servicePath, r.ServiceMethod, r.Payload, nil, err)
+	c.serverStats(k).called(err)
 
-	if share.Trace {
+	if share.TraceEnabled() {
 		log.Debugf("called a client for %s.%s, args: %+v, err: %v in case of xclient wrapSendRaw", c.servicePath, r.ServiceMethod, r.Payload, err)
 	}
 
@@ -831,17 +989,17 @@ func (c *xClient) Broadcast(ctx context.Context, serviceMethod string, args inte
 		return ErrXClientShutdown
 	}
 
-	if c.auth != "" {
+	if auth, _ := c.auth.Load().(string); auth != "" {
 		metadata := ctx.Value(share.ReqMetaDataKey)
 		if metadata == nil {
 			metadata = map[string]string{}
 			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
 		}
 		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
+		m[share.AuthKey] = auth
 	}
 
-	ctx = setServerTimeout(ctx)
+	ctx = withCallState(setServerTimeout(ctx))
 	callPlugins := make([]RPCClient, 0, len(c.servers))
 	clients := make(map[string]RPCClient)
 	c.mu.Lock()
@@ -874,7 +1032,7 @@ func (c *xClient) Broadcast(ctx context.Context, serviceMethod string, args inte
 		k := k
 		client := client
 		go func() {
-			e := c.wrapCall(ctx, client, serviceMethod, args, reply)
+			e := c.wrapCall(ctx, k, client, serviceMethod, args, reply)
 			done <- (e == nil)
 			if e != nil {
 				if uncoverError(e) {
@@ -913,17 +1071,17 @@ func (c *xClient) Fork(ctx context.Context, serviceMethod string, args interface
 		return ErrXClientShutdown
 	}
 
-	if c.auth != "" {
+	if auth, _ := c.auth.Load().(string); auth != "" {
 		metadata := ctx.Value(share.ReqMetaDataKey)
 		if metadata == nil {
 			metadata = map[string]string{}
 			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
 		}
 		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
+		m[share.AuthKey] = auth
 	}
 
-	ctx = setServerTimeout(ctx)
+	ctx = withCallState(setServerTimeout(ctx))
 	callPlugins := make([]RPCClient, 0, len(c.servers))
 	clients := make(map[string]RPCClient)
 	c.mu.Lock()
@@ -961,7 +1119,7 @@ func (c *xClient) Fork(ctx context.Context, serviceMethod string, args interface
 				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
 			}
 
-			e := c.wrapCall(ctx, client, serviceMethod, args, clonedReply)
+			e := c.wrapCall(ctx, k, client, serviceMethod, args, clonedReply)
 			if e == nil && reply != nil && clonedReply != nil {
 				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
 			}
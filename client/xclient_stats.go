@@ -0,0 +1,274 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+)
+
+// Snapshotter is implemented by XClients which can take snapshots, such as XClients created by NewXClient.
+type Snapshotter interface {
+	Snapshot() XClientSnapshot
+}
+
+// XClientSnapshot is a point-in-time view of a XClient, used for debugging.
+type XClientSnapshot struct {
+	ServicePath string           `json:"service_path"`
+	FailMode    string           `json:"fail_mode"`
+	SelectMode  string           `json:"select_mode"`
+	Shutdown    bool             `json:"shutdown"`
+	Servers     []ServerSnapshot `json:"servers"`
+}
+
+// ServerSnapshot describes a server known by a XClient.
+type ServerSnapshot struct {
+	Server string `json:"server"`
+	// Metadata of the server in discovery.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Discovered is false if the server has been removed from discovery or filtered out by state or group,
+	// while calls to it are still being handled.
+	Discovered bool `json:"discovered"`
+	// ConnState is one of "none", "connected", "closing" and "shutdown".
+	ConnState string `json:"conn_state"`
+	// Pending is the number of calls waiting for responses.
+	Pending int `json:"pending"`
+	// Breaker is one of "none", "closed", "half-open" and "open".
+	Breaker string `json:"breaker"`
+	// MethodBreakers are states of breakers of methods, if GenMethodBreaker is set.
+	MethodBreakers map[string]string `json:"method_breakers,omitempty"`
+
+	Selected    uint64    `json:"selected"`
+	Calls       uint64    `json:"calls"`
+	Errors      uint64    `json:"errors"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// serverStats counts selections and calls of a server.
+type serverStats struct {
+	selectedNum uint64
+	callNum     uint64
+	errorNum    uint64
+	inflight    int64
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func (ss *serverStats) selected() {
+	atomic.AddUint64(&ss.selectedNum, 1)
+}
+
+func (ss *serverStats) called(err error) {
+	atomic.AddUint64(&ss.callNum, 1)
+	if err != nil {
+		ss.fail(err)
+	}
+}
+
+func (ss *serverStats) fail(err error) {
+	atomic.AddUint64(&ss.errorNum, 1)
+	ss.mu.Lock()
+	ss.lastError = err.Error()
+	ss.lastErrorAt = time.Now()
+	ss.mu.Unlock()
+}
+
+// begin counts a call in flight and returns a function to end it.
+func (ss *serverStats) begin() func() {
+	atomic.AddInt64(&ss.inflight, 1)
+	return func() { atomic.AddInt64(&ss.inflight, -1) }
+}
+
+// serverLoad returns the number of in-flight calls of the server k.
+func (c *xClient) serverLoad(k string) int {
+	if v, ok := c.stats.Load(k); ok {
+		return int(atomic.LoadInt64(&v.(*serverStats).inflight))
+	}
+	return 0
+}
+
+// serverHealthy returns false if the breaker of the server k is open.
+func (c *xClient) serverHealthy(k string) bool {
+	if breaker, ok := c.breakers.Load(k); ok {
+		return breakerState(breaker.(Breaker)) != BreakerOpen
+	}
+	return true
+}
+
+// bindSelector lets load aware and health aware selectors see in-flight calls and breakers of servers.
+func (c *xClient) bindSelector(s Selector) {
+	if ls, ok := s.(loadAwareSelector); ok {
+		ls.setLoad(c.serverLoad)
+	}
+	if hs, ok := s.(healthAwareSelector); ok {
+		hs.setHealthy(c.serverHealthy)
+	}
+}
+
+func (c *xClient) serverStats(k string) *serverStats {
+	if v, ok := c.stats.Load(k); ok {
+		return v.(*serverStats)
+	}
+	v, _ := c.stats.LoadOrStore(k, &serverStats{})
+	return v.(*serverStats)
+}
+
+// pruneStats drops stats and method breakers of servers which are not in servers any more.
+func (c *xClient) pruneStats(servers map[string]string) {
+	c.stats.Range(func(k, v interface{}) bool {
+		if _, ok := servers[k.(string)]; !ok {
+			c.stats.Delete(k)
+		}
+		return true
+	})
+	c.methodBreakers.Range(func(k, v interface{}) bool {
+		if _, ok := servers[k.(methodBreakerKey).server]; !ok {
+			c.methodBreakers.Delete(k)
+		}
+		return true
+	})
+}
+
+type pendingCounter interface {
+	PendingCalls() int
+}
+
+// Snapshot returns servers known by this xclient and their states.
+// Stats of servers are dropped when they leave discovery, but calls still in flight may add them back.
+func (c *xClient) Snapshot() XClientSnapshot {
+	snapshot := XClientSnapshot{
+		ServicePath: c.servicePath,
+		FailMode:    c.failMode.String(),
+		SelectMode:  c.selectMode.String(),
+	}
+
+	c.mu.Lock()
+	snapshot.Shutdown = c.isShutdown
+	servers := make(map[string]*ServerSnapshot, len(c.servers))
+	for k, v := range c.servers {
+		servers[k] = &ServerSnapshot{
+			Server:     k,
+			Metadata:   parseMetadata(v),
+			Discovered: true,
+		}
+	}
+	c.stats.Range(func(k, v interface{}) bool {
+		if _, ok := servers[k.(string)]; !ok {
+			servers[k.(string)] = &ServerSnapshot{Server: k.(string)}
+		}
+		return true
+	})
+	for k, ss := range servers {
+		ss.ConnState = "none"
+		if client := c.findCachedClient(k, c.servicePath, ""); client != nil {
+			switch {
+			case client.IsShutdown():
+				ss.ConnState = "shutdown"
+			case client.IsClosing():
+				ss.ConnState = "closing"
+			default:
+				ss.ConnState = "connected"
+			}
+			if pc, ok := client.(pendingCounter); ok {
+				ss.Pending = pc.PendingCalls()
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	c.methodBreakers.Range(func(key, v interface{}) bool {
+		mk := key.(methodBreakerKey)
+		if ss, ok := servers[mk.server]; ok {
+			if ss.MethodBreakers == nil {
+				ss.MethodBreakers = make(map[string]string)
+			}
+			ss.MethodBreakers[mk.serviceMethod] = breakerState(v.(Breaker)).String()
+		}
+		return true
+	})
+
+	for k, ss := range servers {
+		ss.Breaker = "none"
+		if breaker, ok := c.breakers.Load(k); ok {
+			ss.Breaker = breakerState(breaker.(Breaker)).String()
+		}
+
+		if v, ok := c.stats.Load(k); ok {
+			stats := v.(*serverStats)
+			ss.Selected = atomic.LoadUint64(&stats.selectedNum)
+			ss.Calls = atomic.LoadUint64(&stats.callNum)
+			ss.Errors = atomic.LoadUint64(&stats.errorNum)
+			stats.mu.Lock()
+			ss.LastError = stats.lastError
+			ss.LastErrorAt = stats.lastErrorAt
+			stats.mu.Unlock()
+		}
+
+		snapshot.Servers = append(snapshot.Servers, *ss)
+	}
+	sort.Slice(snapshot.Servers, func(i, j int) bool {
+		return snapshot.Servers[i].Server < snapshot.Servers[j].Server
+	})
+
+	return snapshot
+}
+
+// breakerState returns the state of breaker.
+// Breakers other than StatefulBreaker are either closed or open.
+func breakerState(breaker Breaker) BreakerState {
+	if sb, ok := breaker.(StatefulBreaker); ok {
+		return sb.State()
+	}
+	if breaker.Ready() {
+		return BreakerClosed
+	}
+	return BreakerOpen
+}
+
+func parseMetadata(metadata string) map[string]string {
+	values, err := url.ParseQuery(metadata)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(values))
+	for k := range values {
+		m[k] = values.Get(k)
+	}
+	return m
+}
+
+// NewXClientDebugHandler returns a http.Handler that serves snapshots of xclients in JSON.
+// The query parameter "service" can be used to show only xclients of the service.
+// XClients which don't implement Snapshotter are skipped.
+func NewXClientDebugHandler(xclients ...XClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := r.URL.Query().Get("service")
+		snapshots := make([]XClientSnapshot, 0, len(xclients))
+		for _, xc := range xclients {
+			sc, ok := xc.(Snapshotter)
+			if !ok {
+				continue
+			}
+			snapshot := sc.Snapshot()
+			if service != "" && snapshot.ServicePath != service {
+				continue
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(snapshots); err != nil {
+			log.Warnf("failed to write xclient snapshots: %v", err)
+		}
+	})
+}
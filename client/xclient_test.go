@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -127,3 +130,462 @@ func TestUncoverError(t *testing.T) {
 		t.Fatalf("expect true but get false")
 	}
 }
+
+func TestXClient_Snapshot(t *testing.T) {
+	s := server.NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	addr := s.Address().String()
+
+	d, err := NewMultipleServersDiscovery([]*KVPair{
+		{Key: "tcp@" + addr, Value: "desc=a+test+service"},
+		{Key: "tcp@127.0.0.1:1", Value: ""},
+	})
+	if err != nil {
+		t.Fatalf("failed to NewMultipleServersDiscovery: %v", err)
+	}
+
+	xclient := NewXClient("Arith", Failover, RoundRobin, d, DefaultOption)
+	defer xclient.Close()
+
+	for i := 0; i < 4; i++ {
+		err = xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, &Reply{})
+		if err != nil {
+			t.Fatalf("failed to call: %v", err)
+		}
+	}
+
+	snapshot := xclient.(Snapshotter).Snapshot()
+	if snapshot.ServicePath != "Arith" || snapshot.FailMode != "Failover" || snapshot.SelectMode != "RoundRobin" {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+	if len(snapshot.Servers) != 2 {
+		t.Fatalf("expect 2 servers but got %d", len(snapshot.Servers))
+	}
+
+	var good, bad ServerSnapshot
+	for _, ss := range snapshot.Servers {
+		if ss.Server == "tcp@"+addr {
+			good = ss
+		} else {
+			bad = ss
+		}
+	}
+
+	if good.ConnState != "connected" || good.Calls != 4 || good.Errors != 0 || good.Metadata["desc"] != "a test service" {
+		t.Errorf("unexpected snapshot of good server: %+v", good)
+	}
+	if bad.ConnState != "none" || bad.Selected == 0 || bad.Errors == 0 || bad.LastError == "" {
+		t.Errorf("unexpected snapshot of bad server: %+v", bad)
+	}
+	// stats of servers are dropped after they leave discovery
+	d.(*MultipleServersDiscovery).Update([]*KVPair{{Key: "tcp@" + addr, Value: "desc=a+test+service"}})
+	time.Sleep(100 * time.Millisecond)
+	snapshot = xclient.(Snapshotter).Snapshot()
+	if len(snapshot.Servers) != 1 || snapshot.Servers[0].Server != "tcp@"+addr || snapshot.Servers[0].Calls != 4 {
+		t.Errorf("unexpected servers after the bad server is removed: %+v", snapshot.Servers)
+	}
+}
+
+type breakerStatePlugin struct {
+	changes []string
+}
+
+func (p *breakerStatePlugin) BreakerStateChange(servicePath, serviceMethod, server string, from, to BreakerState) {
+	p.changes = append(p.changes, servicePath+"."+serviceMethod+":"+to.String())
+}
+
+func TestXClient_MethodBreaker(t *testing.T) {
+	s := server.NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := NewPeer2PeerDiscovery("tcp@"+s.Address().String(), "")
+	opt := DefaultOption
+	opt.GenMethodBreaker = func() Breaker {
+		return NewStateCircuitBreaker(StateCircuitBreakerOption{MinRequests: 3, OpenTimeout: time.Minute})
+	}
+	xclient := NewXClient("Arith", Failfast, RandomSelect, d, opt)
+	defer xclient.Close()
+	p := &breakerStatePlugin{}
+	xclient.GetPlugins().Add(p)
+
+	for i := 0; i < 3; i++ {
+		err := xclient.Call(context.Background(), "Div", &Args{A: 10, B: 20}, &Reply{})
+		if _, ok := err.(ServiceError); !ok {
+			t.Fatalf("expect ServiceError but got %v", err)
+		}
+	}
+	err := xclient.Call(context.Background(), "Div", &Args{A: 10, B: 20}, &Reply{})
+	if err != ErrBreakerOpen {
+		t.Fatalf("expect %v but got %v", ErrBreakerOpen, err)
+	}
+
+	// other methods are not affected
+	err = xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, &Reply{})
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+
+	if len(p.changes) != 1 || p.changes[0] != "Arith.Div:open" {
+		t.Errorf("unexpected state changes: %v", p.changes)
+	}
+
+	ss := xclient.(Snapshotter).Snapshot().Servers[0]
+	if ss.MethodBreakers["Div"] != "open" || ss.MethodBreakers["Mul"] != "closed" {
+		t.Errorf("unexpected method breakers: %v", ss.MethodBreakers)
+	}
+}
+
+func TestXClient_Route(t *testing.T) {
+	d, _ := NewMultipleServersDiscovery([]*KVPair{
+		{Key: "tcp@10.0.0.1:8972", Value: "version=v1"},
+		{Key: "tcp@10.0.0.2:8972", Value: "version=v1"},
+		{Key: "tcp@10.0.0.3:8972", Value: "version=v2"},
+	})
+	rules, _ := NewMultipleServersDiscovery([]*KVPair{
+		{Key: "arith", Value: `[
+			{"name": "beta-users", "match": {"metadata": {"x-user-id": "42"}}, "splits": [{"labels": {"version": "v2"}, "weight": 1}]},
+			{"name": "mul-canary", "match": {"service_path": "Arith", "service_method": "Mul"},
+			 "splits": [{"labels": {"version": "v1"}, "weight": 90}, {"labels": {"version": "v2"}, "weight": 10}]}
+		]`},
+	})
+	router := NewRouterFromDiscovery(rules)
+	defer router.Close()
+
+	opt := DefaultOption
+	opt.Router = router
+	xclient := NewXClient("Arith", Failtry, RoundRobin, d, opt).(*xClient)
+	defer xclient.Close()
+
+	selectN := func(ctx context.Context, method string, n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			xclient.mu.Lock()
+			counts[xclient.routeSelector(ctx, "Arith", method).Select(ctx, "Arith", method, nil)]++
+			xclient.mu.Unlock()
+		}
+		return counts
+	}
+
+	counts := selectN(context.Background(), "Mul", 1000)
+	if n := counts["tcp@10.0.0.3:8972"]; n < 50 || n > 150 {
+		t.Errorf("expected about 10%% of calls to v2, got %v", counts)
+	}
+	counts = selectN(context.Background(), "Add", 100)
+	if counts["tcp@10.0.0.3:8972"] < 30 {
+		t.Errorf("expected unmatched calls to select from all servers, got %v", counts)
+	}
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{"x-user-id": "42"})
+	counts = selectN(ctx, "Add", 100)
+	if counts["tcp@10.0.0.3:8972"] != 100 {
+		t.Errorf("expected calls of beta users to v2, got %v", counts)
+	}
+
+	// reload rules
+	rules.(*MultipleServersDiscovery).Update([]*KVPair{
+		{Key: "arith", Value: `[{"match": {"service_method": "Mul"}, "splits": [{"labels": {"version": "v2"}, "weight": 1}]}]`},
+	})
+	time.Sleep(100 * time.Millisecond)
+	counts = selectN(context.Background(), "Mul", 100)
+	if counts["tcp@10.0.0.3:8972"] != 100 {
+		t.Errorf("expected reloaded rules to route all calls to v2, got %v", counts)
+	}
+}
+
+type shadowArith struct {
+	calls  int32
+	mirror int32
+}
+
+func (t *shadowArith) Mul(ctx context.Context, args *Args, reply *Reply) error {
+	atomic.AddInt32(&t.calls, 1)
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok && meta[share.MirrorKey] == "true" {
+		atomic.AddInt32(&t.mirror, 1)
+	}
+	reply.C = args.A * args.B
+	return nil
+}
+
+func TestMirrorPlugin(t *testing.T) {
+	primary := server.NewServer()
+	primary.RegisterName("Arith", new(Arith), "")
+	go primary.Serve("tcp", "127.0.0.1:0")
+	defer primary.Close()
+	shadow := server.NewServer()
+	arith := &shadowArith{}
+	shadow.RegisterName("Arith", arith, "")
+	go shadow.Serve("tcp", "127.0.0.1:0")
+	defer shadow.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := NewMultipleServersDiscovery([]*KVPair{
+		{Key: "tcp@" + primary.Address().String(), Value: "version=v1"},
+		{Key: "tcp@" + shadow.Address().String(), Value: "version=v2"},
+	})
+	opt := DefaultOption
+	opt.Router = NewRouter([]*RouteRule{{Splits: []*RouteSplit{{Labels: map[string]string{"version": "v1"}, Weight: 1}}}})
+	xclient := NewXClient("Arith", Failtry, RandomSelect, d, opt)
+	defer xclient.Close()
+
+	shadowClient := NewMirrorXClient("Arith", d, map[string]string{"version": "v2"}, DefaultOption)
+	defer shadowClient.Close()
+	mirror := NewMirrorPlugin(shadowClient, MirrorOption{Percent: 100, Methods: map[string]float64{"Add": 0}})
+	xclient.GetPlugins().Add(mirror)
+
+	for i := 0; i < 10; i++ {
+		args := &Args{A: 10, B: 20}
+		reply := &Reply{}
+		if err := xclient.Call(context.Background(), "Mul", args, reply); err != nil || reply.C != 200 {
+			t.Fatalf("failed to call: %v, %d", err, reply.C)
+		}
+		args.A = 0 // reused by the caller
+	}
+	_ = xclient.Call(context.Background(), "Add", &Args{A: 10, B: 20}, &Reply{})
+
+	time.Sleep(200 * time.Millisecond)
+	if mirrored, _ := mirror.Stats(); mirrored != 10 {
+		t.Errorf("expected 10 mirrored calls, got %d", mirrored)
+	}
+	if calls, mirrored := atomic.LoadInt32(&arith.calls), atomic.LoadInt32(&arith.mirror); calls != 10 || mirrored != 10 {
+		t.Errorf("expected 10 mirrored calls on the shadow server, got %d calls and %d mirrored", calls, mirrored)
+	}
+
+	// failures of shadow calls don't affect primary calls
+	shadow.Close()
+	for i := 0; i < 3; i++ {
+		if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, &Reply{}); err != nil {
+			t.Fatalf("failed to call after the shadow server is closed: %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+}
+
+func TestMirrorPlugin_Retries(t *testing.T) {
+	primary := server.NewServer()
+	primary.RegisterName("Arith", new(Arith), "")
+	go primary.Serve("tcp", "127.0.0.1:0")
+	defer primary.Close()
+	shadow := server.NewServer()
+	arith := &shadowArith{}
+	shadow.RegisterName("Arith", arith, "")
+	go shadow.Serve("tcp", "127.0.0.1:0")
+	defer shadow.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	// the broken server closes connections, so calls to it fail and are retried on the other one
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}()
+		}
+	}()
+
+	d, _ := NewMultipleServersDiscovery([]*KVPair{
+		{Key: "tcp@" + ln.Addr().String(), Value: ""},
+		{Key: "tcp@" + primary.Address().String(), Value: ""},
+	})
+	xclient := NewXClient("Arith", Failover, RoundRobin, d, DefaultOption)
+	defer xclient.Close()
+
+	shadowD, _ := NewPeer2PeerDiscovery("tcp@"+shadow.Address().String(), "")
+	shadowClient := NewXClient("Arith", Failfast, RandomSelect, shadowD, DefaultOption)
+	defer shadowClient.Close()
+	mirror := NewMirrorPlugin(shadowClient, MirrorOption{Percent: 100})
+	xclient.GetPlugins().Add(mirror)
+
+	for i := 0; i < 10; i++ {
+		if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, &Reply{}); err != nil {
+			t.Fatalf("failed to call: %v", err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if mirrored, _ := mirror.Stats(); mirrored != 10 {
+		t.Errorf("expected 10 mirrored calls, got %d", mirrored)
+	}
+	if calls := atomic.LoadInt32(&arith.mirror); calls != 10 {
+		t.Errorf("expected 10 mirrored calls on the shadow server, got %d", calls)
+	}
+}
+
+// PingReply has no fields, so concurrent attempts of Broadcast can decode into the same reply.
+type PingReply struct{}
+
+type pingService struct {
+	mirror int32
+}
+
+func (t *pingService) Ping(ctx context.Context, args *Args, reply *PingReply) error {
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok && meta[share.MirrorKey] == "true" {
+		atomic.AddInt32(&t.mirror, 1)
+	}
+	return nil
+}
+
+// barrierPlugin holds attempts of a call in PreCall until all of them arrive.
+type barrierPlugin struct {
+	wg sync.WaitGroup
+}
+
+func (p *barrierPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, args interface{}) error {
+	p.wg.Done()
+	p.wg.Wait()
+	return nil
+}
+
+func TestMirrorPlugin_Broadcast(t *testing.T) {
+	var servers []*server.Server
+	var pairs []*KVPair
+	for i := 0; i < 3; i++ {
+		s := server.NewServer()
+		s.RegisterName("Ping", new(pingService), "")
+		go s.Serve("tcp", "127.0.0.1:0")
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	shadow := server.NewServer()
+	ping := &pingService{}
+	shadow.RegisterName("Ping", ping, "")
+	go shadow.Serve("tcp", "127.0.0.1:0")
+	defer shadow.Close()
+	time.Sleep(500 * time.Millisecond)
+	for _, s := range servers {
+		pairs = append(pairs, &KVPair{Key: "tcp@" + s.Address().String()})
+	}
+
+	d, _ := NewMultipleServersDiscovery(pairs)
+	xclient := NewXClient("Ping", Failtry, RandomSelect, d, DefaultOption)
+	defer xclient.Close()
+
+	shadowD, _ := NewPeer2PeerDiscovery("tcp@"+shadow.Address().String(), "")
+	shadowClient := NewXClient("Ping", Failfast, RandomSelect, shadowD, DefaultOption)
+	defer shadowClient.Close()
+	barrier := &barrierPlugin{}
+	mirror := NewMirrorPlugin(shadowClient, MirrorOption{Percent: 100})
+	xclient.GetPlugins().Add(barrier)
+	xclient.GetPlugins().Add(mirror)
+
+	// attempts of a broadcast call share the call state and run concurrently
+	for i := 0; i < 10; i++ {
+		barrier.wg.Add(len(servers))
+		if err := xclient.Broadcast(context.Background(), "Ping", &Args{A: 10, B: 20}, &PingReply{}); err != nil {
+			t.Fatalf("failed to broadcast: %v", err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if mirrored, _ := mirror.Stats(); mirrored != 10 {
+		t.Errorf("expected 10 mirrored calls, got %d", mirrored)
+	}
+	if calls := atomic.LoadInt32(&ping.mirror); calls != 10 {
+		t.Errorf("expected 10 mirrored calls on the shadow server, got %d", calls)
+	}
+	if inflight := atomic.LoadInt32(&mirror.inflight); inflight != 0 {
+		t.Errorf("expected no mirrored calls in flight, got %d", inflight)
+	}
+}
+
+type slowArith int
+
+func (t *slowArith) Mul(ctx context.Context, args *Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	reply.C = args.A * args.B
+	return nil
+}
+
+func TestXClient_ServerBreaker(t *testing.T) {
+	s := server.NewServer()
+	s.RegisterName("Arith", new(slowArith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := NewPeer2PeerDiscovery("tcp@"+s.Address().String(), "")
+	opt := DefaultOption
+	opt.GenBreaker = func() Breaker {
+		return NewStateCircuitBreaker(StateCircuitBreakerOption{MinRequests: 3, OpenTimeout: time.Minute})
+	}
+	xclient := NewXClient("Arith", Failfast, RandomSelect, d, opt)
+	defer xclient.Close()
+
+	// results of calls with cached clients are recorded after the calls
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := xclient.Call(ctx, "Mul", &Args{A: 100, B: 2}, &Reply{})
+		cancel()
+		if err == nil {
+			t.Fatal("expect timeouts")
+		}
+	}
+	err := xclient.Call(context.Background(), "Mul", &Args{A: 1, B: 2}, &Reply{})
+	if err != ErrBreakerOpen {
+		t.Fatalf("expect %v but got %v", ErrBreakerOpen, err)
+	}
+}
+
+type sequenceSelector struct {
+	servers []string
+	i       int
+}
+
+func (s *sequenceSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	k := s.servers[s.i%len(s.servers)]
+	s.i++
+	return k
+}
+
+func (s *sequenceSelector) UpdateServer(servers map[string]string) {}
+
+func TestXClient_FailoverReleasesProbe(t *testing.T) {
+	s := server.NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	// a server which refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "tcp@" + ln.Addr().String()
+	ln.Close()
+	up := "tcp@" + s.Address().String()
+
+	d, _ := NewMultipleServersDiscovery([]*KVPair{{Key: down}, {Key: up}})
+	opt := DefaultOption
+	opt.Retries = 0
+	xclient := NewXClient("Arith", Failover, RoundRobin, d, opt)
+	defer xclient.Close()
+	xclient.SetSelector(&sequenceSelector{servers: []string{down, up}})
+
+	// the breaker of the healthy server admits a single probe
+	cb := NewStateCircuitBreaker(StateCircuitBreakerOption{MinRequests: 1, OpenTimeout: time.Millisecond, HalfOpenProbes: 1, ProbeTimeout: time.Minute})
+	cb.Fail()
+	time.Sleep(5 * time.Millisecond)
+	xclient.(*xClient).breakers.Store(up, cb)
+
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, &Reply{}); err == nil {
+		t.Fatal("expect an error of the down server")
+	}
+	if !cb.Ready() {
+		t.Fatal("expect the probe is not reserved after the last attempt")
+	}
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// LocalityOption contains the locality of a client and options of ZoneAware select mode.
+// Servers set their locality by "zone", "region" and "priority" in their metadata.
+type LocalityOption struct {
+	Zone   string
+	Region string
+
+	// MinHealthyRatio is the ratio of healthy weight of a locality below which calls spill over to the next locality.
+	// Calls spill over in proportion: a locality with half of MinHealthyRatio healthy receives half of the calls.
+	// Default is 0.7.
+	MinHealthyRatio float64
+
+	// ZoneWeights are the expected total weights of servers in zones.
+	// The healthy ratio of a locality is computed against the larger of the expected and registered weights of its zones,
+	// so calls spill over when servers leave discovery or are marked inactive, even without breakers.
+	// Only registered weights are used for zones not in ZoneWeights.
+	ZoneWeights map[string]int
+
+	// Selector creates the selector of servers in a locality. Default is weighted round robin.
+	Selector func(servers map[string]string) Selector
+}
+
+// healthAwareSelector is a selector that avoids unhealthy servers.
+// XClient sets healthy to a function reporting whether the breaker of a server is not open.
+type healthAwareSelector interface {
+	setHealthy(healthy func(server string) bool)
+}
+
+// locality is a group of servers with the same priority and distance from the client.
+type locality struct {
+	priority int
+	distance int // 0: same zone, 1: same region, 2: other regions
+
+	servers     []string
+	weights     map[string]int
+	zoneWeights map[string]int // registered weights of zones
+	totalWeight int            // the larger of expected and registered weights
+	selector    Selector
+}
+
+// zoneAwareSelector prefers servers in the same zone, then in the same region, then in other regions.
+// Servers with larger priority values only receive calls spilled over from servers with smaller priority values.
+type zoneAwareSelector struct {
+	opt        LocalityOption
+	localities []*locality
+	healthy    func(server string) bool
+}
+
+// NewZoneAwareSelector returns a zone aware selector. It can be set by XClient.SetSelector.
+func NewZoneAwareSelector(servers map[string]string, opt LocalityOption) Selector {
+	if opt.MinHealthyRatio <= 0 {
+		opt.MinHealthyRatio = 0.7
+	}
+	if opt.Selector == nil {
+		opt.Selector = newWeightedRoundRobinSelector
+	}
+	s := &zoneAwareSelector{opt: opt}
+	s.UpdateServer(servers)
+	return s
+}
+
+func (s *zoneAwareSelector) setHealthy(healthy func(server string) bool) {
+	s.healthy = healthy
+}
+
+func (s *zoneAwareSelector) isHealthy(server string) bool {
+	return s.healthy == nil || s.healthy(server)
+}
+
+func (s *zoneAwareSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	var fallback *locality
+	for _, l := range s.localities {
+		healthyWeight := 0
+		for _, server := range l.servers {
+			if s.isHealthy(server) {
+				healthyWeight += l.weights[server]
+			}
+		}
+		if healthyWeight == 0 {
+			continue
+		}
+		if fallback == nil {
+			fallback = l
+		}
+
+		ratio := float64(healthyWeight) / float64(l.totalWeight) / s.opt.MinHealthyRatio
+		if ratio >= 1 || rand.Float64() < ratio {
+			return s.selectIn(ctx, l, servicePath, serviceMethod, args)
+		}
+	}
+
+	// all localities spilled over, or no servers are healthy
+	if fallback == nil {
+		if len(s.localities) == 0 {
+			return ""
+		}
+		return s.localities[0].selector.Select(ctx, servicePath, serviceMethod, args)
+	}
+	return s.selectIn(ctx, fallback, servicePath, serviceMethod, args)
+}
+
+// selectIn selects a healthy server in l, which must have healthy servers.
+func (s *zoneAwareSelector) selectIn(ctx context.Context, l *locality, servicePath, serviceMethod string, args interface{}) string {
+	server := l.selector.Select(ctx, servicePath, serviceMethod, args)
+	if server != "" && s.isHealthy(server) {
+		return server
+	}
+
+	var candidates []string
+	total := 0
+	for _, server := range l.servers {
+		if s.isHealthy(server) {
+			candidates = append(candidates, server)
+			total += l.weights[server]
+		}
+	}
+	n := rand.Intn(total)
+	for _, server := range candidates {
+		n -= l.weights[server]
+		if n < 0 {
+			return server
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (s *zoneAwareSelector) UpdateServer(servers map[string]string) {
+	type localityKey struct {
+		priority int
+		distance int
+	}
+	localities := make(map[localityKey]*locality)
+	groups := make(map[localityKey]map[string]string)
+
+	for server, metadata := range servers {
+		var zone, region string
+		priority, weight := 0, 1
+		if v, err := url.ParseQuery(metadata); err == nil {
+			zone = v.Get("zone")
+			region = v.Get("region")
+			if p, err := strconv.Atoi(v.Get("priority")); err == nil {
+				priority = p
+			}
+			if w, err := strconv.Atoi(v.Get("weight")); err == nil && w > 0 {
+				weight = w
+			}
+		}
+
+		key := localityKey{priority: priority, distance: s.distance(zone, region)}
+		l := localities[key]
+		if l == nil {
+			l = &locality{priority: key.priority, distance: key.distance, weights: make(map[string]int), zoneWeights: make(map[string]int)}
+			localities[key] = l
+			groups[key] = make(map[string]string)
+		}
+		l.servers = append(l.servers, server)
+		l.weights[server] = weight
+		l.zoneWeights[zone] += weight
+		groups[key][server] = metadata
+	}
+
+	s.localities = make([]*locality, 0, len(localities))
+	for key, l := range localities {
+		sort.Strings(l.servers)
+		for zone, weight := range l.zoneWeights {
+			if expected := s.opt.ZoneWeights[zone]; expected > weight {
+				weight = expected
+			}
+			l.totalWeight += weight
+		}
+		l.selector = s.opt.Selector(groups[key])
+		s.localities = append(s.localities, l)
+	}
+	sort.Slice(s.localities, func(i, j int) bool {
+		if s.localities[i].priority != s.localities[j].priority {
+			return s.localities[i].priority < s.localities[j].priority
+		}
+		return s.localities[i].distance < s.localities[j].distance
+	})
+}
+
+// distance returns 0 for servers in the same zone, 1 for servers in the same region and 2 for others.
+// Servers without locality are in other regions.
+func (s *zoneAwareSelector) distance(zone, region string) int {
+	sameRegion := s.opt.Region == "" || region == "" || region == s.opt.Region
+	switch {
+	case zone != "" && zone == s.opt.Zone && sameRegion:
+		return 0
+	case region != "" && region == s.opt.Region:
+		return 1
+	}
+	return 2
+}
+
+// RegionFilter returns a ServiceDiscoveryFilter that accepts servers in the regions and servers without region.
+func RegionFilter(regions ...string) ServiceDiscoveryFilter {
+	return func(kvp *KVPair) bool {
+		v, err := url.ParseQuery(kvp.Value)
+		if err != nil || v.Get("region") == "" {
+			return true
+		}
+		region := v.Get("region")
+		for _, r := range regions {
+			if r == region {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ChainFilters returns a ServiceDiscoveryFilter that accepts servers accepted by all filters.
+func ChainFilters(filters ...ServiceDiscoveryFilter) ServiceDiscoveryFilter {
+	return func(kvp *KVPair) bool {
+		for _, filter := range filters {
+			if filter != nil && !filter(kvp) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"text/template"
+)
+
+var stubTemplate = template.Must(template.New("stub").Parse(`// Code generated by rpcx-gen. DO NOT EDIT.
+{{- if .Source}}
+// source: {{.Source}}
+{{- end}}
+
+package {{.Package}}
+
+import (
+	"context"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/server"
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+{{range .Services}}{{$svc := .Name}}
+// {{$svc}}Server is the server API for {{$svc}} service.
+type {{$svc}}Server interface {
+{{- range .Methods}}
+	{{.Name}}(ctx context.Context, args *{{.ArgType}}, reply *{{.ReplyType}}) error
+{{- end}}
+}
+
+// Register{{$svc}}Server registers impl as the {{$svc}} service in s.
+func Register{{$svc}}Server(s *server.Server, impl {{$svc}}Server, metadata string) error {
+	return s.RegisterName("{{$svc}}", impl, metadata)
+}
+
+// {{$svc}}Client is the typed client API for {{$svc}} service.
+type {{$svc}}Client struct {
+	xclient client.XClient
+}
+
+// New{{$svc}}Client wraps a XClient of {{$svc}} service.
+func New{{$svc}}Client(xclient client.XClient) *{{$svc}}Client {
+	return &{{$svc}}Client{xclient: xclient}
+}
+
+// XClient returns the underlying XClient.
+func (c *{{$svc}}Client) XClient() client.XClient {
+	return c.xclient
+}
+{{range .Methods}}
+// {{.Name}} calls {{$svc}}.{{.Name}}.
+func (c *{{$svc}}Client) {{.Name}}(ctx context.Context, args *{{.ArgType}}) (*{{.ReplyType}}, error) {
+	reply := &{{.ReplyType}}{}
+	err := c.xclient.Call(ctx, "{{.Name}}", args, reply)
+	return reply, err
+}
+{{end}}{{end}}`))
+
+// generate generates typed client stubs and server interfaces of file.
+func generate(file *File, source string) ([]byte, error) {
+	if file.Package == "" {
+		return nil, fmt.Errorf("package name is unknown, please set it by -pkg")
+	}
+	if len(file.Services) == 0 {
+		return nil, fmt.Errorf("no services found")
+	}
+
+	var buf bytes.Buffer
+	err := stubTemplate.Execute(&buf, struct {
+		*File
+		Source string
+	}{file, source})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %v\n%s", err, buf.Bytes())
+	}
+	return data, nil
+}
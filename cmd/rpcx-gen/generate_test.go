@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate_Go(t *testing.T) {
+	src := `package arith
+
+import (
+	"context"
+
+	tu "github.com/caser789/rpcj/_testutils"
+)
+
+type Args struct {
+	A int
+	B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith interface {
+	Mul(ctx context.Context, args *Args, reply *Reply) error
+	ProtoMul(ctx context.Context, args *tu.ProtoArgs) (*tu.ProtoReply, error)
+}
+
+type Other interface {
+	String() string
+}
+`
+	file, err := parseGoFile("arith.go", src, nil)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(file.Services) != 1 || len(file.Services[0].Methods) != 2 {
+		t.Fatalf("expect 1 service with 2 methods but got %+v", file.Services)
+	}
+
+	data, err := generate(file, "arith.go")
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+	code := string(data)
+
+	expected := []string{
+		"package arith",
+		`tu "github.com/caser789/rpcj/_testutils"`,
+		"type ArithServer interface {",
+		"ProtoMul(ctx context.Context, args *tu.ProtoArgs, reply *tu.ProtoReply) error",
+		"func NewArithClient(xclient client.XClient) *ArithClient {",
+		"func (c *ArithClient) Mul(ctx context.Context, args *Args) (*Reply, error) {",
+		`err := c.xclient.Call(ctx, "Mul", args, reply)`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(code, e) {
+			t.Errorf("expect %q in generated code:\n%s", e, code)
+		}
+	}
+}
+
+func TestGenerate_GoInvalidMethod(t *testing.T) {
+	src := `package arith
+
+import "context"
+
+type Arith interface {
+	Mul(ctx context.Context, a, b int) int
+}
+`
+	_, err := parseGoFile("arith.go", src, nil)
+	if err == nil {
+		t.Fatal("expect an error for invalid method")
+	}
+}
+
+func TestGenerate_Proto(t *testing.T) {
+	file, err := parseFile("testdata/arith_service.proto", nil)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if file.Package != "client" {
+		t.Errorf("expect package client but got %s", file.Package)
+	}
+	if len(file.Services) != 1 || file.Services[0].Name != "Arith" {
+		t.Fatalf("expect service Arith but got %+v", file.Services)
+	}
+	m := file.Services[0].Methods[0]
+	if m.Name != "Mul" || m.ArgType != "ProtoArgs" || m.ReplyType != "ProtoReply" {
+		t.Errorf("unexpected method: %+v", m)
+	}
+
+	file.Package = "testutils"
+	data, err := generate(file, "arith_service.proto")
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+	if !strings.Contains(string(data), "func (c *ArithClient) Mul(ctx context.Context, args *ProtoArgs) (*ProtoReply, error) {") {
+		t.Errorf("unexpected generated code:\n%s", data)
+	}
+}
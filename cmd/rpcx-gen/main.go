@@ -0,0 +1,88 @@
+// rpcx-gen generates typed client stubs and server interfaces of rpcx services.
+//
+// Services are defined by Go interfaces:
+//
+//	type Arith interface {
+//		Mul(ctx context.Context, args *Args, reply *Reply) error
+//	}
+//
+// or service blocks of .proto files:
+//
+//	service Arith {
+//		rpc Mul (ProtoArgs) returns (ProtoReply);
+//	}
+//
+// Usage:
+//
+//	rpcx-gen [-pkg name] [-o output] [-type Arith,...] file.go|file.proto
+//
+// The generated file contains ArithServer, RegisterArithServer and ArithClient,
+// so services can be called as:
+//
+//	reply, err := NewArithClient(xclient).Mul(ctx, &Args{A: 10, B: 20})
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	pkg   = flag.String("pkg", "", "package name of the generated file, default is the package of the input")
+	out   = flag.String("o", "", "output file, default is <input>_rpcx.go in the directory of the input, - for stdout")
+	types = flag.String("type", "", "comma-separated names of services to generate, default is all")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: rpcx-gen [flags] file.go|file.proto\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	input := flag.Arg(0)
+
+	var names []string
+	if *types != "" {
+		names = strings.Split(*types, ",")
+	}
+
+	file, err := parseFile(input, names)
+	if err != nil {
+		fatal(err)
+	}
+	if *pkg != "" {
+		file.Package = *pkg
+	}
+
+	data, err := generate(file, filepath.Base(input))
+	if err != nil {
+		fatal(err)
+	}
+
+	output := *out
+	if output == "" {
+		output = strings.TrimSuffix(input, filepath.Ext(input)) + "_rpcx.go"
+	}
+	if output == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "rpcx-gen: %v\n", err)
+	os.Exit(1)
+}
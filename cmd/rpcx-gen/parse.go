@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File is a parsed service definition.
+type File struct {
+	Package  string
+	Imports  []string
+	Services []*Service
+}
+
+// Service is a service with typed methods.
+type Service struct {
+	Name    string
+	Methods []*Method
+}
+
+// Method is a method of a service. ArgType and ReplyType are type names without the pointer.
+type Method struct {
+	Name      string
+	ArgType   string
+	ReplyType string
+}
+
+// parseGoFile parses interfaces in a Go file as service definitions.
+// Methods must be in one of the following forms:
+//
+//	Mul(ctx context.Context, args *Args, reply *Reply) error
+//	Mul(ctx context.Context, args *Args) (*Reply, error)
+//
+// If names is not empty, only the named interfaces are parsed,
+// otherwise interfaces without methods accepting context.Context are ignored.
+func parseGoFile(filename string, src interface{}, names []string) (*File, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	imports := make(map[string]string) // name -> path
+	for _, spec := range f.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		name := path.Base(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = spec.Path.Value
+	}
+
+	file := &File{Package: f.Name.Name}
+	used := make(map[string]bool)
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			it, ok := ts.Type.(*ast.InterfaceType)
+			if !ok || !selected(ts.Name.Name, names) || (len(names) == 0 && !hasContextMethod(it)) {
+				continue
+			}
+
+			svc := &Service{Name: ts.Name.Name}
+			for _, field := range it.Methods.List {
+				ft, ok := field.Type.(*ast.FuncType)
+				if !ok || len(field.Names) == 0 {
+					continue
+				}
+				m, err := parseGoMethod(field.Names[0].Name, ft, used)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s.%s: %v", fset.Position(field.Pos()), svc.Name, field.Names[0].Name, err)
+				}
+				svc.Methods = append(svc.Methods, m)
+			}
+			if len(svc.Methods) > 0 {
+				file.Services = append(file.Services, svc)
+			}
+		}
+	}
+
+	for name := range used {
+		p, ok := imports[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: package %s is not imported", filename, name)
+		}
+		if path.Base(strings.Trim(p, `"`)) != name {
+			p = name + " " + p
+		}
+		file.Imports = append(file.Imports, p)
+	}
+	sort.Strings(file.Imports)
+
+	return file, nil
+}
+
+// hasContextMethod returns true if a method of it accepts context.Context as the first argument.
+func hasContextMethod(it *ast.InterfaceType) bool {
+	for _, field := range it.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if ok && len(ft.Params.List) > 0 && exprString(ft.Params.List[0].Type) == "context.Context" {
+			return true
+		}
+	}
+	return false
+}
+
+func selected(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseGoMethod(name string, ft *ast.FuncType, used map[string]bool) (*Method, error) {
+	var params []ast.Expr
+	for _, p := range ft.Params.List {
+		n := len(p.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, p.Type)
+		}
+	}
+	var results []ast.Expr
+	if ft.Results != nil {
+		for _, r := range ft.Results.List {
+			n := len(r.Names)
+			if n == 0 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				results = append(results, r.Type)
+			}
+		}
+	}
+
+	if len(params) == 0 || exprString(params[0]) != "context.Context" {
+		return nil, fmt.Errorf("the first argument must be context.Context")
+	}
+
+	m := &Method{Name: name}
+	var argExpr, replyExpr ast.Expr
+	switch {
+	case len(params) == 3 && len(results) == 1 && exprString(results[0]) == "error":
+		argExpr, replyExpr = params[1], params[2]
+	case len(params) == 2 && len(results) == 2 && exprString(results[1]) == "error":
+		argExpr, replyExpr = params[1], results[0]
+	default:
+		return nil, fmt.Errorf("must be Method(ctx, *Args, *Reply) error or Method(ctx, *Args) (*Reply, error)")
+	}
+
+	var err error
+	if m.ArgType, err = pointerElem(argExpr, used); err != nil {
+		return nil, fmt.Errorf("args: %v", err)
+	}
+	if m.ReplyType, err = pointerElem(replyExpr, used); err != nil {
+		return nil, fmt.Errorf("reply: %v", err)
+	}
+	return m, nil
+}
+
+// pointerElem returns the name of the type pointed by expr, and marks the package of the type as used.
+func pointerElem(expr ast.Expr, used map[string]bool) (string, error) {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return "", fmt.Errorf("%s is not a pointer", exprString(expr))
+	}
+	switch x := star.X.(type) {
+	case *ast.Ident:
+		return x.Name, nil
+	case *ast.SelectorExpr:
+		pkg, ok := x.X.(*ast.Ident)
+		if !ok {
+			break
+		}
+		used[pkg.Name] = true
+		return pkg.Name + "." + x.Sel.Name, nil
+	}
+	return "", fmt.Errorf("unsupported type %s", exprString(expr))
+}
+
+func exprString(expr ast.Expr) string {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		return exprString(x.X) + "." + x.Sel.Name
+	case *ast.StarExpr:
+		return "*" + exprString(x.X)
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+var (
+	protoPackageRe   = regexp.MustCompile(`^package\s+([\w.]+)\s*;`)
+	protoGoPackageRe = regexp.MustCompile(`^option\s+go_package\s*=\s*"([^"]+)"\s*;`)
+	protoServiceRe   = regexp.MustCompile(`^service\s+(\w+)\s*\{`)
+	protoRPCRe       = regexp.MustCompile(`^rpc\s+(\w+)\s*\(\s*([\w.]+)\s*\)\s*returns\s*\(\s*([\w.]+)\s*\)`)
+	protoRPCEndRe    = regexp.MustCompile(`^(;|\{\s*\})`)
+)
+
+// parseProtoFile parses service blocks of a .proto file.
+// Messages are expected to be generated into the same Go package by protoc-gen-gogo or protoc-gen-go,
+// and streaming rpcs are not supported.
+func parseProtoFile(filename string, r io.Reader) (*File, error) {
+	file := &File{}
+	var svc *Service
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if m := protoGoPackageRe.FindStringSubmatch(line); m != nil {
+			// "path/to/pkg;name" or "path/to/pkg"
+			goPkg := m[1]
+			if i := strings.Index(goPkg, ";"); i >= 0 {
+				file.Package = goPkg[i+1:]
+			} else {
+				file.Package = path.Base(goPkg)
+			}
+			continue
+		}
+		if m := protoPackageRe.FindStringSubmatch(line); m != nil {
+			if file.Package == "" {
+				file.Package = strings.Replace(m[1], ".", "_", -1)
+			}
+			continue
+		}
+
+		if svc == nil {
+			if m := protoServiceRe.FindStringSubmatch(line); m != nil {
+				svc = &Service{Name: m[1]}
+				line = strings.TrimSpace(line[len(m[0]):])
+			}
+		}
+		if svc == nil {
+			continue
+		}
+
+		for line != "" {
+			if strings.HasPrefix(line, "}") {
+				file.Services = append(file.Services, svc)
+				svc = nil
+				break
+			}
+			m := protoRPCRe.FindStringSubmatch(line)
+			if m == nil {
+				if strings.HasPrefix(line, "rpc") {
+					return nil, fmt.Errorf("%s:%d: unsupported rpc definition: %s", filename, lineNo, line)
+				}
+				break
+			}
+			svc.Methods = append(svc.Methods, &Method{
+				Name:      m[1],
+				ArgType:   protoGoType(m[2]),
+				ReplyType: protoGoType(m[3]),
+			})
+			line = strings.TrimSpace(line[len(m[0]):])
+			line = strings.TrimSpace(protoRPCEndRe.ReplaceAllString(line, ""))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if svc != nil {
+		return nil, fmt.Errorf("%s: service %s is not closed", filename, svc.Name)
+	}
+
+	return file, nil
+}
+
+// protoGoType returns the Go type name of a message. Packages of messages are ignored.
+func protoGoType(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+func parseFile(filename string, names []string) (*File, error) {
+	if strings.HasSuffix(filename, ".proto") {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		file, err := parseProtoFile(filename, f)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			services := file.Services[:0]
+			for _, svc := range file.Services {
+				if selected(svc.Name, names) {
+					services = append(services, svc)
+				}
+			}
+			file.Services = services
+		}
+		return file, nil
+	}
+
+	return parseGoFile(filename, nil, names)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/caser789/rpcj/bench"
+)
+
+func runBench(opts *options, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	servicePath, method, err := splitServiceMethod(args[1])
+	if err != nil {
+		return err
+	}
+	s, err := opts.readArgs(args[2:])
+	if err != nil {
+		return err
+	}
+	argv, err := opts.encodeArgs(s)
+	if err != nil {
+		return err
+	}
+	meta, err := opts.metadata()
+	if err != nil {
+		return err
+	}
+
+	xclient, err := opts.xclient(args[0], servicePath)
+	if err != nil {
+		return err
+	}
+	defer xclient.Close()
+
+	b := &bench.Benchmark{
+		XClient:       xclient,
+		ServiceMethod: method,
+		Args:          argv,
+		NewReply:      opts.newReply,
+		Metadata:      meta,
+		Concurrency:   opts.concurrency,
+		QPS:           opts.qps,
+		OpenLoop:      opts.openLoop,
+		Requests:      opts.requests,
+		Duration:      opts.duration,
+		Warmup:        opts.warmup,
+		Timeout:       opts.timeout,
+	}
+	r, err := b.Run(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		if err := r.WriteJSON(opts.stdout); err != nil {
+			return err
+		}
+	} else {
+		opts.printBench(r)
+	}
+	if r.Succeeded == 0 {
+		return fmt.Errorf("all %d requests failed", r.Failed)
+	}
+	return nil
+}
+
+func (opts *options) printBench(r *bench.Result) {
+	fmt.Fprintf(opts.stdout, "requests:    %d\n", r.Requests)
+	fmt.Fprintf(opts.stdout, "succeeded:   %d\n", r.Succeeded)
+	fmt.Fprintf(opts.stdout, "failed:      %d\n", r.Failed)
+	fmt.Fprintf(opts.stdout, "elapsed:     %v\n", r.Elapsed)
+	fmt.Fprintf(opts.stdout, "throughput:  %.2f req/s\n", r.Throughput)
+
+	if r.Succeeded > 0 {
+		fmt.Fprintf(opts.stdout, "latency:     min=%v mean=%v max=%v stddev=%v\n",
+			r.Latency.Min, r.Latency.Mean, r.Latency.Max, r.Latency.StdDev)
+		for _, p := range r.Latency.Percentiles {
+			fmt.Fprintf(opts.stdout, "  p%-8v  %v\n", p.Percentile, p.Latency)
+		}
+	}
+
+	msgs := make([]string, 0, len(r.Errors))
+	for msg := range r.Errors {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		fmt.Fprintf(opts.stdout, "error:       %d\t%s\n", r.Errors[msg], msg)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/reflection"
+	"github.com/caser789/rpcj/share"
+)
+
+// readArgs returns JSON args of the command, - reads them from stdin and {} is used if absent.
+func (opts *options) readArgs(args []string) (string, error) {
+	if len(args) == 0 {
+		return "{}", nil
+	}
+	if args[0] != "-" {
+		return args[0], nil
+	}
+	data, err := ioutil.ReadAll(opts.stdin)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// encodeArgs converts JSON args to a value which can be encoded by the serialize type.
+func (opts *options) encodeArgs(s string) (interface{}, error) {
+	st, err := opts.serializeType()
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON args: %v", err)
+	}
+	if st == protocol.JSON {
+		return json.RawMessage(s), nil
+	}
+	return fromJSON(v), nil
+}
+
+// fromJSON converts json.Number in v to int64 or float64, so that numbers are typed in msgpack.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+	}
+	return v
+}
+
+// newReply returns a reply which can be decoded by the serialize type.
+func (opts *options) newReply() interface{} {
+	if st, _ := opts.serializeType(); st == protocol.JSON {
+		return new(json.RawMessage)
+	}
+	return new(interface{})
+}
+
+// printJSON prints v as indented JSON.
+func (opts *options) printJSON(v interface{}) error {
+	var data []byte
+	var err error
+	if raw, ok := v.(*json.RawMessage); ok {
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, *raw, "", "  "); err == nil {
+			data = buf.Bytes()
+		}
+	} else {
+		data, err = json.MarshalIndent(v, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(opts.stdout, "%s\n", data)
+	return err
+}
+
+// printMeta prints metadata of the response in ctx.
+func (opts *options) printMeta(ctx context.Context) {
+	meta, _ := ctx.Value(share.ResMetaDataKey).(map[string]string)
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(opts.stdout, "%s: %s\n", k, meta[k])
+	}
+}
+
+func runCall(opts *options, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	servicePath, method, err := splitServiceMethod(args[1])
+	if err != nil {
+		return err
+	}
+	s, err := opts.readArgs(args[2:])
+	if err != nil {
+		return err
+	}
+	argv, err := opts.encodeArgs(s)
+	if err != nil {
+		return err
+	}
+
+	xclient, err := opts.xclient(args[0], servicePath)
+	if err != nil {
+		return err
+	}
+	defer xclient.Close()
+
+	ctx, cancel, err := opts.context()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	reply := opts.newReply()
+	if err := xclient.Call(ctx, method, argv, reply); err != nil {
+		return err
+	}
+	if opts.verbose {
+		opts.printMeta(ctx)
+	}
+	return opts.printJSON(reply)
+}
+
+func runList(opts *options, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUsage
+	}
+	var name string
+	if len(args) == 2 {
+		name = args[1]
+	}
+
+	xclient, err := opts.xclient(args[0], opts.reflection)
+	if err != nil {
+		return err
+	}
+	defer xclient.Close()
+
+	ctx, cancel, err := opts.context()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	var d reflection.Descriptor
+	if err := xclient.Call(ctx, "GetDescriptor", name, &d); err != nil {
+		return err
+	}
+	if opts.verbose {
+		return opts.printJSON(&d)
+	}
+
+	for _, sd := range d.Services {
+		if sd.Metadata == "" {
+			fmt.Fprintln(opts.stdout, sd.Name)
+		} else {
+			fmt.Fprintf(opts.stdout, "%s\t%s\n", sd.Name, sd.Metadata)
+		}
+		for _, m := range sd.Methods {
+			fmt.Fprintf(opts.stdout, "  %s(%s) %s\t%s", m.Name, m.ArgType, m.ReplyType, serializeNames(m.SerializeTypes))
+			if m.Metadata != "" {
+				fmt.Fprintf(opts.stdout, "\t%s", m.Metadata)
+			}
+			fmt.Fprintln(opts.stdout)
+		}
+	}
+	return nil
+}
+
+var serializeTypeNames = map[protocol.SerializeType]string{
+	protocol.SerializeNone: "raw",
+	protocol.JSON:          "json",
+	protocol.ProtoBuffer:   "protobuf",
+	protocol.MsgPack:       "msgpack",
+	protocol.Thrift:        "thrift",
+}
+
+func serializeNames(sts []protocol.SerializeType) string {
+	names := make([]string, 0, len(sts))
+	for _, st := range sts {
+		if name, ok := serializeTypeNames[st]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprint(int(st)))
+		}
+	}
+	return strings.Join(names, ",")
+}
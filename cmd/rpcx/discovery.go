@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+)
+
+// discoveryFunc creates a ServiceDiscovery of servicePath from the URL of a registry.
+type discoveryFunc func(u *url.URL, servicePath string) (client.ServiceDiscovery, error)
+
+// discoveries are service discoveries by schemes of targets.
+var discoveries = map[string]discoveryFunc{
+	"file": func(u *url.URL, servicePath string) (client.ServiceDiscovery, error) {
+		return client.NewFileDiscovery(u.Host+u.Path, servicePath, time.Minute)
+	},
+	"zookeeper": func(u *url.URL, servicePath string) (client.ServiceDiscovery, error) {
+		return client.NewZookeeperDiscovery(basePath(u), servicePath, hosts(u), nil)
+	},
+	"consul": func(u *url.URL, servicePath string) (client.ServiceDiscovery, error) {
+		return client.NewConsulDiscovery(basePath(u), servicePath, hosts(u), nil)
+	},
+	"redis": func(u *url.URL, servicePath string) (client.ServiceDiscovery, error) {
+		return client.NewRedisDiscovery(basePath(u), servicePath, hosts(u), nil)
+	},
+	"mdns": func(u *url.URL, servicePath string) (client.ServiceDiscovery, error) {
+		timeout := 5 * time.Second
+		if s := u.Query().Get("timeout"); s != "" {
+			var err error
+			if timeout, err = time.ParseDuration(s); err != nil {
+				return nil, err
+			}
+		}
+		return client.NewMDNSDiscovery(servicePath, timeout, time.Minute, u.Query().Get("domain"))
+	},
+	"dns": func(u *url.URL, _ string) (client.ServiceDiscovery, error) {
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", port)
+		}
+		network := u.Query().Get("network")
+		if network == "" {
+			network = "tcp"
+		}
+		return client.NewDNSDiscovery(host, network, p, time.Minute)
+	},
+	"dnssrv": func(u *url.URL, _ string) (client.ServiceDiscovery, error) {
+		return client.NewDNSSRVDiscovery(client.DNSSRVOption{Name: u.Host, Network: u.Query().Get("network")})
+	},
+	"k8s": func(u *url.URL, _ string) (client.ServiceDiscovery, error) {
+		return client.NewKubernetesInClusterDiscovery(u.Host, strings.Trim(u.Path, "/"), u.Query().Get("port"))
+	},
+}
+
+func basePath(u *url.URL) string {
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		return p
+	}
+	return "rpcx"
+}
+
+func hosts(u *url.URL) []string {
+	return strings.Split(u.Host, ",")
+}
+
+// newDiscovery creates a ServiceDiscovery of servicePath on target,
+// which is servers such as tcp@127.0.0.1:8972 separated by commas, or the URL of a registry.
+func newDiscovery(target, servicePath string) (client.ServiceDiscovery, error) {
+	if i := strings.Index(target, "://"); i > 0 {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		fn, ok := discoveries[u.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("unsupported registry %s", u.Scheme)
+		}
+		return fn(u, servicePath)
+	}
+
+	var pairs []*client.KVPair
+	for _, server := range strings.Split(target, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if !strings.Contains(server, "@") {
+			server = "tcp@" + server
+		}
+		pairs = append(pairs, &client.KVPair{Key: server})
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no servers in %q", target)
+	}
+	return client.NewMultipleServersDiscovery(pairs)
+}
+
+func runDiscover(opts *options, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	d, err := newDiscovery(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	pairs := d.GetServices()
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	for _, p := range pairs {
+		if p.Value == "" {
+			fmt.Fprintln(opts.stdout, p.Key)
+		} else {
+			fmt.Fprintf(opts.stdout, "%s\t%s\n", p.Key, p.Value)
+		}
+	}
+	if len(pairs) == 0 {
+		return fmt.Errorf("no servers of %s", args[1])
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// +build etcd
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/caser789/rpcj/client"
+)
+
+func init() {
+	discoveries["etcd"] = func(u *url.URL, servicePath string) (client.ServiceDiscovery, error) {
+		return client.NewEtcdV3Discovery(basePath(u), servicePath, hosts(u), nil)
+	}
+}
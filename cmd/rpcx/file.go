@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/caser789/rpcj/share"
+)
+
+func runUpload(opts *options, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	meta, err := opts.metadata()
+	if err != nil {
+		return err
+	}
+	xclient, err := opts.xclient(args[0], share.SendFileServiceName)
+	if err != nil {
+		return err
+	}
+	defer xclient.Close()
+
+	ctx, cancel, err := opts.context()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return xclient.SendFile(ctx, args[1], opts.rate, meta)
+}
+
+func runDownload(opts *options, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	local := filepath.Base(args[1])
+	if len(args) == 3 {
+		local = args[2]
+	}
+	meta, err := opts.metadata()
+	if err != nil {
+		return err
+	}
+	xclient, err := opts.xclient(args[0], share.SendFileServiceName)
+	if err != nil {
+		return err
+	}
+	defer xclient.Close()
+
+	ctx, cancel, err := opts.context()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	w := opts.stdout
+	if local != "-" {
+		f, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return xclient.DownloadFile(ctx, args[1], w, meta)
+}
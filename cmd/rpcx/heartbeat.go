@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+)
+
+func runHeartbeat(opts *options, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if strings.Contains(args[0], "://") && opts.service == "" {
+		return fmt.Errorf("-service is required to resolve servers of registries")
+	}
+	st, err := opts.serializeType()
+	if err != nil {
+		return err
+	}
+	d, err := newDiscovery(args[0], opts.service)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	pairs := d.GetServices()
+	if len(pairs) == 0 {
+		return fmt.Errorf("no servers in %s", args[0])
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	option := client.DefaultOption
+	option.SerializeType = st
+	option.ConnectTimeout = opts.timeout
+
+	var failed int
+	for _, p := range pairs {
+		if err := opts.heartbeat(p.Key, option); err != nil {
+			fmt.Fprintf(opts.stdout, "%s: %v\n", p.Key, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed", failed, len(pairs))
+	}
+	return nil
+}
+
+// heartbeat sends heartbeats to the server, and prints their round-trip times.
+func (opts *options) heartbeat(server string, option client.Option) error {
+	network, addr := server, server
+	if i := strings.Index(server, "@"); i > 0 {
+		network, addr = server[:i], server[i+1:]
+	}
+	c := client.NewClient(option)
+	if err := c.Connect(network, addr); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for seq := 1; opts.count == 0 || seq <= opts.count; seq++ {
+		if seq > 1 {
+			time.Sleep(opts.interval)
+		}
+		request := time.Now().UnixNano()
+		var reply int64
+		ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+		start := time.Now()
+		err := c.Call(ctx, "", "", &request, &reply)
+		rtt := time.Since(start)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if reply != request {
+			return fmt.Errorf("reply %d of heartbeat %d is different from request %d", reply, seq, request)
+		}
+		fmt.Fprintf(opts.stdout, "%s: seq=%d time=%v\n", server, seq, rtt)
+	}
+	return nil
+}
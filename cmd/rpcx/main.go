@@ -0,0 +1,246 @@
+// rpcx is a command-line client of rpcx services for ad-hoc calls and debugging.
+//
+// Usage:
+//
+//	rpcx call [flags] target Service.Method [args]   call a method with JSON args, - reads args from stdin
+//	rpcx list [flags] target [Service]               list services by the reflection service
+//	rpcx discover [flags] target Service             resolve servers of a service
+//	rpcx heartbeat [flags] target                    send heartbeats to servers
+//	rpcx upload [flags] target file                  send a file by SendFile
+//	rpcx download [flags] target file [local]        download a file by DownloadFile, - writes it to stdout
+//	rpcx bench [flags] target Service.Method [args]  benchmark a method
+//
+// Targets are servers such as tcp@127.0.0.1:8972, separated by commas,
+// or registries of service discoveries:
+//
+//	file:///etc/rpcx/servers.yaml
+//	zookeeper://127.0.0.1:2181,127.0.0.2:2181/rpcx_test
+//	consul://127.0.0.1:8500/rpcx_test
+//	redis://127.0.0.1:6379/rpcx_test
+//	etcd://127.0.0.1:2379/rpcx_test      (built with -tags etcd)
+//	mdns://?domain=local.
+//	dns://example.com:8972
+//	dnssrv://_rpcx._tcp.example.com
+//	k8s://namespace/service?port=rpcx
+//
+// For example:
+//
+//	rpcx call tcp@localhost:8972 Arith.Mul '{"A":10,"B":20}'
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+// errUsage is returned by commands of wrong arguments.
+var errUsage = errors.New("wrong arguments")
+
+type command struct {
+	usage string
+	run   func(opts *options, args []string) error
+}
+
+var commands = map[string]command{
+	"call":      {"target Service.Method [args]", runCall},
+	"list":      {"target [Service]", runList},
+	"discover":  {"target Service", runDiscover},
+	"heartbeat": {"target", runHeartbeat},
+	"upload":    {"target file", runUpload},
+	"download":  {"target file [local]", runDownload},
+	"bench":     {"target Service.Method [args]", runBench},
+}
+
+var commandNames = []string{"call", "list", "discover", "heartbeat", "upload", "download", "bench"}
+
+// options are flags of commands.
+type options struct {
+	fs *flag.FlagSet
+
+	timeout    time.Duration
+	serialize  string
+	meta       string
+	auth       string
+	reflection string
+	service    string
+	verbose    bool
+
+	// heartbeat
+	count    int
+	interval time.Duration
+
+	// upload
+	rate int64
+
+	// bench
+	requests    int64
+	concurrency int
+	duration    time.Duration
+	qps         float64
+	openLoop    bool
+	warmup      time.Duration
+	json        bool
+
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func newOptions(name string) *options {
+	opts := &options{fs: flag.NewFlagSet(name, flag.ContinueOnError), stdin: os.Stdin, stdout: os.Stdout}
+	fs := opts.fs
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of requests")
+	fs.StringVar(&opts.serialize, "serialize", "json", "serialize type of args and replies, json or msgpack")
+	fs.StringVar(&opts.meta, "meta", "", "metadata of requests in URL query format, such as k1=v1&k2=v2")
+	fs.StringVar(&opts.auth, "auth", "", "auth token of requests")
+	verbose := "print metadata of responses"
+	if name == "list" {
+		verbose = "print descriptors with schemas in JSON"
+	}
+	fs.BoolVar(&opts.verbose, "v", false, verbose)
+
+	switch name {
+	case "list":
+		fs.StringVar(&opts.reflection, "reflection", "Reflection", "name of the reflection service")
+	case "heartbeat":
+		fs.StringVar(&opts.service, "service", "", "service to resolve servers of registries")
+		fs.IntVar(&opts.count, "n", 3, "number of heartbeats to each server, 0 means forever")
+		fs.DurationVar(&opts.interval, "interval", time.Second, "interval of heartbeats")
+	case "upload":
+		fs.Int64Var(&opts.rate, "rate", 0, "rate limit of uploading in bytes per second, 0 means no limit")
+	case "bench":
+		fs.Int64Var(&opts.requests, "n", 10000, "number of requests, 0 means until the duration")
+		fs.IntVar(&opts.concurrency, "c", 10, "number of concurrent callers")
+		fs.DurationVar(&opts.duration, "d", 0, "duration of the benchmark, 0 means until the number of requests")
+		fs.Float64Var(&opts.qps, "qps", 0, "rate of requests per second, 0 means no limit")
+		fs.BoolVar(&opts.openLoop, "open", false, "schedule requests at the rate of -qps regardless of responses to avoid coordinated omission")
+		fs.DurationVar(&opts.warmup, "warmup", 0, "duration of warmup before measurements")
+		fs.BoolVar(&opts.json, "json", false, "print results in JSON")
+	}
+	return opts
+}
+
+func (opts *options) serializeType() (protocol.SerializeType, error) {
+	switch strings.ToLower(opts.serialize) {
+	case "json":
+		return protocol.JSON, nil
+	case "msgpack":
+		return protocol.MsgPack, nil
+	}
+	return 0, fmt.Errorf("unsupported serialize type %s", opts.serialize)
+}
+
+// metadata returns metadata of requests.
+func (opts *options) metadata() (map[string]string, error) {
+	meta := make(map[string]string)
+	if opts.meta == "" {
+		return meta, nil
+	}
+	values, err := url.ParseQuery(opts.meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata %s: %v", opts.meta, err)
+	}
+	for k, v := range values {
+		meta[k] = v[0]
+	}
+	return meta, nil
+}
+
+// context returns the context of a request with metadata.
+func (opts *options) context() (context.Context, context.CancelFunc, error) {
+	meta, err := opts.metadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, meta)
+	ctx = context.WithValue(ctx, share.ResMetaDataKey, make(map[string]string))
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	return ctx, cancel, nil
+}
+
+// xclient creates a XClient of servicePath on target.
+func (opts *options) xclient(target, servicePath string) (client.XClient, error) {
+	st, err := opts.serializeType()
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDiscovery(target, servicePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.GetServices()) == 0 {
+		d.Close()
+		return nil, fmt.Errorf("no servers of %s in %s", servicePath, target)
+	}
+
+	option := client.DefaultOption
+	option.SerializeType = st
+	option.Retries = 0
+	xclient := client.NewXClient(servicePath, client.Failfast, client.RandomSelect, d, option)
+	if opts.auth != "" {
+		xclient.Auth(opts.auth)
+	}
+	return xclient, nil
+}
+
+func splitServiceMethod(s string) (string, string, error) {
+	i := strings.LastIndex(s, ".")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("method must be Service.Method but got %s", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: rpcx command [flags] args\n\nCommands:\n")
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun rpcx command -h for flags of the command.\n")
+}
+
+// run runs the command of args, and returns the exit code.
+func run(args []string, stdin io.Reader, stdout io.Writer) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return 2
+	}
+
+	opts := newOptions(args[0])
+	opts.stdin, opts.stdout = stdin, stdout
+	opts.fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rpcx %s [flags] %s\n", args[0], cmd.usage)
+		opts.fs.PrintDefaults()
+	}
+	if err := opts.fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if err := cmd.run(opts, opts.fs.Args()); err != nil {
+		if err == errUsage {
+			opts.fs.Usage()
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "rpcx %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout))
+}
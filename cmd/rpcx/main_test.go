@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/bench"
+	"github.com/caser789/rpcj/reflection"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+)
+
+type Args struct {
+	A int
+	B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Mul(ctx context.Context, args *Args, reply *Reply) error {
+	reply.C = args.A * args.B
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok && meta["echo"] != "" {
+		ctx.Value(share.ResMetaDataKey).(map[string]string)["echo"] = meta["echo"]
+	}
+	return nil
+}
+
+func startServer(t *testing.T) (*server.Server, string) {
+	s := server.NewServer()
+	r := reflection.New()
+	s.Plugins.Add(r)
+	if err := s.RegisterName("Arith", new(Arith), "group=test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("Reflection", r, ""); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve("tcp", "127.0.0.1:0")
+	for i := 0; i < 50 && s.Address() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Address() == nil {
+		t.Fatal("server is not started")
+	}
+	return s, "tcp@" + s.Address().String()
+}
+
+func runOutput(t *testing.T, stdin string, args ...string) (string, int) {
+	var out bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &out)
+	return out.String(), code
+}
+
+func TestCall(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	for _, serialize := range []string{"json", "msgpack"} {
+		out, code := runOutput(t, "", "call", "-serialize", serialize, addr, "Arith.Mul", `{"A":10,"B":20}`)
+		if code != 0 {
+			t.Fatalf("%s: unexpected exit code %d", serialize, code)
+		}
+		var reply Reply
+		if err := json.Unmarshal([]byte(out), &reply); err != nil || reply.C != 200 {
+			t.Errorf("%s: unexpected reply %q: %v", serialize, out, err)
+		}
+	}
+
+	out, code := runOutput(t, `{"A":3,"B":4}`, "call", "-v", "-meta", "echo=hi", addr, "Arith.Mul", "-")
+	if code != 0 || !strings.Contains(out, "echo: hi") || !strings.Contains(out, `"C": 12`) {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+
+	if _, code := runOutput(t, "", "call", addr, "Arith.Missing"); code != 1 {
+		t.Errorf("expect failures of missing methods but got %d", code)
+	}
+	if _, code := runOutput(t, "", "call", addr, "Arith.Mul", "{"); code != 1 {
+		t.Errorf("expect failures of invalid args but got %d", code)
+	}
+	if _, code := runOutput(t, "", "call", addr); code != 2 {
+		t.Errorf("expect usage of wrong arguments but got %d", code)
+	}
+	if _, code := runOutput(t, "", "unknown"); code != 2 {
+		t.Errorf("expect usage of unknown commands but got %d", code)
+	}
+}
+
+func TestList(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	out, code := runOutput(t, "", "list", addr)
+	if code != 0 || !strings.Contains(out, "Arith\tgroup=test") || !strings.Contains(out, "Mul(*main.Args) *main.Reply") {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+
+	out, code = runOutput(t, "", "list", "-v", addr, "Arith")
+	var d reflection.Descriptor
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d", code)
+	}
+	if err := json.Unmarshal([]byte(out), &d); err != nil || len(d.Services) != 1 || d.Components.Schemas["Args"] == nil {
+		t.Errorf("unexpected descriptor %q: %v", out, err)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	out, code := runOutput(t, "", "discover", "127.0.0.1:8972,tcp@127.0.0.1:8973", "Arith")
+	if code != 0 || out != "tcp@127.0.0.1:8972\ntcp@127.0.0.1:8973\n" {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+	if _, code := runOutput(t, "", "discover", "unknown://127.0.0.1", "Arith"); code != 1 {
+		t.Errorf("expect failures of unknown registries but got %d", code)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	out, code := runOutput(t, "", "heartbeat", "-n", "2", "-interval", "10ms", addr)
+	if code != 0 || strings.Count(out, addr+": seq=") != 2 {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+	if _, code := runOutput(t, "", "heartbeat", "consul://127.0.0.1:8500"); code != 1 {
+		t.Errorf("expect -service is required but got %d", code)
+	}
+}
+
+func TestFileTransfer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileAddr := ln.Addr().String()
+	ln.Close()
+
+	uploaded := make(chan []byte, 1)
+	ft := server.NewFileTransfer(fileAddr, func(conn net.Conn, args *share.FileTransferArgs) {
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(conn, args.FileSize))
+		uploaded <- data
+	}, func(conn net.Conn, args *share.DownloadFileArgs) {
+		defer conn.Close()
+		conn.Write([]byte("content of " + args.FileName))
+	}, 10)
+
+	s, addr := startServer(t)
+	defer s.Close()
+	s.EnableFileTransfer(share.SendFileServiceName, ft)
+	time.Sleep(100 * time.Millisecond)
+
+	dir, err := ioutil.TempDir("", "rpcx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "upload.txt")
+	if err := ioutil.WriteFile(name, []byte("hello rpcx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, code := runOutput(t, "", "upload", addr, name); code != 0 {
+		t.Fatalf("unexpected exit code %d", code)
+	}
+	select {
+	case data := <-uploaded:
+		if string(data) != "hello rpcx" {
+			t.Errorf("unexpected uploaded content %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file is not uploaded")
+	}
+
+	out, code := runOutput(t, "", "download", addr, "a.txt", "-")
+	if code != 0 || out != "content of a.txt" {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+}
+
+func TestBench(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Close()
+
+	out, code := runOutput(t, "", "bench", "-n", "100", "-c", "4", addr, "Arith.Mul", `{"A":1,"B":2}`)
+	if code != 0 || !strings.Contains(out, "succeeded:   100\n") || !strings.Contains(out, "p99") {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+
+	out, code = runOutput(t, "", "bench", "-json", "-n", "20", "-qps", "1000", "-open", addr, "Arith.Mul", `{"A":1,"B":2}`)
+	var r bench.Result
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d", code)
+	}
+	if err := json.Unmarshal([]byte(out), &r); err != nil || r.Succeeded != 20 || !r.OpenLoop {
+		t.Errorf("unexpected result %q: %v", out, err)
+	}
+
+	out, code = runOutput(t, "", "bench", "-n", "10", "-c", "2", addr, "Arith.Missing")
+	if code != 1 || !strings.Contains(out, "failed:      10\n") || !strings.Contains(out, "error:       10\t") {
+		t.Errorf("unexpected output %q of code %d", out, code)
+	}
+}
@@ -5,7 +5,9 @@ go 1.16
 require (
 	git.apache.org/thrift.git v0.0.0-20180902110319-2566ecd5d999 // indirect
 	github.com/ChimeraCoder/gojson v1.1.0
+	github.com/HdrHistogram/hdrhistogram-go v1.1.2
 	github.com/abronan/valkeyrie v0.2.0
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/anacrolix/missinggo v1.3.0 // indirect
 	github.com/anacrolix/sync v0.4.0 // indirect
 	github.com/anacrolix/utp v0.1.0
@@ -16,8 +18,11 @@ require (
 	github.com/edwingeng/doublejump v0.0.0-20200219153503-7cfc0ed6e836
 	github.com/fatih/color v1.12.0
 	github.com/fzipp/gocyclo v0.3.1 // indirect
+	github.com/go-ping/ping v0.0.0-20201115131931-3300c582a663
+	github.com/go-redis/redis/v8 v8.8.2
 	github.com/gogo/protobuf v1.3.2
 	github.com/golang/protobuf v1.5.2
+	github.com/golang/snappy v0.0.2
 	github.com/google/renameio v0.1.0 // indirect
 	github.com/grandcat/zeroconf v0.0.0-20180329153754-df75bb3ccae1
 	github.com/hashicorp/go-multierror v1.1.0
@@ -30,24 +35,37 @@ require (
 	github.com/kr/pretty v0.2.0
 	github.com/marten-seemann/quic-conn v0.0.0-20191204020628-6e719687462b
 	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/miekg/dns v1.1.26
 	github.com/nacos-group/nacos-sdk-go v1.0.8
 	github.com/opentracing/opentracing-go v1.1.1-0.20190913142402-a7454ce5950e
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
 	github.com/rogpeppe/go-internal v1.3.0 // indirect
+	github.com/rpcxio/libkv v0.5.1-0.20210420120011-1fceaedca8a5
 	github.com/rs/cors v1.7.0
 	github.com/rubyist/circuitbreaker v2.2.1+incompatible
 	github.com/smallnest/libkv-etcdv3-store v1.1.9
 	github.com/smallnest/rpcx v1.6.7
 	github.com/smallnest/valkeyrie v0.0.0-20201124111609-8912291d39da
-	github.com/soheilhy/cmux v0.1.4
+	github.com/soheilhy/cmux v0.1.5
+	github.com/stretchr/testify v1.7.0
+	github.com/syndtr/goleveldb v1.0.0
 	github.com/tatsushid/go-fastping v0.0.0-20160109021039-d7bb493dee3e
 	github.com/u35s/rudp v0.0.0-20190524081740-bcc26b6b3828 // indirect
 	github.com/valyala/fastrand v0.0.0-20170531153657-19dd0f0bf014
 	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	github.com/vmihailenco/msgpack/v5 v5.3.4
 	github.com/vrischmann/go-metrics-influxdb v0.1.1 // indirect
 	github.com/xtaci/kcp-go v5.4.20+incompatible
+	go.etcd.io/etcd/api/v3 v3.5.0
+	go.etcd.io/etcd/client/v3 v3.5.0
+	go.etcd.io/etcd/server/v3 v3.5.0
 	go.opencensus.io v0.22.3
-	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	google.golang.org/appengine v1.6.7 // indirect
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 	honnef.co/go/tools v0.2.0 // indirect
 )
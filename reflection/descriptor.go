@@ -0,0 +1,137 @@
+package reflection
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+)
+
+// Descriptor describes services, so that generic tools can call methods by JSON without compiling against their types.
+type Descriptor struct {
+	Services []*ServiceDescriptor `json:"services"`
+	// Components contains schemas of named types, which are referenced by #/components/schemas/Name.
+	Components server.OpenAPIComponents `json:"components"`
+}
+
+// ServiceDescriptor describes a service.
+type ServiceDescriptor struct {
+	Name string `json:"name"`
+	// Metadata is the metadata of the registration of the service.
+	Metadata string              `json:"metadata,omitempty"`
+	Methods  []*MethodDescriptor `json:"methods"`
+}
+
+// MethodDescriptor describes a method or a function of a service.
+type MethodDescriptor struct {
+	Name string `json:"name"`
+	// Function is true for functions registered by RegisterFunction.
+	Function bool `json:"function,omitempty"`
+	// Metadata is the metadata of the registration of the function.
+	Metadata  string             `json:"metadata,omitempty"`
+	ArgType   string             `json:"arg_type"`
+	ReplyType string             `json:"reply_type"`
+	Arg       *server.JSONSchema `json:"arg"`
+	Reply     *server.JSONSchema `json:"reply"`
+	// SerializeTypes are serialize types which can encode args and replies.
+	// Methods can be called by JSON without their types if it contains protocol.JSON.
+	SerializeTypes []protocol.SerializeType `json:"serialize_types"`
+
+	argType, replyType reflect.Type
+}
+
+func newMethodDescriptor(name string, argType, replyType reflect.Type) *MethodDescriptor {
+	return &MethodDescriptor{
+		Name:           name,
+		ArgType:        argType.String(),
+		ReplyType:      replyType.String(),
+		SerializeTypes: serializeTypes(argType, replyType),
+		argType:        argType,
+		replyType:      replyType,
+	}
+}
+
+// serializeTypes returns serialize types of codecs in share.Codecs which can encode zero values of args and replies.
+func serializeTypes(types ...reflect.Type) []protocol.SerializeType {
+	var sts []protocol.SerializeType
+	for st, codec := range share.Codecs {
+		ok := true
+		for _, t := range types {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if !canEncode(codec, reflect.New(t).Interface()) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			sts = append(sts, st)
+		}
+	}
+	sort.Slice(sts, func(i, j int) bool { return sts[i] < sts[j] })
+	return sts
+}
+
+func canEncode(codec interface{ Encode(interface{}) ([]byte, error) }, v interface{}) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	_, err := codec.Encode(v)
+	return err == nil
+}
+
+// Describe returns the Descriptor of services. All services are described if names is empty.
+func (r *Reflection) Describe(names ...string) (*Descriptor, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(names) == 0 {
+		for name := range r.descriptors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	g := server.NewSchemaGenerator()
+	d := &Descriptor{}
+	for _, name := range names {
+		sd, ok := r.descriptors[name]
+		if !ok {
+			return nil, fmt.Errorf("not found service %s", name)
+		}
+		described := &ServiceDescriptor{Name: sd.Name, Metadata: sd.Metadata}
+		for _, m := range sd.Methods {
+			md := *m
+			md.Arg = g.Schema(m.argType)
+			md.Reply = g.Schema(m.replyType)
+			described.Methods = append(described.Methods, &md)
+		}
+		sort.Slice(described.Methods, func(i, j int) bool { return described.Methods[i].Name < described.Methods[j].Name })
+		d.Services = append(d.Services, described)
+	}
+	d.Components.Schemas = g.Schemas
+	return d, nil
+}
+
+// GetDescriptor returns the Descriptor of the service s, or of all services if s is empty.
+func (r *Reflection) GetDescriptor(ctx context.Context, s string, reply *Descriptor) error {
+	var d *Descriptor
+	var err error
+	if s == "" {
+		d, err = r.Describe()
+	} else {
+		d, err = r.Describe(s)
+	}
+	if err != nil {
+		return err
+	}
+	*reply = *d
+	return nil
+}
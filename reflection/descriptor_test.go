@@ -0,0 +1,112 @@
+package reflection
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"testing"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+)
+
+type Reply struct {
+	C int `json:"c"`
+}
+
+type Calc int
+
+func (c *Calc) Add(ctx context.Context, args *Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func Double(ctx context.Context, args *int, reply *int) error {
+	*reply = *args * 2
+	return nil
+}
+
+func hasSerializeType(sts []protocol.SerializeType, st protocol.SerializeType) bool {
+	for _, s := range sts {
+		if s == st {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReflection_Describe(t *testing.T) {
+	r := New()
+	s := server.NewServer()
+	s.Plugins.Add(r)
+	if err := s.RegisterName("Calc", new(Calc), "group=a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunction("Math", Double, "weight=2"); err != nil {
+		t.Fatal(err)
+	}
+	arith := PBArith(0)
+	if err := s.RegisterName("Arith", &arith, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var d Descriptor
+	if err := r.GetDescriptor(context.Background(), "", &d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Services) != 3 || d.Services[0].Name != "Arith" || d.Services[1].Name != "Calc" || d.Services[2].Name != "Math" {
+		t.Fatalf("unexpected services %+v", d.Services)
+	}
+
+	calc := d.Services[1]
+	if calc.Metadata != "group=a" || len(calc.Methods) != 1 {
+		t.Fatalf("unexpected service %+v", calc)
+	}
+	add := calc.Methods[0]
+	if add.Name != "Add" || add.Function || add.ArgType != "*reflection.Args" || add.Arg.Ref != "#/components/schemas/Args" {
+		t.Errorf("unexpected method %+v", add)
+	}
+	if !hasSerializeType(add.SerializeTypes, protocol.JSON) || hasSerializeType(add.SerializeTypes, protocol.ProtoBuffer) {
+		t.Errorf("unexpected serialize types %v", add.SerializeTypes)
+	}
+	double := d.Services[2].Methods[0]
+	if double.Name != "Double" || !double.Function || double.Metadata != "weight=2" || double.Arg.Type != "integer" {
+		t.Errorf("unexpected function %+v", double)
+	}
+	if reply := d.Components.Schemas["Reply"]; reply == nil || reply.Properties["c"].Type != "integer" {
+		t.Errorf("unexpected schema of Reply %+v", reply)
+	}
+
+	mul := d.Services[0].Methods[0]
+	if !hasSerializeType(mul.SerializeTypes, protocol.ProtoBuffer) {
+		t.Errorf("expect protobuf for proto messages but got %v", mul.SerializeTypes)
+	}
+
+	// descriptors are JSON for generic tools
+	data, err := stdjson.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic map[string]interface{}
+	if err := stdjson.Unmarshal(data, &generic); err != nil || len(generic["services"].([]interface{})) != 3 {
+		t.Fatalf("unexpected JSON %s", data)
+	}
+
+	if err := r.GetDescriptor(context.Background(), "Missing", &d); err == nil {
+		t.Error("expect an error of the missing service")
+	}
+	// methods registered after functions of the same service are merged
+	r.RegisterFunction("Merged", "Double", Double, "")
+	r.Register("Merged", new(Calc), "group=b")
+	merged, err := r.Describe("Merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd := merged.Services[0]; sd.Metadata != "group=b" || len(sd.Methods) != 2 || sd.Methods[0].Name != "Add" || sd.Methods[1].Name != "Double" {
+		t.Fatalf("unexpected service %+v", sd)
+	}
+
+	r.Unregister("Calc")
+	if _, err := r.Describe("Calc"); err == nil {
+		t.Error("expect Calc is unregistered")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"text/template"
 	"unicode"
 	"unicode/utf8"
@@ -63,15 +64,20 @@ func (si ServiceInfo) String() string {
 
 type Reflection struct {
 	Services map[string]*ServiceInfo
+
+	mu          sync.RWMutex
+	descriptors map[string]*ServiceDescriptor
 }
 
 func New() *Reflection {
 	return &Reflection{
-		Services: make(map[string]*ServiceInfo),
+		Services:    make(map[string]*ServiceInfo),
+		descriptors: make(map[string]*ServiceDescriptor),
 	}
 }
 func (r *Reflection) Register(name string, rcvr interface{}, metadata string) error {
 	si := &ServiceInfo{}
+	sd := &ServiceDescriptor{Name: name, Metadata: metadata}
 
 	val := reflect.ValueOf(rcvr)
 	typ := reflect.TypeOf(rcvr)
@@ -125,6 +131,8 @@ func (r *Reflection) Register(name string, rcvr interface{}, metadata string) er
 			continue
 		}
 
+		sd.Methods = append(sd.Methods, newMethodDescriptor(method.Name, argType, replyType))
+
 		mi := &MethodInfo{}
 		mi.Name = method.Name
 
@@ -141,19 +149,70 @@ func (r *Reflection) Register(name string, rcvr interface{}, metadata string) er
 		si.Methods = append(si.Methods, mi)
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if len(si.Methods) > 0 {
 		r.Services[name] = si
 	}
+	if len(sd.Methods) > 0 {
+		// functions may have been registered to the same service before
+		if old := r.descriptors[name]; old != nil {
+			old.Metadata = metadata
+			for _, md := range sd.Methods {
+				old.setMethod(md)
+			}
+		} else {
+			r.descriptors[name] = sd
+		}
+	}
 
 	return nil
 }
 
+// RegisterFunction records functions registered by RegisterFunction of servers.
+// They are described by GetDescriptor, but not by GetService or GetServices.
+func (r *Reflection) RegisterFunction(serviceName, fname string, fn interface{}, metadata string) error {
+	ftype := reflect.TypeOf(fn)
+	if ftype == nil || ftype.Kind() != reflect.Func || ftype.NumIn() != 3 || ftype.In(2).Kind() != reflect.Ptr {
+		return nil
+	}
+	md := newMethodDescriptor(fname, ftype.In(1), ftype.In(2))
+	md.Function = true
+	md.Metadata = metadata
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sd := r.descriptors[serviceName]
+	if sd == nil {
+		sd = &ServiceDescriptor{Name: serviceName}
+		r.descriptors[serviceName] = sd
+	}
+	sd.setMethod(md)
+	return nil
+}
+
+// setMethod adds md to the service, and replaces the method of the same name.
+func (sd *ServiceDescriptor) setMethod(md *MethodDescriptor) {
+	for i, m := range sd.Methods {
+		if m.Name == md.Name {
+			sd.Methods = append(sd.Methods[:i], sd.Methods[i+1:]...)
+			break
+		}
+	}
+	sd.Methods = append(sd.Methods, md)
+}
+
 func (r *Reflection) Unregister(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	delete(r.Services, name)
+	delete(r.descriptors, name)
 	return nil
 }
 
 func (r *Reflection) GetService(ctx context.Context, s string, reply *string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	si, ok := r.Services[s]
 	if !ok {
 		return fmt.Errorf("not found service %s", s)
@@ -164,6 +223,8 @@ func (r *Reflection) GetService(ctx context.Context, s string, reply *string) er
 }
 
 func (r *Reflection) GetServices(ctx context.Context, s string, reply *string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	var buf bytes.Buffer
 
 	pkg := `package `
@@ -0,0 +1,90 @@
+package rpcxtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/caser789/rpcj/server"
+)
+
+// ErrDropped is returned to calls whose connections are dropped by faults.
+var ErrDropped = errors.New("rpcxtest: connection dropped")
+
+// Fault fails calls of a service or a method.
+type Fault struct {
+	// Delay delays calls before they are handled.
+	Delay time.Duration
+	// Err is returned to clients instead of calling methods.
+	Err error
+	// Drop closes connections of calls, as if the network is broken.
+	Drop bool
+	// Times is the number of calls to fail, 0 means all calls.
+	Times int
+}
+
+type fault struct {
+	Fault
+	hits int
+}
+
+// InjectFault injects the fault into calls of serviceMethod, which is Service.Method or Service for all methods of the service.
+// It replaces the previous fault of serviceMethod.
+func (s *Server) InjectFault(serviceMethod string, f Fault) {
+	s.mu.Lock()
+	s.faults[serviceMethod] = &fault{Fault: f}
+	s.mu.Unlock()
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	s.faults = make(map[string]*fault)
+	s.mu.Unlock()
+}
+
+// takeFault returns the fault of the method, and counts it.
+func (s *Server) takeFault(serviceName, methodName string) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.faults[serviceName+"."+methodName]
+	if f == nil {
+		f = s.faults[serviceName]
+	}
+	if f == nil || (f.Times > 0 && f.hits >= f.Times) {
+		return Fault{}, false
+	}
+	f.hits++
+	return f.Fault, true
+}
+
+// interceptor is the plugin of servers to inject faults and record calls.
+type interceptor struct {
+	s *Server
+}
+
+func (i *interceptor) PreCall(ctx context.Context, serviceName, methodName string, args interface{}) (interface{}, error) {
+	f, ok := i.s.takeFault(serviceName, methodName)
+	if !ok {
+		return args, nil
+	}
+
+	if f.Delay > 0 {
+		t := time.NewTimer(f.Delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return args, ctx.Err()
+		case <-t.C:
+		}
+	}
+	if f.Drop {
+		if conn, ok := ctx.Value(server.RemoteConnContextKey).(net.Conn); ok {
+			conn.Close()
+		}
+		return args, ErrDropped
+	}
+	return args, f.Err
+}
@@ -0,0 +1,84 @@
+package rpcxtest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+// Call is a call recorded by servers.
+type Call struct {
+	ServicePath   string
+	ServiceMethod string
+	Metadata      map[string]string
+	SerializeType protocol.SerializeType
+	Oneway        bool
+	// Payload is the encoded args.
+	Payload []byte
+	// Error is the error returned to the client, empty if the call succeeded.
+	Error string
+}
+
+// DecodeArgs decodes args of the call into v.
+func (c *Call) DecodeArgs(v interface{}) error {
+	codec := share.Codecs[c.SerializeType]
+	if codec == nil {
+		return fmt.Errorf("can not find codec for %d", c.SerializeType)
+	}
+	return codec.Decode(c.Payload, v)
+}
+
+// Calls returns calls handled by the server in order of responses.
+func (s *Server) Calls() []*Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Call(nil), s.calls...)
+}
+
+// CallsOf returns calls of the Service.Method.
+func (s *Server) CallsOf(serviceMethod string) []*Call {
+	var calls []*Call
+	for _, c := range s.Calls() {
+		if c.ServicePath+"."+c.ServiceMethod == serviceMethod {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// ResetCalls removes recorded calls.
+func (s *Server) ResetCalls() {
+	s.mu.Lock()
+	s.calls = nil
+	s.mu.Unlock()
+}
+
+// PreWriteResponse records calls before responses are sent, so calls are recorded once clients get replies.
+// Messages are copied since they are pooled.
+func (i *interceptor) PreWriteResponse(ctx context.Context, req *protocol.Message, res *protocol.Message, err error) error {
+	if req == nil || req.IsHeartbeat() {
+		return nil
+	}
+
+	c := &Call{
+		ServicePath:   req.ServicePath,
+		ServiceMethod: req.ServiceMethod,
+		Metadata:      make(map[string]string, len(req.Metadata)),
+		SerializeType: req.SerializeType(),
+		Oneway:        req.IsOneway(),
+		Payload:       append([]byte(nil), req.Payload...),
+	}
+	for k, v := range req.Metadata {
+		c.Metadata[k] = v
+	}
+	if res != nil && res.MessageStatusType() == protocol.Error {
+		c.Error = res.Metadata[protocol.ServiceError]
+	}
+
+	i.s.mu.Lock()
+	i.s.calls = append(i.s.calls, c)
+	i.s.mu.Unlock()
+	return nil
+}
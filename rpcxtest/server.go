@@ -0,0 +1,77 @@
+package rpcxtest
+
+import (
+	"net"
+	"sync"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/util"
+)
+
+// Server is a rpcx server for tests, which serves in-process connections without sockets.
+// Services are registered by the embedded server.Server, and calls to them can be recorded and failed by faults.
+type Server struct {
+	*server.Server
+	// Addr is the rpcx address of the server, such as inprocess@inprocess-1.
+	Addr string
+
+	ln net.Listener
+
+	mu       sync.Mutex
+	xclients []client.XClient
+	faults   map[string]*fault
+	calls    []*Call
+}
+
+// NewServer creates and starts a server with options. It panics if the server can not listen.
+func NewServer(options ...server.OptionFn) *Server {
+	ln, err := util.ListenInprocess("")
+	if err != nil {
+		panic("rpcxtest: failed to listen: " + err.Error())
+	}
+
+	s := &Server{
+		Server: server.NewServer(options...),
+		Addr:   util.InprocessNetwork + "@" + ln.Addr().String(),
+		ln:     ln,
+		faults: make(map[string]*fault),
+	}
+	s.Plugins.Add(&interceptor{s: s})
+	// connections wait until they are accepted, so the server is ready once it serves
+	go s.ServeListener(util.InprocessNetwork, ln)
+	return s
+}
+
+// NewXClient creates a XClient of servicePath connected to the server with client.DefaultOption.
+// XClients are closed when the server is closed.
+func (s *Server) NewXClient(servicePath string) client.XClient {
+	return s.NewXClientWithOption(servicePath, client.DefaultOption)
+}
+
+// NewXClientWithOption creates a XClient of servicePath connected to the server with option.
+// XClients are closed when the server is closed.
+func (s *Server) NewXClientWithOption(servicePath string, option client.Option) client.XClient {
+	d, _ := client.NewPeer2PeerDiscovery(s.Addr, "")
+	xclient := client.NewXClient(servicePath, client.Failfast, client.RandomSelect, d, option)
+
+	s.mu.Lock()
+	s.xclients = append(s.xclients, xclient)
+	s.mu.Unlock()
+	return xclient
+}
+
+// Close closes XClients created by the server, and then closes the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	xclients := s.xclients
+	s.xclients = nil
+	s.mu.Unlock()
+	for _, xclient := range xclients {
+		xclient.Close()
+	}
+
+	err := s.Server.Close()
+	s.ln.Close()
+	return err
+}
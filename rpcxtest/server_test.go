@@ -0,0 +1,118 @@
+package rpcxtest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/share"
+)
+
+type Args struct {
+	A int
+	B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Mul(ctx context.Context, args *Args, reply *Reply) error {
+	reply.C = args.A * args.B
+	return nil
+}
+
+func (t *Arith) Add(ctx context.Context, args *Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	if err := s.RegisterName("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s.Addr, "inprocess@") {
+		t.Fatalf("unexpected address %s", s.Addr)
+	}
+
+	xclient := s.NewXClient("Arith")
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{"k": "v"})
+	reply := &Reply{}
+	if err := xclient.Call(ctx, "Mul", &Args{A: 10, B: 20}, reply); err != nil || reply.C != 200 {
+		t.Fatalf("unexpected reply %d: %v", reply.C, err)
+	}
+	if err := xclient.Call(context.Background(), "Missing", &Args{}, reply); err == nil {
+		t.Fatal("expect an error of the missing method")
+	}
+
+	calls := s.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expect 2 calls but got %d", len(calls))
+	}
+	var args Args
+	if err := calls[0].DecodeArgs(&args); err != nil || args.A != 10 || args.B != 20 {
+		t.Errorf("unexpected args %+v: %v", args, err)
+	}
+	if calls[0].ServiceMethod != "Mul" || calls[0].Metadata["k"] != "v" || calls[0].Error != "" {
+		t.Errorf("unexpected call %+v", calls[0])
+	}
+	if !strings.Contains(calls[1].Error, "Missing") {
+		t.Errorf("expect the error is recorded but got %+v", calls[1])
+	}
+	if len(s.CallsOf("Arith.Mul")) != 1 {
+		t.Errorf("expect a call of Arith.Mul")
+	}
+	s.ResetCalls()
+	if len(s.Calls()) != 0 {
+		t.Error("expect calls are reset")
+	}
+}
+
+func TestServer_InjectFault(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RegisterName("Arith", new(Arith), "")
+	xclient := s.NewXClient("Arith")
+	args := &Args{A: 1, B: 2}
+	reply := &Reply{}
+
+	// method faults take precedence over service faults
+	s.InjectFault("Arith", Fault{Err: errors.New("unavailable")})
+	s.InjectFault("Arith.Mul", Fault{Err: errors.New("overloaded"), Times: 1})
+	if err := xclient.Call(context.Background(), "Mul", args, reply); err == nil || err.Error() != "overloaded" {
+		t.Fatalf("expect overloaded but got %v", err)
+	}
+	if err := xclient.Call(context.Background(), "Mul", args, reply); err != nil || reply.C != 2 {
+		t.Fatalf("expect the fault is used up but got %v", err)
+	}
+	if err := xclient.Call(context.Background(), "Add", args, reply); err == nil || err.Error() != "unavailable" {
+		t.Fatalf("expect unavailable but got %v", err)
+	}
+
+	s.ClearFaults()
+	s.InjectFault("Arith.Add", Fault{Delay: 50 * time.Millisecond, Times: 1})
+	start := time.Now()
+	if err := xclient.Call(context.Background(), "Add", args, reply); err != nil || reply.C != 3 {
+		t.Fatalf("unexpected reply %d: %v", reply.C, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expect the call is delayed but took %v", d)
+	}
+
+	s.InjectFault("Arith.Add", Fault{Drop: true, Times: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := xclient.Call(ctx, "Add", args, reply); err == nil {
+		t.Fatal("expect an error of the dropped connection")
+	}
+	// XClients reconnect broken connections
+	if err := xclient.Call(context.Background(), "Add", args, reply); err != nil {
+		t.Fatalf("expect reconnected but got %v", err)
+	}
+}
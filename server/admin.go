@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/share"
+)
+
+// connStat records runtime statistics of a client connection.
+type connStat struct {
+	createdAt    time.Time
+	readBytes    int64
+	writtenBytes int64
+	pending      int32
+	draining     int32
+	// handlers tracks handlers of pending requests.
+	handlers sync.WaitGroup
+}
+
+func (cs *connStat) addWritten(n int) {
+	atomic.AddInt64(&cs.writtenBytes, int64(n))
+}
+
+func (cs *connStat) isDraining() bool {
+	return atomic.LoadInt32(&cs.draining) == 1
+}
+
+// waitIdle waits until all pending requests of the connection are handled.
+func (cs *connStat) waitIdle() {
+	cs.handlers.Wait()
+}
+
+// countingReader counts bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// ServiceInfo describes a registered service.
+type ServiceInfo struct {
+	Name      string       `json:"name"`
+	Methods   []MethodInfo `json:"methods,omitempty"`
+	Functions []MethodInfo `json:"functions,omitempty"`
+}
+
+// MethodInfo describes a method or a function of a service.
+type MethodInfo struct {
+	Name      string `json:"name"`
+	ArgType   string `json:"arg_type"`
+	ReplyType string `json:"reply_type"`
+}
+
+// ConnInfo describes an active client connection.
+type ConnInfo struct {
+	RemoteAddr   string `json:"remote_addr"`
+	LocalAddr    string `json:"local_addr"`
+	Age          string `json:"age"`
+	ReadBytes    int64  `json:"read_bytes"`
+	WrittenBytes int64  `json:"written_bytes"`
+	Pending      int32  `json:"pending"`
+	Draining     bool   `json:"draining"`
+}
+
+// Services returns registered services and their methods, sorted by name.
+func (s *Server) Services() []ServiceInfo {
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+
+	infos := make([]ServiceInfo, 0, len(s.serviceMap))
+	for name, svc := range s.serviceMap {
+		info := ServiceInfo{Name: name}
+		for mname, mtype := range svc.method {
+			info.Methods = append(info.Methods, MethodInfo{
+				Name:      mname,
+				ArgType:   typeName(mtype.ArgType),
+				ReplyType: typeName(mtype.ReplyType),
+			})
+		}
+		for fname, ftype := range svc.function {
+			info.Functions = append(info.Functions, MethodInfo{
+				Name:      fname,
+				ArgType:   typeName(ftype.ArgType),
+				ReplyType: typeName(ftype.ReplyType),
+			})
+		}
+		sort.Slice(info.Methods, func(i, j int) bool { return info.Methods[i].Name < info.Methods[j].Name })
+		sort.Slice(info.Functions, func(i, j int) bool { return info.Functions[i].Name < info.Functions[j].Name })
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func typeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	return t.String()
+}
+
+// ConnInfos returns statistics of active client connections.
+func (s *Server) ConnInfos() []ConnInfo {
+	conns := s.ActiveClientConn()
+	infos := make([]ConnInfo, 0, len(conns))
+	now := time.Now()
+	for _, conn := range conns {
+		info := ConnInfo{
+			RemoteAddr: conn.RemoteAddr().String(),
+			LocalAddr:  conn.LocalAddr().String(),
+		}
+		if v, ok := s.connStats.Load(conn); ok {
+			stat := v.(*connStat)
+			info.Age = now.Sub(stat.createdAt).Truncate(time.Millisecond).String()
+			info.ReadBytes = atomic.LoadInt64(&stat.readBytes)
+			info.WrittenBytes = atomic.LoadInt64(&stat.writtenBytes)
+			info.Pending = atomic.LoadInt32(&stat.pending)
+			info.Draining = stat.isDraining()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].RemoteAddr < infos[j].RemoteAddr })
+	return infos
+}
+
+// HandlingRequests returns the number of requests being handled.
+func (s *Server) HandlingRequests() int32 {
+	return atomic.LoadInt32(&s.handlerMsgNum)
+}
+
+func (s *Server) findConn(remoteAddr string) net.Conn {
+	for _, conn := range s.ActiveClientConn() {
+		if conn.RemoteAddr().String() == remoteAddr {
+			return conn
+		}
+	}
+	return nil
+}
+
+// CloseConn closes the client connection from remoteAddr immediately.
+func (s *Server) CloseConn(remoteAddr string) error {
+	conn := s.findConn(remoteAddr)
+	if conn == nil {
+		return fmt.Errorf("rpcx: connection %s not found", remoteAddr)
+	}
+	return conn.Close()
+}
+
+// DrainConn stops reading new requests from the client connection from remoteAddr,
+// and closes it after its pending requests are handled.
+func (s *Server) DrainConn(remoteAddr string) error {
+	conn := s.findConn(remoteAddr)
+	if conn == nil {
+		return fmt.Errorf("rpcx: connection %s not found", remoteAddr)
+	}
+	s.drainConn(conn)
+	return nil
+}
+
+func (s *Server) drainConn(conn net.Conn) {
+	v, ok := s.connStats.Load(conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	if atomic.CompareAndSwapInt32(&v.(*connStat).draining, 0, 1) {
+		// wake up the blocked reading
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Drain puts the server into drain mode.
+// New connections are closed right after accepted and active connections are drained.
+// Unlike Shutdown, the listener is kept open and Drain does not wait.
+func (s *Server) Drain() {
+	if !atomic.CompareAndSwapInt32(&s.inDrain, 0, 1) {
+		return
+	}
+	log.Info("drain begin")
+	for _, conn := range s.ActiveClientConn() {
+		s.drainConn(conn)
+	}
+}
+
+// IsDraining returns whether the server is in drain mode.
+func (s *Server) IsDraining() bool {
+	return isDrain(s)
+}
+
+// AdminHandler returns a http.Handler that exposes live state of the server for debugging.
+// It can be mounted on the http gateway by HandleGateway or served on a separate address.
+//
+// Routes under prefix:
+//
+//	GET  /services                  registered services and methods
+//	GET  /conns                     active connections
+//	GET  /plugins                   added plugins
+//	GET  /options                   server options
+//	POST /trace?enable=true|false   toggle trace logs by share.SetTrace
+//	POST /conns/close?addr=         close a connection
+//	POST /conns/drain?addr=         drain a connection
+//	POST /drain                     put the server into drain mode
+func (s *Server) AdminHandler(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"/services", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, s.Services())
+	})
+	mux.HandleFunc(prefix+"/conns", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, map[string]interface{}{
+			"handling_requests": s.HandlingRequests(),
+			"draining":          s.IsDraining(),
+			"conns":             s.ConnInfos(),
+		})
+	})
+	mux.HandleFunc(prefix+"/plugins", func(w http.ResponseWriter, r *http.Request) {
+		plugins := s.Plugins.All()
+		names := make([]string, 0, len(plugins))
+		for _, p := range plugins {
+			names = append(names, fmt.Sprintf("%T", p))
+		}
+		writeAdminJSON(w, names)
+	})
+	mux.HandleFunc(prefix+"/options", func(w http.ResponseWriter, r *http.Request) {
+		opts := map[string]string{
+			"readTimeout":        s.readTimeout.String(),
+			"writeTimeout":       s.writeTimeout.String(),
+			"DisableHTTPGateway": strconv.FormatBool(s.DisableHTTPGateway),
+			"DisableJSONRPC":     strconv.FormatBool(s.DisableJSONRPC),
+			"TLS":                strconv.FormatBool(s.tlsConfig != nil),
+			"Trace":              strconv.FormatBool(share.TraceEnabled()),
+		}
+		for k, v := range s.options {
+			opts[k] = fmt.Sprint(v)
+		}
+		writeAdminJSON(w, opts)
+	})
+	mux.HandleFunc(prefix+"/trace", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+		if err != nil {
+			http.Error(w, "invalid enable: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		share.SetTrace(enable)
+		log.Infof("trace is set to %t by admin", enable)
+		writeAdminJSON(w, map[string]bool{"trace": enable})
+	})
+	mux.HandleFunc(prefix+"/conns/close", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		if err := s.CloseConn(r.URL.Query().Get("addr")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(prefix+"/conns/drain", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		if err := s.DrainConn(r.URL.Query().Get("addr")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(prefix+"/drain", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		s.Drain()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Warnf("failed to write admin response: %v", err)
+	}
+}
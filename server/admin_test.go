@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+func TestAdminHandler(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := client.NewPeer2PeerDiscovery("tcp@"+s.Address().String(), "")
+	xclient := client.NewXClient("Arith", client.Failfast, client.RandomSelect, d, client.DefaultOption)
+	defer xclient.Close()
+
+	reply := &Reply{}
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+
+	h := s.AdminHandler("/debug/rpcx")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/rpcx/services", nil))
+	var services []ServiceInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &services); err != nil {
+		t.Fatalf("failed to decode services: %v", err)
+	}
+	if len(services) != 1 || services[0].Name != "Arith" {
+		t.Fatalf("expect service Arith but got %+v", services)
+	}
+	found := false
+	for _, m := range services[0].Methods {
+		if m.Name == "Mul" {
+			found = true
+			if m.ArgType != "*server.Args" || m.ReplyType != "*server.Reply" {
+				t.Errorf("unexpected types of Mul: %+v", m)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expect method Mul but got %+v", services[0].Methods)
+	}
+
+	conns := s.ConnInfos()
+	if len(conns) != 1 {
+		t.Fatalf("expect 1 conn but got %d", len(conns))
+	}
+	if conns[0].ReadBytes == 0 || conns[0].WrittenBytes == 0 {
+		t.Errorf("expect counted bytes but got %+v", conns[0])
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/rpcx/trace?enable=true", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expect 405 but got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/rpcx/trace?enable=true", nil))
+	if !share.TraceEnabled() {
+		t.Errorf("expect trace enabled")
+	}
+	share.SetTrace(false)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/rpcx/conns/drain?addr="+conns[0].RemoteAddr, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expect 204 but got %d: %s", w.Code, w.Body.String())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(s.ActiveClientConn()); n != 0 {
+		t.Errorf("expect drained conn closed but got %d active conns", n)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/rpcx/drain", nil))
+	if !s.IsDraining() {
+		t.Errorf("expect server in drain mode")
+	}
+}
+
+// blockFirstRead blocks reading of the first request until release is closed.
+type blockFirstRead struct {
+	once    sync.Once
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (p *blockFirstRead) PostReadRequest(ctx context.Context, r *protocol.Message, e error) error {
+	p.once.Do(func() {
+		close(p.read)
+		<-p.release
+	})
+	return nil
+}
+
+func TestDrainConn_Buffered(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("Arith", new(Arith), "")
+	p := &blockFirstRead{read: make(chan struct{}), release: make(chan struct{})}
+	s.Plugins.Add(p)
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", s.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// two requests are sent at once, so that the second one is buffered while reading the first one
+	var data []byte
+	for seq := uint64(1); seq <= 2; seq++ {
+		req := protocol.NewMessage()
+		req.SetMessageType(protocol.Request)
+		req.SetSerializeType(protocol.JSON)
+		req.SetSeq(seq)
+		req.ServicePath = "Arith"
+		req.ServiceMethod = "Mul"
+		req.Payload, _ = json.Marshal(&Args{A: 10, B: 20})
+		data = append(data, req.Encode()...)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-p.read:
+	case <-time.After(time.Second):
+		t.Fatal("request is not read")
+	}
+	if err := s.DrainConn(conn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	close(p.release)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		res, err := protocol.Read(conn)
+		if err != nil {
+			t.Fatalf("expect 2 responses but got %d: %v", i, err)
+		}
+		if res.MessageStatusType() != protocol.Normal {
+			t.Errorf("unexpected response of seq %d: %v", res.Seq(), res.Metadata)
+		}
+	}
+	if _, err := protocol.Read(conn); err == nil {
+		t.Error("expect the drained connection closed")
+	}
+}
@@ -37,6 +37,15 @@ func (s *Server) startGateway(network string, ln net.Listener) net.Listener {
 		go s.startJSONRPC2(jsonrpc2Ln)
 	}
 
+	if !s.DisableGRPC {
+		grpcLn := m.MatchWithWriters(grpcMatcher())
+		srv := s.newGRPCServer()
+		s.mu.Lock()
+		s.grpcServer = srv
+		s.mu.Unlock()
+		go s.startGRPC(srv, grpcLn)
+	}
+
 	if !s.DisableHTTPGateway {
 		httpLn := m.Match(cmux.HTTP1Fast())
 		go s.startHTTP1APIGateway(httpLn)
@@ -62,18 +71,34 @@ func (s *Server) startHTTP1APIGateway(ln net.Listener) {
 	router.GET("/*servicePath", s.handleGatewayRequest)
 	router.PUT("/*servicePath", s.handleGatewayRequest)
 
+	var handler http.Handler = router
+	s.mu.RLock()
+	if len(s.gatewayHandlers) > 0 || s.openAPIInfo != nil {
+		mux := http.NewServeMux()
+		for pattern, h := range s.gatewayHandlers {
+			mux.Handle(pattern, h)
+		}
+		if _, ok := s.gatewayHandlers[OpenAPIPath]; !ok && s.openAPIInfo != nil {
+			mux.Handle(OpenAPIPath, s.OpenAPIHandler(*s.openAPIInfo))
+		}
+		mux.Handle("/", router)
+		handler = mux
+	}
+	if len(s.routes) > 0 {
+		handler = s.routeHandler(s.routes, handler)
+	}
+	s.mu.RUnlock()
+
 	if s.corsOptions != nil {
 		opt := cors.Options(*s.corsOptions)
 		c := cors.New(opt)
-		mux := c.Handler(router)
-		s.mu.Lock()
-		s.gatewayHTTPServer = &http.Server{Handler: mux}
-		s.mu.Unlock()
-	} else {
-		s.mu.Lock()
-		s.gatewayHTTPServer = &http.Server{Handler: router}
-		s.mu.Unlock()
+		handler = c.Handler(handler)
 	}
+	s.mu.Lock()
+	s.gatewayHTTPServer = &http.Server{Handler: handler, ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, HttpConnContextKey, c)
+	}}
+	s.mu.Unlock()
 
 	if err := s.gatewayHTTPServer.Serve(ln); err != nil {
 		if err == ErrServerClosed || strings.Contains(err.Error(), "listener closed") {
@@ -84,6 +109,19 @@ func (s *Server) startHTTP1APIGateway(ln net.Listener) {
 	}
 }
 
+// HandleGateway mounts handler on the http gateway for the given pattern,
+// for example a metrics or debug handler.
+// Requests matching the pattern are served by handler instead of being converted to rpcx requests.
+// It must be called before the server starts.
+func (s *Server) HandleGateway(pattern string, handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gatewayHandlers == nil {
+		s.gatewayHandlers = make(map[string]http.Handler)
+	}
+	s.gatewayHandlers[pattern] = handler
+}
+
 func (s *Server) closeHTTP1APIGateway(ctx context.Context) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -96,6 +134,7 @@ func (s *Server) closeHTTP1APIGateway(ctx context.Context) error {
 
 func (s *Server) handleGatewayRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	ctx := share.WithValue(r.Context(), RemoteConnContextKey, r.RemoteAddr) // notice: It is a string, different with TCP (net.Conn)
+	ctx = share.WithLocalValue(ctx, PeerContextKey, newHTTPPeer(r))
 	err := s.Plugins.DoPreReadRequest(ctx)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -148,7 +187,9 @@ func (s *Server) handleGatewayRequest(w http.ResponseWriter, r *http.Request, pa
 	}
 	err = s.Plugins.DoPostReadRequest(ctx, req, nil)
 	if err != nil {
+		s.Plugins.DoPreWriteResponse(ctx, req, nil, err)
 		http.Error(w, err.Error(), 500)
+		s.Plugins.DoPostWriteResponse(ctx, req, req.Clone(), err)
 		return
 	}
 
@@ -176,9 +217,17 @@ func (s *Server) handleGatewayRequest(w http.ResponseWriter, r *http.Request, pa
 		} else {
 			log.Warnf("rpcx:  gateway request: %v", err)
 		}
+		s.Plugins.DoPreWriteResponse(newCtx, req, res, err)
 		wh.Set(XMessageStatusType, "Error")
 		wh.Set(XErrorMessage, err.Error())
-		w.WriteHeader(500)
+		if _, ok := err.(*InvalidArgumentError); ok {
+			meta := url.Values{}
+			meta.Set(share.InvalidArgumentKey, res.Metadata[share.InvalidArgumentKey])
+			wh.Set(XMeta, meta.Encode())
+		}
+		setRetryAfter(wh, resMetadata)
+		w.WriteHeader(HTTPStatus(err))
+		s.Plugins.DoPostWriteResponse(newCtx, req, res, err)
 		return
 	}
 
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcRawCodec passes payloads of gRPC messages through without decoding them.
+// Payloads are decoded by the protobuf codec of rpcx when requests are handled.
+type grpcRawCodec struct{}
+
+func (grpcRawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case *[]byte:
+		return *data, nil
+	}
+	return nil, fmt.Errorf("rpcx: grpc codec can not marshal %T", v)
+}
+
+func (grpcRawCodec) Unmarshal(data []byte, v interface{}) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rpcx: grpc codec can not unmarshal %T", v)
+	}
+	*p = append((*p)[:0], data...)
+	return nil
+}
+
+func (grpcRawCodec) Name() string {
+	return "proto"
+}
+
+func grpcMatcher() cmux.MatchWriter {
+	// content-type may be "application/grpc+proto" or other subtypes
+	return cmux.HTTP2MatchHeaderFieldPrefixSendSettings("content-type", "application/grpc")
+}
+
+// grpcConnCredentials passes connections through, because TLS connections have been accepted by the TLS listener
+// of the server. It reports TLS states of connections as auth infos, so gRPC calls get peers with client certificates.
+type grpcConnCredentials struct{}
+
+func (grpcConnCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("rpcx: grpc server credentials can not be used by clients")
+}
+
+func (grpcConnCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	c := conn
+	if mc, ok := c.(*cmux.MuxConn); ok {
+		c = mc.Conn
+	}
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return conn, nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	info := credentials.TLSInfo{
+		State:          tlsConn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+	}
+	return conn, info, nil
+}
+
+func (grpcConnCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{}
+}
+
+func (c grpcConnCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (grpcConnCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+func (s *Server) newGRPCServer() *grpc.Server {
+	return grpc.NewServer(
+		grpc.Creds(grpcConnCredentials{}),
+		grpc.ForceServerCodec(grpcRawCodec{}),
+		grpc.UnknownServiceHandler(s.handleGRPCStream),
+	)
+}
+
+func (s *Server) startGRPC(srv *grpc.Server, ln net.Listener) {
+	if err := srv.Serve(ln); err != nil {
+		if err == grpc.ErrServerStopped || strings.Contains(err.Error(), "listener closed") {
+			log.Info("grpc server closed")
+		} else {
+			log.Errorf("error in grpc Serve: %T %s", err, err)
+		}
+	}
+}
+
+// closeGRPC stops the grpc server gracefully, and stops it immediately if ctx is done before.
+func (s *Server) closeGRPC(ctx context.Context) {
+	s.mu.RLock()
+	srv := s.grpcServer
+	s.mu.RUnlock()
+	if srv == nil {
+		return
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
+
+// splitGRPCMethod splits a full gRPC method name, such as "/pkg.Arith/Mul", into service path and method.
+// The package is ignored if the service is registered without it.
+func (s *Server) splitGRPCMethod(fullMethod string) (string, string, error) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	i := strings.LastIndex(name, "/")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", fmt.Errorf("malformed method name %q", fullMethod)
+	}
+	servicePath, serviceMethod := name[:i], name[i+1:]
+
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+
+	svc := s.serviceMap[servicePath]
+	if svc == nil {
+		if j := strings.LastIndex(servicePath, "."); j >= 0 {
+			servicePath = servicePath[j+1:]
+			svc = s.serviceMap[servicePath]
+		}
+	}
+	if svc == nil {
+		return "", "", errors.New("rpcx: can't find service " + servicePath)
+	}
+	if svc.method[serviceMethod] == nil && svc.function[serviceMethod] == nil {
+		return "", "", errors.New("rpcx: can't find method " + serviceMethod)
+	}
+	return servicePath, serviceMethod, nil
+}
+
+// handleGRPCStream handles unary gRPC calls as rpcx requests with ProtoBuffer serialization.
+func (s *Server) handleGRPCStream(srv interface{}, stream grpc.ServerStream) error {
+	fullMethod, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "rpcx: can not get method of grpc stream")
+	}
+	atomic.AddInt32(&s.handlerMsgNum, 1)
+	defer atomic.AddInt32(&s.handlerMsgNum, -1)
+
+	var remoteAddr string
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remoteAddr = p.Addr.String()
+	}
+	ctx := share.WithValue(stream.Context(), RemoteConnContextKey, remoteAddr) // notice: It is a string, different with TCP (net.Conn)
+	ctx = share.WithLocalValue(ctx, PeerContextKey, newGRPCPeer(stream.Context()))
+	err := s.Plugins.DoPreReadRequest(ctx)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	servicePath, serviceMethod, err := s.splitGRPCMethod(fullMethod)
+	if err != nil {
+		return status.Error(codes.Unimplemented, err.Error())
+	}
+
+	var payload []byte
+	if err := stream.RecvMsg(&payload); err != nil {
+		return err
+	}
+
+	req := protocol.NewMessage()
+	defer protocol.FreeMsg(req)
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.ProtoBuffer)
+	req.SetSeq(atomic.AddUint64(&s.seq, 1))
+	req.ServicePath = servicePath
+	req.ServiceMethod = serviceMethod
+	req.Payload = payload
+	req.Metadata = grpcMetadataToRpcx(stream.Context())
+
+	err = s.Plugins.DoPostReadRequest(ctx, req, nil)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	ctx.SetValue(StartRequestContextKey, time.Now().UnixNano())
+	err = s.auth(ctx, req)
+	if err != nil {
+		s.Plugins.DoPreWriteResponse(ctx, req, nil, err)
+		s.Plugins.DoPostWriteResponse(ctx, req, req.Clone(), err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	resMetadata := make(map[string]string)
+	newCtx := share.WithLocalValue(share.WithLocalValue(ctx, share.ReqMetaDataKey, req.Metadata),
+		share.ResMetaDataKey, resMetadata)
+
+	res, err := s.handleRequest(newCtx, req)
+	defer protocol.FreeMsg(res)
+
+	if err != nil {
+		if s.HandleServiceError != nil {
+			s.HandleServiceError(err)
+		} else {
+			log.Warnf("rpcx: grpc request: %v", err)
+		}
+		s.Plugins.DoPreWriteResponse(newCtx, req, res, err)
+		s.Plugins.DoPostWriteResponse(newCtx, req, res, err)
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	s.Plugins.DoPreWriteResponse(newCtx, req, nil, nil)
+	// only metadata set by services is sent back, metadata of requests is not echoed.
+	if len(resMetadata) > 0 {
+		stream.SetHeader(rpcxMetadataToGRPC(resMetadata))
+	}
+	err = stream.SendMsg(res.Payload)
+	s.Plugins.DoPostWriteResponse(newCtx, req, res, err)
+	return err
+}
+
+// grpcMetadataToRpcx converts incoming gRPC metadata to rpcx metadata.
+// The "authorization" header is used as the auth token of rpcx.
+func grpcMetadataToRpcx(ctx context.Context) map[string]string {
+	m := make(map[string]string)
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return m
+	}
+	for k, v := range md {
+		if len(v) == 0 || strings.HasPrefix(k, ":") {
+			continue
+		}
+		if k == "authorization" {
+			m[share.AuthKey] = v[0]
+			continue
+		}
+		m[k] = v[0]
+	}
+	return m
+}
+
+func rpcxMetadataToGRPC(m map[string]string) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range m {
+		// gRPC only accepts lowercase keys
+		md.Append(strings.ToLower(k), v)
+	}
+	return md
+}
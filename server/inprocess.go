@@ -0,0 +1,25 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/caser789/rpcj/util"
+)
+
+func init() {
+	makeListeners[util.InprocessNetwork] = inprocessMakeListener
+}
+
+// inprocessMakeListener listens in-process connections, so that clients in the process connect it without sockets.
+// A unique address is generated if address is empty, which can be got by Address.
+func inprocessMakeListener(s *Server, address string) (ln net.Listener, err error) {
+	ln, err = util.ListenInprocess(address)
+	if err != nil {
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	return ln, nil
+}
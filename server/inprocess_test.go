@@ -0,0 +1,22 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/caser789/rpcj/util"
+)
+
+func TestInprocessMakeListener(t *testing.T) {
+	s := NewServer()
+	ln, err := s.makeListener(util.InprocessNetwork, "server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().Network() != util.InprocessNetwork || ln.Addr().String() != "server-test" {
+		t.Fatalf("unexpected address %v", ln.Addr())
+	}
+	if _, err := s.makeListener(util.InprocessNetwork, "server-test"); err == nil {
+		t.Fatal("expect an error of the address in use")
+	}
+}
@@ -37,6 +37,7 @@ func (s *Server) jsonrpcHandler(w http.ResponseWriter, r *http.Request) {
 	conn := r.Context().Value(HttpConnContextKey).(net.Conn)
 
 	ctx := share.WithValue(r.Context(), RemoteConnContextKey, conn)
+	ctx = share.WithLocalValue(ctx, PeerContextKey, NewPeer(conn))
 
 	if req.ID != nil {
 		res := s.handleJSONRPCRequest(ctx, req, r.Header)
@@ -124,6 +125,13 @@ func (s *Server) handleJSONRPCRequest(ctx context.Context, r *jsonrpcRequest, he
 			Code:    CodeInternalJSONRPCError,
 			Message: err.Error(),
 		}
+		if iae, ok := err.(*InvalidArgumentError); ok {
+			res.Error.Code = CodeInvalidParams
+			if data, e := json.Marshal(iae.Violations); e == nil {
+				raw := json.RawMessage(data)
+				res.Error.Data = &raw
+			}
+		}
 		s.Plugins.DoPostWriteResponse(ctx, req, req.Clone(), err)
 		return res
 	}
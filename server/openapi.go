@@ -0,0 +1,561 @@
+package server
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+)
+
+// OpenAPIPath is the path of the OpenAPI document on the http gateway.
+const OpenAPIPath = "/openapi.json"
+
+// OpenAPI is an OpenAPI 3 document.
+type OpenAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo is the info of an OpenAPI document.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// OpenAPIOperation is an operation of a path.
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+// OpenAPIParameter is a path, query or header parameter.
+type OpenAPIParameter struct {
+	Name     string      `json:"name"`
+	In       string      `json:"in"`
+	Required bool        `json:"required,omitempty"`
+	Schema   *JSONSchema `json:"schema"`
+}
+
+// OpenAPIRequestBody is a request body.
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse is a response.
+type OpenAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIMediaType is the schema of a media type.
+type OpenAPIMediaType struct {
+	Schema *JSONSchema `json:"schema"`
+}
+
+// OpenAPIComponents contains schemas of named types.
+type OpenAPIComponents struct {
+	Schemas map[string]*JSONSchema `json:"schemas"`
+}
+
+// JSONSchema is a schema object of OpenAPI 3.
+type JSONSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	OneOf                []*JSONSchema          `json:"oneOf,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+const (
+	openAPIErrorSchema        = "rpcx.Error"
+	openAPIJSONRPCErrorSchema = "rpcx.JSONRPCError"
+)
+
+var (
+	typeOfTime          = reflect.TypeOf(time.Time{})
+	typeOfRawMessage    = reflect.TypeOf(json.RawMessage{})
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// SchemaGenerator generates schemas of Go types from fields, json tags and validate tags.
+// Schemas of named structs are put into Schemas, and referenced by #/components/schemas/Name.
+type SchemaGenerator struct {
+	Schemas map[string]*JSONSchema
+	names   map[reflect.Type]string
+}
+
+// NewSchemaGenerator creates a SchemaGenerator.
+func NewSchemaGenerator() *SchemaGenerator {
+	return &SchemaGenerator{
+		Schemas: make(map[string]*JSONSchema),
+		names:   make(map[reflect.Type]string),
+	}
+}
+
+func fieldViolationSchema() *JSONSchema {
+	return &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"field":   {Type: "string"},
+			"rule":    {Type: "string"},
+			"message": {Type: "string"},
+		},
+	}
+}
+
+func schemaRef(name string) *JSONSchema {
+	return &JSONSchema{Ref: "#/components/schemas/" + name}
+}
+
+// nameOf returns the unique name of a named type in components.
+func (g *SchemaGenerator) nameOf(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	sanitize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '_' || r == '.' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+				return r
+			}
+			return '_'
+		}, s)
+	}
+	name := sanitize(t.Name())
+	if _, taken := g.Schemas[name]; taken {
+		name = sanitize(path.Base(t.PkgPath())) + "." + name
+	}
+	for i, base := 2, name; ; i++ {
+		if _, taken := g.Schemas[name]; !taken {
+			break
+		}
+		name = base + strconv.Itoa(i)
+	}
+	g.names[t] = name
+	return name
+}
+
+// Schema returns the schema of t.
+func (g *SchemaGenerator) Schema(t reflect.Type) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == typeOfTime:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case t == typeOfRawMessage:
+		return &JSONSchema{}
+	case t.Implements(typeOfTextMarshaler) || reflect.PtrTo(t).Implements(typeOfTextMarshaler):
+		return &JSONSchema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return &JSONSchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64:
+		return &JSONSchema{Type: "integer", Format: "int64"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		min := 0.0
+		return &JSONSchema{Type: "integer", Format: "int32", Minimum: &min}
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		min := 0.0
+		return &JSONSchema{Type: "integer", Format: "int64", Minimum: &min}
+	case reflect.Float32:
+		return &JSONSchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &JSONSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &JSONSchema{Type: "string", Format: "byte"}
+		}
+		return &JSONSchema{Type: "array", Items: g.Schema(t.Elem())}
+	case reflect.Array:
+		n := t.Len()
+		return &JSONSchema{Type: "array", Items: g.Schema(t.Elem()), MinItems: &n, MaxItems: &n}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: g.Schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.nameOf(t)
+			g.Schemas[name] = &JSONSchema{} // placeholder for recursive types
+			g.Schemas[name] = g.structSchema(t)
+		}
+		return schemaRef(name)
+	}
+	// interfaces and others can be any values
+	return &JSONSchema{}
+}
+
+func (g *SchemaGenerator) structSchema(t reflect.Type) *JSONSchema {
+	s := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema)}
+	g.addFields(s, t)
+	return s
+}
+
+// addFields adds fields of t to s by the rules of encoding/json. Fields of embedded structs are promoted.
+func (g *SchemaGenerator) addFields(s *JSONSchema, t reflect.Type) {
+	rules := make(map[int][]fieldRule)
+	for _, fr := range rulesOf(t) {
+		rules[fr.index] = fr.rules
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" && len(tag) == 1 {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(s, ft)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fs := g.Schema(f.Type)
+		for _, opt := range tag[1:] {
+			if opt == "string" && fs.Type != "" && fs.Type != "object" && fs.Type != "array" {
+				fs = &JSONSchema{Type: "string"}
+			}
+		}
+		if applyRules(fs, f.Type, rules[i]) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = fs
+	}
+}
+
+// applyRules applies validate rules to the schema of t, and returns whether the field is required.
+func applyRules(s *JSONSchema, t reflect.Type, rules []fieldRule) (required bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for _, rule := range rules {
+		if rule.name == "required" {
+			required = true
+			continue
+		}
+		if s.Ref != "" {
+			continue
+		}
+		if rule.name == "oneof" {
+			for _, option := range strings.Fields(rule.param) {
+				if s.Type == "integer" || s.Type == "number" {
+					if n, err := strconv.ParseFloat(option, 64); err == nil {
+						s.Enum = append(s.Enum, n)
+					}
+				} else {
+					s.Enum = append(s.Enum, option)
+				}
+			}
+			continue
+		}
+
+		n, err := strconv.ParseFloat(rule.param, 64)
+		if err != nil {
+			continue
+		}
+		count := int(n)
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			switch rule.name {
+			case "min":
+				s.Minimum = &n
+			case "max":
+				s.Maximum = &n
+			case "len":
+				s.Minimum, s.Maximum = &n, &n
+			}
+		case reflect.String:
+			switch rule.name {
+			case "min":
+				s.MinLength = &count
+			case "max":
+				s.MaxLength = &count
+			case "len":
+				s.MinLength, s.MaxLength = &count, &count
+			}
+		case reflect.Slice, reflect.Array:
+			switch rule.name {
+			case "min":
+				s.MinItems = &count
+			case "max":
+				s.MaxItems = &count
+			case "len":
+				s.MinItems, s.MaxItems = &count, &count
+			}
+		}
+	}
+	return required
+}
+
+// isParamType reports whether fields of t can be bound from query parameters by paramJSON.
+func isParamType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(typeOfTextUnmarshaler) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return false
+	case reflect.Slice, reflect.Array:
+		return t.Elem().Kind() == reflect.Uint8 || isParamType(t.Elem())
+	}
+	return true
+}
+
+func jsonContent(schema *JSONSchema) map[string]*OpenAPIMediaType {
+	return map[string]*OpenAPIMediaType{"application/json": {Schema: schema}}
+}
+
+// routeOperation returns the operation of a RESTful route.
+// Args of GET, HEAD and DELETE routes are bound from parameters, and others from the JSON body.
+func (g *SchemaGenerator) routeOperation(rt *route, argType, replyType reflect.Type) *OpenAPIOperation {
+	op := &OpenAPIOperation{
+		Summary: rt.servicePath + "." + rt.serviceMethod,
+		Tags:    []string{rt.servicePath},
+		Responses: map[string]*OpenAPIResponse{
+			"200":     {Description: "OK", Content: jsonContent(g.Schema(replyType))},
+			"default": {Description: "error", Content: jsonContent(schemaRef(openAPIErrorSchema))},
+		},
+	}
+
+	t := argType
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	fields := make(map[string]reflect.StructField)
+	if t.Kind() == reflect.Struct {
+		for _, fr := range rulesOf(t) {
+			fields[fr.name] = t.Field(fr.index)
+		}
+	}
+
+	inPath := make(map[string]bool)
+	for _, seg := range rt.segments {
+		if !isRouteParam(seg) {
+			continue
+		}
+		name := seg[1 : len(seg)-1]
+		inPath[name] = true
+		schema := &JSONSchema{Type: "string"}
+		for fname, f := range fields {
+			if strings.EqualFold(fname, name) {
+				schema = g.Schema(f.Type)
+			}
+		}
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: name, In: "path", Required: true, Schema: schema})
+	}
+
+	switch rt.method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if inPath[name] {
+				continue
+			}
+			if ft := fields[name].Type; isParamType(ft) {
+				op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: name, In: "query", Schema: g.Schema(ft)})
+			}
+		}
+	default:
+		op.RequestBody = &OpenAPIRequestBody{Content: jsonContent(g.Schema(argType))}
+	}
+	return op
+}
+
+// jsonrpcOperation returns the operation of a method on the JSON-RPC endpoint.
+func (g *SchemaGenerator) jsonrpcOperation(servicePath, serviceMethod string, argType, replyType reflect.Type) *OpenAPIOperation {
+	method := servicePath + "." + serviceMethod
+	id := &JSONSchema{OneOf: []*JSONSchema{{Type: "integer"}, {Type: "string"}}}
+	return &OpenAPIOperation{
+		OperationID: "jsonrpc." + method,
+		Summary:     method + " by JSON-RPC 2.0",
+		Tags:        []string{servicePath},
+		Parameters: []*OpenAPIParameter{
+			{Name: "X-JSONRPC-2.0", In: "header", Required: true, Schema: &JSONSchema{Type: "string", Enum: []interface{}{"true"}}},
+		},
+		RequestBody: &OpenAPIRequestBody{Required: true, Content: jsonContent(&JSONSchema{
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"jsonrpc": {Type: "string", Enum: []interface{}{"2.0"}},
+				"method":  {Type: "string", Enum: []interface{}{method}},
+				"params":  g.Schema(argType),
+				"id":      id,
+			},
+			Required: []string{"jsonrpc", "method", "params"},
+		})},
+		Responses: map[string]*OpenAPIResponse{
+			"200": {Description: "OK", Content: jsonContent(&JSONSchema{
+				Type: "object",
+				Properties: map[string]*JSONSchema{
+					"jsonrpc": {Type: "string"},
+					"id":      id,
+					"result":  g.Schema(replyType),
+					"error":   schemaRef(openAPIJSONRPCErrorSchema),
+				},
+			})},
+		},
+	}
+}
+
+// OpenAPI generates an OpenAPI 3 document of registered services.
+// It contains RESTful routes of the http gateway added by HandleRoute,
+// and all methods and functions on the JSON-RPC endpoint at /jsonrpc/Service.Method unless DisableJSONRPC is set.
+// Schemas are generated from fields, json tags and validate tags of args and replies.
+func (s *Server) OpenAPI(info OpenAPIInfo) *OpenAPI {
+	if info.Title == "" {
+		info.Title = "rpcx"
+	}
+	if info.Version == "" {
+		info.Version = "1.0.0"
+	}
+	doc := &OpenAPI{
+		OpenAPI: "3.0.3",
+		Info:    info,
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+	}
+	g := NewSchemaGenerator()
+	g.Schemas[openAPIErrorSchema] = &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"code":       {Type: "integer"},
+			"message":    {Type: "string"},
+			"violations": {Type: "array", Items: fieldViolationSchema()},
+		},
+		Required: []string{"code", "message"},
+	}
+	g.Schemas[openAPIJSONRPCErrorSchema] = &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"code":    {Type: "integer"},
+			"message": {Type: "string"},
+			"data":    {},
+		},
+		Required: []string{"code", "message"},
+	}
+	addOperation := func(p, method string, op *OpenAPIOperation) {
+		if doc.Paths[p] == nil {
+			doc.Paths[p] = make(map[string]*OpenAPIOperation)
+		}
+		doc.Paths[p][strings.ToLower(method)] = op
+	}
+
+	type methodTypes struct{ arg, reply reflect.Type }
+	methods := make(map[string]methodTypes)
+	s.serviceMapMu.RLock()
+	for name, svc := range s.serviceMap {
+		for mname, mtype := range svc.method {
+			methods[name+"."+mname] = methodTypes{mtype.ArgType, mtype.ReplyType}
+		}
+		for fname, ftype := range svc.function {
+			methods[name+"."+fname] = methodTypes{ftype.ArgType, ftype.ReplyType}
+		}
+	}
+	s.serviceMapMu.RUnlock()
+
+	s.mu.RLock()
+	routes := s.routes
+	s.mu.RUnlock()
+	ids := make(map[string]bool)
+	for _, rt := range routes {
+		mt, ok := methods[rt.servicePath+"."+rt.serviceMethod]
+		if !ok {
+			continue
+		}
+		op := g.routeOperation(rt, mt.arg, mt.reply)
+		op.OperationID = op.Summary
+		if ids[op.OperationID] {
+			op.OperationID = op.Summary + "_" + strings.ToLower(rt.method)
+		}
+		for i := 2; ids[op.OperationID]; i++ {
+			op.OperationID = op.Summary + "_" + strings.ToLower(rt.method) + strconv.Itoa(i)
+		}
+		ids[op.OperationID] = true
+		addOperation("/"+strings.Join(rt.segments, "/"), rt.method, op)
+	}
+
+	if !s.DisableJSONRPC {
+		names := make([]string, 0, len(methods))
+		for name := range methods {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lastDot := strings.LastIndex(name, ".")
+			mt := methods[name]
+			addOperation("/jsonrpc/"+name, http.MethodPost, g.jsonrpcOperation(name[:lastDot], name[lastDot+1:], mt.arg, mt.reply))
+		}
+	}
+
+	doc.Components.Schemas = g.Schemas
+	return doc
+}
+
+// OpenAPIHandler returns a http.Handler that serves the OpenAPI document of registered services as JSON.
+// The http gateway serves it at OpenAPIPath if the server is created with WithOpenAPI.
+func (s *Server) OpenAPIHandler(info OpenAPIInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(s.OpenAPI(info), "", "  ")
+		if err != nil {
+			log.Warnf("failed to generate openapi document: %v", err)
+			http.Error(w, fmt.Sprintf("failed to generate openapi document: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
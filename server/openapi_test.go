@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type OpenAPIArgs struct {
+	ID       int64             `json:"id" validate:"required"`
+	Name     string            `json:"name,omitempty" validate:"max=8"`
+	Kind     string            `json:"kind" validate:"oneof=a b"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Created  time.Time         `json:"created"`
+	Parent   *OpenAPIArgs      `json:"parent"`
+	Internal string            `json:"-"`
+	OpenAPIEmbedded
+}
+
+type OpenAPIEmbedded struct {
+	Page int `json:"page" validate:"min=1"`
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("UserService", new(UserService), "")
+	s.RegisterName("Validated", new(ValidatedService), "")
+	s.HandleRoute("GET", "/v1/users/{id}", "UserService.Get")
+	s.HandleRoute("PUT", "/v1/users/{id}", "UserService.Get")
+	s.HandleRoute("GET", "/v1/missing", "Missing.Get")
+
+	doc := s.OpenAPI(OpenAPIInfo{Title: "users"})
+	if doc.OpenAPI != "3.0.3" || doc.Info.Title != "users" || doc.Info.Version == "" {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if _, ok := doc.Paths["/v1/missing"]; ok {
+		t.Error("expect routes of missing methods are skipped")
+	}
+
+	get := doc.Paths["/v1/users/{id}"]["get"]
+	if get == nil || get.OperationID != "UserService.Get" || get.RequestBody != nil {
+		t.Fatalf("unexpected GET operation %+v", get)
+	}
+	params := make(map[string]*OpenAPIParameter)
+	for _, p := range get.Parameters {
+		params[p.Name] = p
+	}
+	if p := params["id"]; p == nil || p.In != "path" || !p.Required || p.Schema.Type != "integer" {
+		t.Errorf("unexpected path parameter %+v", p)
+	}
+	if p := params["fields"]; p == nil || p.In != "query" || p.Schema.Type != "array" {
+		t.Errorf("unexpected query parameter %+v", p)
+	}
+	if get.Responses["200"].Content["application/json"].Schema.Ref != "#/components/schemas/User" {
+		t.Errorf("unexpected response %+v", get.Responses["200"])
+	}
+
+	put := doc.Paths["/v1/users/{id}"]["put"]
+	if put == nil || put.OperationID != "UserService.Get_put" || put.RequestBody == nil {
+		t.Fatalf("unexpected PUT operation %+v", put)
+	}
+
+	rpc := doc.Paths["/jsonrpc/Validated.Echo"]["post"]
+	if rpc == nil || rpc.OperationID != "jsonrpc.Validated.Echo" {
+		t.Fatalf("unexpected JSON-RPC operation %+v", rpc)
+	}
+	body := rpc.RequestBody.Content["application/json"].Schema
+	if body.Properties["params"].Ref != "#/components/schemas/ValidatedArgs" {
+		t.Errorf("unexpected params %+v", body.Properties["params"])
+	}
+
+	va := doc.Components.Schemas["ValidatedArgs"]
+	if va == nil || len(va.Required) != 1 || va.Required[0] != "user" {
+		t.Fatalf("unexpected schema %+v", va)
+	}
+	if code := va.Properties["code"]; *code.MinLength != 4 || *code.MaxLength != 4 {
+		t.Errorf("unexpected schema of code %+v", code)
+	}
+	if items := va.Properties["items"]; items.Items.Ref != "#/components/schemas/ValidatedItem" || *items.MaxItems != 3 {
+		t.Errorf("unexpected schema of items %+v", items)
+	}
+
+	// types of fields, tags and embedded structs
+	g := NewSchemaGenerator()
+	g.Schema(reflect.TypeOf(&OpenAPIArgs{}))
+	oa := g.Schemas["OpenAPIArgs"]
+	if oa == nil {
+		t.Fatal("expect the schema of OpenAPIArgs")
+	}
+	for name, typ := range map[string]string{"id": "integer", "name": "string", "tags": "array", "labels": "object", "created": "string", "page": "integer"} {
+		if p := oa.Properties[name]; p == nil || p.Type != typ {
+			t.Errorf("expect %s of %s but got %+v", typ, name, p)
+		}
+	}
+	if oa.Properties["parent"].Ref != "#/components/schemas/OpenAPIArgs" {
+		t.Errorf("expect a recursive reference but got %+v", oa.Properties["parent"])
+	}
+	if _, ok := oa.Properties["Internal"]; ok {
+		t.Error("expect fields with json tag - are skipped")
+	}
+	if kind := oa.Properties["kind"]; len(kind.Enum) != 2 {
+		t.Errorf("unexpected enum %+v", kind.Enum)
+	}
+	if page := oa.Properties["page"]; page.Minimum == nil || *page.Minimum != 1 {
+		t.Errorf("unexpected minimum of page %+v", page)
+	}
+
+	// served as JSON
+	w := httptest.NewRecorder()
+	s.OpenAPIHandler(OpenAPIInfo{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	var served map[string]interface{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &served) != nil || served["openapi"] != "3.0.3" {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+
+	s.DisableJSONRPC = true
+	if _, ok := s.OpenAPI(OpenAPIInfo{}).Paths["/jsonrpc/Validated.Echo"]; ok {
+		t.Error("expect no JSON-RPC operations if JSON-RPC is disabled")
+	}
+}
+
+func TestOpenAPI_Gateway(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		var opts []OptionFn
+		if enabled {
+			opts = append(opts, WithOpenAPI(OpenAPIInfo{Title: "arith"}))
+		}
+		s := NewServer(opts...)
+		s.RegisterName("Validated", new(ValidatedService), "")
+		go s.Serve("tcp", "127.0.0.1:0")
+		time.Sleep(200 * time.Millisecond)
+
+		res, err := http.Get("http://" + s.Address().String() + OpenAPIPath)
+		if err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+		var doc map[string]interface{}
+		served := json.NewDecoder(res.Body).Decode(&doc) == nil && doc["openapi"] == "3.0.3"
+		res.Body.Close()
+		s.Close()
+		if served != enabled {
+			t.Errorf("expect the document is served %v but got %v", enabled, served)
+		}
+	}
+}
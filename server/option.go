@@ -37,3 +37,11 @@ func WithWriteTimeout(writeTimeout time.Duration) OptionFn {
 		s.writeTimeout = writeTimeout
 	}
 }
+
+// WithOpenAPI serves the OpenAPI document of registered services at OpenAPIPath of the http gateway.
+// The document is not protected by the auth function and plugins of the server.
+func WithOpenAPI(info OpenAPIInfo) OptionFn {
+	return func(s *Server) {
+		s.openAPIInfo = &info
+	}
+}
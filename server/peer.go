@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Peer contains information of the client of a request.
+// It is in the context of handlers, and can be got by PeerFromContext.
+type Peer struct {
+	// Addr is the remote address of the client.
+	Addr net.Addr
+	// TLS is the state of the TLS connection, or nil if the connection is not TLS.
+	TLS *tls.ConnectionState
+	// Certificate is the verified certificate of the client, or nil if the client has no certificate.
+	Certificate *x509.Certificate
+	// SPIFFEID is the SPIFFE ID in URI SANs of the certificate, for example spiffe://example.org/ns/default/sa/arith.
+	SPIFFEID string
+	// CommonName is the CN of the certificate subject.
+	CommonName string
+}
+
+// Identity returns the SPIFFE ID of the client, or its CN if there is no SPIFFE ID.
+func (p *Peer) Identity() string {
+	if p.SPIFFEID != "" {
+		return p.SPIFFEID
+	}
+	return p.CommonName
+}
+
+// NewPeer returns the Peer of conn. The TLS handshake of conn must have been completed.
+func NewPeer(conn net.Conn) *Peer {
+	p := &Peer{Addr: conn.RemoteAddr()}
+
+	// connections are wrapped when the gateway is started
+	if mc, ok := conn.(*cmux.MuxConn); ok {
+		conn = mc.Conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		p.setTLS(tlsConn.ConnectionState())
+	}
+	return p
+}
+
+// newHTTPPeer returns the Peer of a request of the http gateway or JSON-RPC.
+func newHTTPPeer(r *http.Request) *Peer {
+	if conn, ok := r.Context().Value(HttpConnContextKey).(net.Conn); ok {
+		return NewPeer(conn)
+	}
+
+	p := &Peer{}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+	if r.TLS != nil {
+		p.setTLS(*r.TLS)
+	}
+	return p
+}
+
+// newGRPCPeer returns the Peer of a gRPC call.
+func newGRPCPeer(ctx context.Context) *Peer {
+	gp, ok := peer.FromContext(ctx)
+	if !ok {
+		return &Peer{}
+	}
+	p := &Peer{Addr: gp.Addr}
+	if info, ok := gp.AuthInfo.(credentials.TLSInfo); ok {
+		p.setTLS(info.State)
+	}
+	return p
+}
+
+func (p *Peer) setTLS(state tls.ConnectionState) {
+	p.TLS = &state
+
+	// only verified certificates are trusted as identities
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := state.VerifiedChains[0][0]
+	p.Certificate = cert
+	p.CommonName = cert.Subject.CommonName
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			p.SPIFFEID = uri.String()
+			break
+		}
+	}
+}
+
+// PeerFromContext returns the Peer in the context of handlers.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(PeerContextKey).(*Peer)
+	return p, ok
+}
@@ -7,8 +7,8 @@ import (
 	"testing"
 	"time"
 
-	"github.com/caser789/rpcy/client"
-	"github.com/caser789/rpcy/protocol"
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/protocol"
 )
 
 type HeartbeatHandler struct{}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+// StatusError is an error with an HTTP status code.
+// The http gateway responds with the status code of errors which have a HTTPStatus() int method.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// HTTPStatus returns the HTTP status code.
+func (e *StatusError) HTTPStatus() int {
+	return e.Code
+}
+
+// HTTPStatus returns the HTTP status code of errors of services for the http gateway and RESTful routes.
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	var se interface{ HTTPStatus() int }
+	if errors.As(err, &se) {
+		return se.HTTPStatus()
+	}
+	var iae *InvalidArgumentError
+	if errors.As(err, &iae) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// route maps an HTTP method and path to a service method.
+type route struct {
+	method        string
+	pattern       string
+	segments      []string // literals, or {name} for path parameters
+	servicePath   string
+	serviceMethod string
+}
+
+func isRouteParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// match returns the path parameters if path matches the route.
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range rt.segments {
+		if !isRouteParam(seg) {
+			if seg != segments[i] {
+				return nil, false
+			}
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		v, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return nil, false
+		}
+		params[seg[1:len(seg)-1]] = v
+	}
+	return params, true
+}
+
+// moreSpecific reports whether a should be matched before b: literal segments are matched before parameters.
+// Routes only match paths with the same number of segments, so shorter routes are ordered first
+// to keep the order transitive.
+func (rt *route) moreSpecific(b *route) bool {
+	if len(rt.segments) != len(b.segments) {
+		return len(rt.segments) < len(b.segments)
+	}
+	for i := 0; i < len(rt.segments); i++ {
+		pa, pb := isRouteParam(rt.segments[i]), isRouteParam(b.segments[i])
+		if pa != pb {
+			return pb
+		}
+	}
+	return false
+}
+
+// HandleRoute maps a RESTful route of the http gateway to a service method, for example
+//
+//	s.HandleRoute("GET", "/v1/users/{id}", "UserService.Get")
+//
+// Args are bound from the JSON body, query parameters and path parameters, matched to fields by their json names.
+// Query parameters override the body, and path parameters override both.
+// Replies are written as JSON, and errors are written as JSON with status codes of HTTPStatus.
+// Routes are matched before the X-RPCX header based gateway requests.
+// It must be called before the server starts.
+func (s *Server) HandleRoute(method, pattern, serviceMethod string) error {
+	method = strings.ToUpper(method)
+	if method == "" {
+		return errors.New("rpcx: empty method of route")
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("rpcx: route %s must start with /", pattern)
+	}
+	lastDot := strings.LastIndex(serviceMethod, ".")
+	if lastDot <= 0 || lastDot == len(serviceMethod)-1 {
+		return fmt.Errorf("rpcx: service method of route %s must be Service.Method but got %s", pattern, serviceMethod)
+	}
+
+	rt := &route{
+		method:        method,
+		pattern:       pattern,
+		segments:      splitPath(pattern),
+		servicePath:   serviceMethod[:lastDot],
+		serviceMethod: serviceMethod[lastDot+1:],
+	}
+	names := make(map[string]bool)
+	for _, seg := range rt.segments {
+		if !isRouteParam(seg) {
+			continue
+		}
+		name := seg[1 : len(seg)-1]
+		if name == "" || names[name] {
+			return fmt.Errorf("rpcx: invalid or duplicated parameter %s of route %s", seg, pattern)
+		}
+		names[name] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.routes {
+		if r.method == method && strings.Join(r.segments, "/") == strings.Join(rt.segments, "/") {
+			return fmt.Errorf("rpcx: route %s %s already exists", method, pattern)
+		}
+	}
+	s.routes = append(s.routes, rt)
+	sort.SliceStable(s.routes, func(i, j int) bool { return s.routes[i].moreSpecific(s.routes[j]) })
+	return nil
+}
+
+// routeHandler serves RESTful routes, and passes other requests to next.
+func (s *Server) routeHandler(routes []*route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := splitPath(r.URL.EscapedPath())
+		var allowed []string
+		for _, rt := range routes {
+			params, ok := rt.match(segments)
+			if !ok {
+				continue
+			}
+			if rt.method == r.Method {
+				s.handleRouteRequest(w, r, rt, params)
+				return
+			}
+			allowed = append(allowed, rt.method)
+		}
+
+		if len(allowed) > 0 && r.Header.Get(XServiceMethod) == "" {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeRouteError(w, &StatusError{Code: http.StatusMethodNotAllowed, Message: "rpcx: method not allowed"}, nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type routeError struct {
+	Code       int              `json:"code"`
+	Message    string           `json:"message"`
+	Violations []FieldViolation `json:"violations,omitempty"`
+}
+
+// setRetryAfter sets the Retry-After header in seconds by share.RetryAfterKey in milliseconds of metadata.
+func setRetryAfter(h http.Header, meta map[string]string) {
+	if retryAfter, ok := meta[share.RetryAfterKey]; ok {
+		if ms, e := strconv.ParseInt(retryAfter, 10, 64); e == nil {
+			h.Set("Retry-After", strconv.FormatInt((ms+999)/1000, 10))
+		}
+	}
+}
+
+func writeRouteError(w http.ResponseWriter, err error, meta map[string]string) {
+	re := routeError{Code: HTTPStatus(err), Message: err.Error()}
+	var iae *InvalidArgumentError
+	if errors.As(err, &iae) {
+		re.Violations = iae.Violations
+	}
+	setRetryAfter(w.Header(), meta)
+
+	data, _ := json.Marshal(re)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(re.Code)
+	w.Write(data)
+}
+
+func (s *Server) argTypeOf(servicePath, serviceMethod string) reflect.Type {
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+	service := s.serviceMap[servicePath]
+	if service == nil {
+		return nil
+	}
+	if mtype := service.method[serviceMethod]; mtype != nil {
+		return mtype.ArgType
+	}
+	if ftype := service.function[serviceMethod]; ftype != nil {
+		return ftype.ArgType
+	}
+	return nil
+}
+
+func (s *Server) handleRouteRequest(w http.ResponseWriter, r *http.Request, rt *route, params map[string]string) {
+	ctx := share.WithValue(r.Context(), RemoteConnContextKey, r.RemoteAddr)
+	ctx = share.WithLocalValue(ctx, PeerContextKey, newHTTPPeer(r))
+	err := s.Plugins.DoPreReadRequest(ctx)
+	if err != nil {
+		writeRouteError(w, err, nil)
+		return
+	}
+
+	argType := s.argTypeOf(rt.servicePath, rt.serviceMethod)
+	if argType == nil {
+		writeRouteError(w, &StatusError{Code: http.StatusNotFound, Message: "rpcx: can't find method " + rt.servicePath + "." + rt.serviceMethod}, nil)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeRouteError(w, &StatusError{Code: http.StatusBadRequest, Message: err.Error()}, nil)
+		return
+	}
+	payload, err := bindRouteArgs(argType, body, r.URL.Query(), params)
+	if err != nil {
+		writeRouteError(w, err, nil)
+		return
+	}
+
+	req := protocol.NewMessage()
+	defer protocol.FreeMsg(req)
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.JSON)
+	req.ServicePath = rt.servicePath
+	req.ServiceMethod = rt.serviceMethod
+	req.Payload = payload
+	req.Metadata = make(map[string]string)
+	if meta := r.Header.Get(XMeta); meta != "" {
+		metadata, _ := url.ParseQuery(meta)
+		for k, v := range metadata {
+			if len(v) > 0 {
+				req.Metadata[k] = v[0]
+			}
+		}
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Metadata[share.AuthKey] = auth
+	}
+
+	err = s.Plugins.DoPostReadRequest(ctx, req, nil)
+	if err != nil {
+		writeRouteError(w, err, nil)
+		return
+	}
+
+	ctx.SetValue(StartRequestContextKey, time.Now().UnixNano())
+	err = s.auth(ctx, req)
+	if err != nil {
+		s.Plugins.DoPreWriteResponse(ctx, req, nil, err)
+		writeRouteError(w, &StatusError{Code: http.StatusUnauthorized, Message: err.Error()}, nil)
+		s.Plugins.DoPostWriteResponse(ctx, req, req.Clone(), err)
+		return
+	}
+
+	resMetadata := make(map[string]string)
+	newCtx := share.WithLocalValue(share.WithLocalValue(ctx, share.ReqMetaDataKey, req.Metadata),
+		share.ResMetaDataKey, resMetadata)
+
+	res, err := s.handleRequest(newCtx, req)
+	defer protocol.FreeMsg(res)
+
+	if res.Metadata == nil {
+		res.Metadata = resMetadata
+	} else {
+		for k, v := range resMetadata {
+			res.Metadata[k] = v
+		}
+	}
+
+	wh := w.Header()
+	meta := url.Values{}
+	for k, v := range res.Metadata {
+		if k != protocol.ServiceError && k != share.InvalidArgumentKey {
+			meta.Add(k, v)
+		}
+	}
+	if len(meta) > 0 {
+		wh.Set(XMeta, meta.Encode())
+	}
+
+	if err != nil {
+		if s.HandleServiceError != nil {
+			s.HandleServiceError(err)
+		} else {
+			log.Warnf("rpcx: route %s %s: %v", rt.method, rt.pattern, err)
+		}
+		s.Plugins.DoPreWriteResponse(newCtx, req, res, err)
+		writeRouteError(w, err, res.Metadata)
+		s.Plugins.DoPostWriteResponse(newCtx, req, res, err)
+		return
+	}
+
+	s.Plugins.DoPreWriteResponse(newCtx, req, nil, nil)
+	wh.Set("Content-Type", "application/json")
+	w.Write(res.Payload)
+	s.Plugins.DoPostWriteResponse(newCtx, req, res, err)
+}
+
+// bindRouteArgs merges the JSON body, query parameters and path parameters into the JSON payload of args.
+func bindRouteArgs(argType reflect.Type, body []byte, query url.Values, params map[string]string) ([]byte, error) {
+	body = bytes.TrimSpace(body)
+	t := argType
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		if len(body) == 0 {
+			return []byte("null"), nil
+		}
+		return body, nil
+	}
+
+	obj := make(map[string]json.RawMessage)
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return nil, &InvalidArgumentError{Violations: []FieldViolation{{Rule: "json", Message: "invalid JSON body: " + err.Error()}}}
+		}
+	}
+
+	var violations []FieldViolation
+	set := func(key string, values []string) {
+		for _, fr := range rulesOf(t) {
+			if !strings.EqualFold(fr.name, key) {
+				continue
+			}
+			v, err := paramJSON(t.Field(fr.index).Type, values)
+			if err != nil {
+				violations = append(violations, FieldViolation{Field: fr.name, Rule: "type", Message: err.Error()})
+				return
+			}
+			for k := range obj {
+				if strings.EqualFold(k, fr.name) {
+					delete(obj, k)
+				}
+			}
+			obj[fr.name] = v
+			return
+		}
+	}
+	for k, v := range query {
+		set(k, v)
+	}
+	for k, v := range params {
+		set(k, []string{v})
+	}
+	if len(violations) > 0 {
+		sort.Slice(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+		return nil, &InvalidArgumentError{Violations: violations}
+	}
+
+	return json.Marshal(obj)
+}
+
+var typeOfTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// paramJSON converts values of parameters to JSON of type t.
+func paramJSON(t reflect.Type, values []string) (json.RawMessage, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(typeOfTextUnmarshaler) {
+		return json.Marshal(values[0])
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return json.Marshal(values[0])
+	case reflect.Bool:
+		b, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		return json.Marshal(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(values[0], 10, t.Bits())
+		if err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		return json.Marshal(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(values[0], 10, t.Bits())
+		if err != nil {
+			return nil, errors.New("must be a non-negative integer")
+		}
+		return json.Marshal(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(values[0], t.Bits())
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return json.Marshal(f)
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return json.Marshal([]byte(values[0]))
+		}
+		items := make([]json.RawMessage, len(values))
+		for i, v := range values {
+			item, err := paramJSON(t.Elem(), []string{v})
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return json.Marshal(items)
+	case reflect.Interface:
+		return json.Marshal(values[0])
+	}
+	return nil, errors.New("can not be bound from parameters")
+}
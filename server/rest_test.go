@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caser789/rpcj/share"
+)
+
+type GetUserArgs struct {
+	ID      int64    `json:"id"`
+	Fields  []string `json:"fields"`
+	Verbose bool     `json:"verbose"`
+	Name    string   `json:"name" validate:"max=8"`
+}
+
+// Reset resets args put back to argsReplyPools if UsePool is true.
+func (a *GetUserArgs) Reset() {
+	*a = GetUserArgs{}
+}
+
+type User struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Fields  []string `json:"fields"`
+	Verbose bool     `json:"verbose"`
+}
+
+type UserService int
+
+func (s *UserService) Get(ctx context.Context, args *GetUserArgs, reply *User) error {
+	if args.ID == 404 {
+		return &StatusError{Code: http.StatusNotFound, Message: "user not found"}
+	}
+	*reply = User{ID: args.ID, Name: args.Name, Fields: args.Fields, Verbose: args.Verbose}
+	return nil
+}
+
+func (s *UserService) Me(ctx context.Context, args *GetUserArgs, reply *User) error {
+	reply.Name = "me"
+	return nil
+}
+
+func (s *UserService) Limited(ctx context.Context, args *GetUserArgs, reply *User) error {
+	ctx.Value(share.ResMetaDataKey).(map[string]string)[share.RetryAfterKey] = "1500"
+	return &StatusError{Code: http.StatusTooManyRequests, Message: "rate limited"}
+}
+
+func TestHandleRoute(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("UserService", new(UserService), "")
+	for _, r := range [][3]string{
+		{"GET", "/v1/users/{id}", "UserService.Get"},
+		{"PUT", "/v1/users/{id}", "UserService.Get"},
+		{"GET", "/v1/users/me", "UserService.Me"},
+		{"GET", "/v1/limited", "UserService.Limited"},
+		{"GET", "/v1/missing", "Missing.Get"},
+	} {
+		if err := s.HandleRoute(r[0], r[1], r[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.HandleRoute("GET", "/v1/users/{id}", "UserService.Me"); err == nil {
+		t.Fatal("expect an error of the duplicated route")
+	}
+	if err := s.HandleRoute("GET", "/v1/{id}/{id}", "UserService.Get"); err == nil {
+		t.Fatal("expect an error of the duplicated parameter")
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	handler := s.routeHandler(s.routes, next)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// path and query parameters
+	w := do("GET", "/v1/users/42?fields=a&fields=b&verbose=true", "")
+	var user User
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &user) != nil {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	if user.ID != 42 || !user.Verbose || len(user.Fields) != 2 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected user %+v", user)
+	}
+
+	// path parameters override the body
+	w = do("PUT", "/v1/users/7", `{"id":1,"name":"bob"}`)
+	user = User{}
+	json.Unmarshal(w.Body.Bytes(), &user)
+	if user.ID != 7 || user.Name != "bob" {
+		t.Fatalf("unexpected user %+v", user)
+	}
+
+	// literal segments are matched before parameters
+	w = do("GET", "/v1/users/me", "")
+	if !strings.Contains(w.Body.String(), `"name":"me"`) {
+		t.Fatalf("unexpected response %s", w.Body)
+	}
+
+	// errors
+	for _, c := range []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"GET", "/v1/users/abc", "", http.StatusBadRequest},
+		{"PUT", "/v1/users/1", `{"name":"too long name"}`, http.StatusBadRequest},
+		{"PUT", "/v1/users/1", `{`, http.StatusBadRequest},
+		{"GET", "/v1/users/404", "", http.StatusNotFound},
+		{"GET", "/v1/missing", "", http.StatusNotFound},
+		{"DELETE", "/v1/users/1", "", http.StatusMethodNotAllowed},
+		{"GET", "/v1/limited", "", http.StatusTooManyRequests},
+		{"GET", "/other", "", http.StatusTeapot},
+	} {
+		w := do(c.method, c.target, c.body)
+		if w.Code != c.code {
+			t.Errorf("expect %d of %s %s but got %d: %s", c.code, c.method, c.target, w.Code, w.Body)
+		}
+	}
+
+	w = do("GET", "/v1/users/abc", "")
+	var re routeError
+	if err := json.Unmarshal(w.Body.Bytes(), &re); err != nil || len(re.Violations) != 1 || re.Violations[0].Field != "id" {
+		t.Fatalf("unexpected error %s", w.Body)
+	}
+	if w := do("GET", "/v1/limited", ""); w.Header().Get("Retry-After") != "2" {
+		t.Errorf("expect Retry-After 2 but got %q", w.Header().Get("Retry-After"))
+	}
+	if w := do("DELETE", "/v1/users/1", ""); w.Header().Get("Allow") != "GET, PUT" {
+		t.Errorf("unexpected Allow %q", w.Header().Get("Allow"))
+	}
+}
+
+func TestHandleRoute_Order(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("UserService", new(UserService), "")
+	for _, r := range [][3]string{
+		{"GET", "/x/{id}", "UserService.Get"},
+		{"GET", "/x", "UserService.Get"},
+		{"GET", "/x/y", "UserService.Me"},
+	} {
+		if err := s.HandleRoute(r[0], r[1], r[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := s.routeHandler(s.routes, http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/x/y", nil))
+	if !strings.Contains(w.Body.String(), `"name":"me"`) {
+		t.Fatalf("expect the literal route is matched but got %d: %s", w.Code, w.Body)
+	}
+
+	// handlers of routes get the peer
+	var peer *Peer
+	s.RegisterFunctionName("Peer", "Get", func(ctx context.Context, args *GetUserArgs, reply *User) error {
+		peer, _ = PeerFromContext(ctx)
+		return nil
+	}, "")
+	if err := s.HandleRoute("GET", "/peer", "Peer.Get"); err != nil {
+		t.Fatal(err)
+	}
+	handler = s.routeHandler(s.routes, http.NotFoundHandler())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/peer", nil))
+	if peer == nil || peer.Addr == nil || peer.Addr.String() != "192.0.2.1:1234" {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	if HTTPStatus(errors.New("internal")) != http.StatusInternalServerError {
+		t.Error("expect 500 for unknown errors")
+	}
+	if HTTPStatus(&InvalidArgumentError{}) != http.StatusBadRequest {
+		t.Error("expect 400 for invalid arguments")
+	}
+	if HTTPStatus(&StatusError{Code: http.StatusForbidden}) != http.StatusForbidden {
+		t.Error("expect the status of StatusError")
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/caser789/rpcj/protocol"
 	"github.com/caser789/rpcj/share"
 	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
 )
 
 // ErrServerClosed is returned by the Server's Serve, ListenAndServe after a call to Shutdown or Close.
@@ -59,6 +60,8 @@ var (
 	TagContextKey = &contextKey{"service-tag"}
 	// HttpConnContextKey is used to store http connection.
 	HttpConnContextKey = &contextKey{"http-conn"}
+	// PeerContextKey is used to store the Peer of requests. Its value is a *Peer.
+	PeerContextKey = &contextKey{"peer"}
 )
 
 // Server is rpcx server that use TCP or UDP.
@@ -69,16 +72,21 @@ type Server struct {
 	gatewayHTTPServer  *http.Server
 	DisableHTTPGateway bool // should disable http invoke or not.
 	DisableJSONRPC     bool // should disable json rpc or not.
+	DisableGRPC        bool // should disable grpc or not.
+	DisableValidation  bool // should disable validation of args or not.
+	grpcServer         *grpc.Server
 
 	serviceMapMu sync.RWMutex
 	serviceMap   map[string]*service
 
 	mu         sync.RWMutex
 	activeConn map[net.Conn]struct{}
+	connStats  sync.Map // net.Conn -> *connStat
 	doneChan   chan struct{}
 	seq        uint64
 
 	inShutdown int32
+	inDrain    int32
 	onShutdown []func(s *Server)
 	onRestart  []func(s *Server)
 
@@ -90,6 +98,13 @@ type Server struct {
 	// CORS options
 	corsOptions *CORSOptions
 
+	// extra handlers mounted on the http gateway
+	gatewayHandlers map[string]http.Handler
+	// RESTful routes of the http gateway
+	routes []*route
+	// info of the OpenAPI document, or nil if it is not served
+	openAPIInfo *OpenAPIInfo
+
 	Plugins PluginContainer
 
 	// AuthFunc can be used to auth.
@@ -306,7 +321,7 @@ func (s *Server) serveListener(ln net.Listener) error {
 		s.mu.Lock()
 		s.activeConn[conn] = struct{}{}
 		s.mu.Unlock()
-		if share.Trace {
+		if share.TraceEnabled() {
 			log.Debug("server accepted an conn%c", conn.RemoteAddr().String())
 		}
 
@@ -362,22 +377,26 @@ func (s *Server) serveConn(conn net.Conn) {
 			buf = buf[:ss]
 			log.Errorf("serving %s panic error: %s, stack:\n %s", conn.RemoteAddr(), err, buf)
 		}
-		if share.Trace {
+		if share.TraceEnabled() {
 			log.Debug("server closed conn: %v", conn.RemoteAddr().String())
 		}
 		s.mu.Lock()
 		delete(s.activeConn, conn)
 		s.mu.Unlock()
+		s.connStats.Delete(conn)
 		conn.Close()
 
 		s.Plugins.DoPostConnClose(conn)
 	}()
 
-	if isShutdown(s) {
+	if isShutdown(s) || isDrain(s) {
 		closeChannel(s, conn)
 		return
 	}
 
+	stat := &connStat{createdAt: time.Now()}
+	s.connStats.Store(conn, stat)
+
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		if d := s.readTimeout; d != 0 {
 			conn.SetReadDeadline(time.Now().Add(d))
@@ -391,7 +410,8 @@ func (s *Server) serveConn(conn net.Conn) {
 		}
 	}
 
-	r := bufio.NewReaderSize(conn, ReaderBuffsize)
+	r := bufio.NewReaderSize(&countingReader{conn, &stat.readBytes}, ReaderBuffsize)
+	peer := NewPeer(conn)
 
 	for {
 		if isShutdown(s) {
@@ -403,11 +423,25 @@ func (s *Server) serveConn(conn net.Conn) {
 		if s.readTimeout != 0 {
 			conn.SetReadDeadline(t0.Add(s.readTimeout))
 		}
+		if stat.isDraining() {
+			// requests already buffered are handled, but no more is read from the connection
+			if r.Buffered() == 0 {
+				stat.waitIdle()
+				return
+			}
+			conn.SetReadDeadline(time.Now())
+		}
 
 		ctx := share.WithValue(context.Background(), RemoteConnContextKey, conn)
+		ctx = share.WithLocalValue(ctx, PeerContextKey, peer)
 
 		req, err := s.readRequest(ctx, r)
 		if err != nil {
+			if stat.isDraining() {
+				log.Infof("rpcx: connection %s is drained", conn.RemoteAddr().String())
+				stat.waitIdle()
+				return
+			}
 			if err == io.EOF {
 				log.Infof("client has closed this connection: %s", conn.RemoteAddr().String())
 			} else if strings.Contains(err.Error(), "use of closed network connection") {
@@ -422,7 +456,7 @@ func (s *Server) serveConn(conn net.Conn) {
 			conn.SetWriteDeadline(t0.Add(s.writeTimeout))
 		}
 
-		if share.Trace {
+		if share.TraceEnabled() {
 			log.Debug("server received an request %s from conn: %v", req, conn.RemoteAddr().String())
 		}
 		ctx = share.WithLocalValue(ctx, StartRequestContextKey, time.Now().UnixNano())
@@ -442,7 +476,8 @@ func (s *Server) serveConn(conn net.Conn) {
 				handleError(res, err)
 				s.Plugins.DoPreWriteResponse(ctx, req, res, err)
 				data := res.EncodeSlicePointer()
-				_, err := conn.Write(*data)
+				n, err := conn.Write(*data)
+				stat.addWritten(n)
 				protocol.PutData(data)
 				s.Plugins.DoPostWriteResponse(ctx, req, res, err)
 				protocol.FreeMsg(res)
@@ -457,15 +492,20 @@ func (s *Server) serveConn(conn net.Conn) {
 			}
 			continue
 		}
+		atomic.AddInt32(&stat.pending, 1)
+		stat.handlers.Add(1)
 		go func() {
 			atomic.AddInt32(&s.handlerMsgNum, 1)
 			defer atomic.AddInt32(&s.handlerMsgNum, -1)
+			defer stat.handlers.Done()
+			defer atomic.AddInt32(&stat.pending, -1)
 
 			if req.IsHeartbeat() {
 				s.Plugins.DoHeartbeatRequest(ctx, req)
 				req.SetMessageType(protocol.Response)
 				data := req.EncodeSlicePointer()
-				conn.Write(*data)
+				n, _ := conn.Write(*data)
+				stat.addWritten(n)
 				protocol.PutData(data)
 				return
 			}
@@ -481,7 +521,7 @@ func (s *Server) serveConn(conn net.Conn) {
 
 			s.Plugins.DoPreHandleRequest(ctx, req)
 
-			if share.Trace {
+			if share.TraceEnabled() {
 				log.Debug("server handle request %s from conn: %v", req, conn.RemoteAddr().String())
 			}
 			res, err := s.handleRequest(ctx, req)
@@ -513,12 +553,13 @@ func (s *Server) serveConn(conn net.Conn) {
 					res.SetCompressType(req.CompressType())
 				}
 				data := res.EncodeSlicePointer()
-				conn.Write(*data)
+				n, _ := conn.Write(*data)
+				stat.addWritten(n)
 				protocol.PutData(data)
 			}
 			s.Plugins.DoPostWriteResponse(ctx, req, res, err)
 
-			if share.Trace {
+			if share.TraceEnabled() {
 				log.Debug("server write response %v for an request %s from conn: %v", res, req, conn.RemoteAddr().String())
 			}
 			protocol.FreeMsg(req)
@@ -551,6 +592,10 @@ func isShutdown(s *Server) bool {
 	return atomic.LoadInt32(&s.inShutdown) == 1
 }
 
+func isDrain(s *Server) bool {
+	return atomic.LoadInt32(&s.inDrain) == 1
+}
+
 func closeChannel(s *Server, conn net.Conn) {
 	s.mu.Lock()
 	delete(s.activeConn, conn)
@@ -621,6 +666,11 @@ func (s *Server) handleRequest(ctx context.Context, req *protocol.Message) (res
 		return handleError(res, err)
 	}
 
+	if err = s.validate(argv); err != nil {
+		argsReplyPools.Put(mtype.ArgType, argv)
+		return handleInvalidArgument(res, err)
+	}
+
 	replyv := argsReplyPools.Get(mtype.ReplyType)
 
 	argv, err = s.Plugins.DoPreCall(ctx, serviceName, methodName, argv)
@@ -702,8 +752,19 @@ func (s *Server) handleRequestForFunction(ctx context.Context, req *protocol.Mes
 		return handleError(res, err)
 	}
 
+	if err = s.validate(argv); err != nil {
+		argsReplyPools.Put(mtype.ArgType, argv)
+		return handleInvalidArgument(res, err)
+	}
+
 	replyv := argsReplyPools.Get(mtype.ReplyType)
 
+	argv, err = s.Plugins.DoPreCall(ctx, serviceName, methodName, argv)
+	if err != nil {
+		argsReplyPools.Put(mtype.ReplyType, replyv)
+		return handleError(res, err)
+	}
+
 	if mtype.ArgType.Kind() != reflect.Ptr {
 		err = service.callForFunction(ctx, mtype, reflect.ValueOf(argv).Elem(), reflect.ValueOf(replyv))
 	} else {
@@ -775,6 +836,9 @@ func (s *Server) Close() error {
 	if s.ln != nil {
 		err = s.ln.Close()
 	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
 	for c := range s.activeConn {
 		c.Close()
 		delete(s.activeConn, c)
@@ -845,6 +909,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 				log.Info("closed gateway")
 			}
 		}
+		s.closeGRPC(ctx)
 
 		s.mu.Lock()
 		for conn := range s.activeConn {
@@ -113,3 +113,4 @@ func TestHandleRequest(t *testing.T) {
 		t.Fatalf("expect 200 but got %d", reply.C)
 	}
 }
+var _ = fmt.Sprint // TMPFIX
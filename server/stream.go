@@ -9,8 +9,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/caser789/rpcy/log"
-	"github.com/caser789/rpcy/share"
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/share"
 	lru "github.com/hashicorp/golang-lru"
 )
 
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+// Validator is implemented by args that validate themselves.
+// Validate is called after validate tags are checked.
+// It can return an *InvalidArgumentError to report violations of fields.
+type Validator interface {
+	Validate() error
+}
+
+// FieldViolation is a violation of a field of args.
+type FieldViolation struct {
+	// Field is the path of the field, for example items[0].name. Names are from json tags.
+	Field string `json:"field"`
+	// Rule is the violated rule, for example required or min.
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// InvalidArgumentError is returned if args are invalid.
+// Violations are in share.InvalidArgumentKey metadata of responses as JSON,
+// and in the data of JSON-RPC errors. The HTTP gateway responds 400 for it.
+type InvalidArgumentError struct {
+	Violations []FieldViolation
+}
+
+func (e *InvalidArgumentError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		if v.Field == "" {
+			msgs[i] = v.Message
+		} else {
+			msgs[i] = v.Field + ": " + v.Message
+		}
+	}
+	return "rpcx: invalid argument: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks validate tags of fields of v, and calls Validate of v if it implements Validator.
+// Supported tags are required, min, max, len and oneof, separated by commas, for example
+// `validate:"required,max=64"`. min, max and len are values of numbers, and lengths of strings, slices and maps.
+// Nested structs, and structs in slices and maps, are validated too.
+// Unknown rules, for example rules of other validators such as email, are ignored with a warning.
+func Validate(v interface{}) error {
+	var violations []FieldViolation
+	validateValue(reflect.ValueOf(v), "", &violations)
+	if len(violations) > 0 {
+		return &InvalidArgumentError{Violations: violations}
+	}
+	return nil
+}
+
+type fieldRule struct {
+	name  string
+	param string
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	rules []fieldRule
+}
+
+var structRules sync.Map // reflect.Type -> []fieldRules
+
+var knownRules = map[string]bool{"required": true, "min": true, "max": true, "len": true, "oneof": true}
+
+func rulesOf(t reflect.Type) []fieldRules {
+	if rules, ok := structRules.Load(t); ok {
+		return rules.([]fieldRules)
+	}
+
+	var rules []fieldRules
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous { // unexported
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			name = f.Name
+		} else if tag != "" {
+			name = tag
+		}
+
+		fr := fieldRules{index: i, name: name}
+		if tag := f.Tag.Get("validate"); tag != "" && tag != "-" {
+			for _, r := range strings.Split(tag, ",") {
+				kv := strings.SplitN(strings.TrimSpace(r), "=", 2)
+				rule := fieldRule{name: kv[0]}
+				if len(kv) == 2 {
+					rule.param = kv[1]
+				}
+				if !knownRules[rule.name] {
+					log.Warnf("rpcx: unknown validate rule %q of field %s of %s is ignored", rule.name, f.Name, t)
+					continue
+				}
+				fr.rules = append(fr.rules, rule)
+			}
+		}
+		rules = append(rules, fr)
+	}
+	structRules.Store(t, rules)
+	return rules
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func validateValue(v reflect.Value, path string, violations *[]FieldViolation) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, fr := range rulesOf(v.Type()) {
+			f := v.Field(fr.index)
+			fieldPath := joinPath(path, fr.name)
+			for _, rule := range fr.rules {
+				if msg := checkRule(f, rule); msg != "" {
+					*violations = append(*violations, FieldViolation{Field: fieldPath, Rule: rule.name, Message: msg})
+				}
+			}
+			validateValue(f, fieldPath, violations)
+		}
+	case reflect.Slice, reflect.Array:
+		if !hasStructs(v.Type().Elem()) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), violations)
+		}
+	case reflect.Map:
+		if !hasStructs(v.Type().Elem()) {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			validateValue(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key()), violations)
+		}
+	}
+
+	if !v.CanInterface() {
+		return
+	}
+	validator, ok := v.Interface().(Validator)
+	if !ok && v.CanAddr() {
+		validator, ok = v.Addr().Interface().(Validator)
+	}
+	if !ok {
+		return
+	}
+	err := validator.Validate()
+	if err == nil {
+		return
+	}
+	var iae *InvalidArgumentError
+	if errors.As(err, &iae) {
+		for _, violation := range iae.Violations {
+			violation.Field = joinPath(path, violation.Field)
+			*violations = append(*violations, violation)
+		}
+		return
+	}
+	*violations = append(*violations, FieldViolation{Field: path, Rule: "validate", Message: err.Error()})
+}
+
+// hasStructs reports whether values of t may be structs, so that they should be validated.
+func hasStructs(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct || t.Kind() == reflect.Interface
+}
+
+// checkRule returns the message of the violation of rule, or "" if v doesn't violate it.
+func checkRule(v reflect.Value, rule fieldRule) string {
+	switch rule.name {
+	case "required":
+		if v.IsZero() {
+			return "is required"
+		}
+		return ""
+	case "oneof":
+		if v.IsZero() {
+			return ""
+		}
+		s := fmt.Sprint(reflect.Indirect(v).Interface())
+		for _, option := range strings.Fields(rule.param) {
+			if s == option {
+				return ""
+			}
+		}
+		return "must be one of " + rule.param
+	case "min", "max", "len":
+	default:
+		return ""
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	param, err := strconv.ParseFloat(rule.param, 64)
+	if err != nil {
+		return "invalid " + rule.name + " " + rule.param
+	}
+
+	var n float64
+	what := ""
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	case reflect.String:
+		n, what = float64(len([]rune(v.String()))), "length "
+	case reflect.Slice, reflect.Array, reflect.Map:
+		n, what = float64(v.Len()), "length "
+	default:
+		return ""
+	}
+
+	switch {
+	case rule.name == "min" && n < param:
+		return what + "must be at least " + rule.param
+	case rule.name == "max" && n > param:
+		return what + "must be at most " + rule.param
+	case rule.name == "len" && n != param:
+		return what + "must be " + rule.param
+	}
+	return ""
+}
+
+// validate validates args unless validation is disabled.
+func (s *Server) validate(argv interface{}) error {
+	if s.DisableValidation {
+		return nil
+	}
+	return Validate(argv)
+}
+
+// handleInvalidArgument handles errors of handleRequest, and puts violations into metadata of the response.
+func handleInvalidArgument(res *protocol.Message, err error) (*protocol.Message, error) {
+	res, err = handleError(res, err)
+	if iae, ok := err.(*InvalidArgumentError); ok {
+		if data, e := json.Marshal(iae.Violations); e == nil {
+			res.Metadata[share.InvalidArgumentKey] = string(data)
+		}
+	}
+	return res, err
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/share"
+)
+
+type ValidatedItem struct {
+	Name  string `json:"name" validate:"required,max=8"`
+	Count int    `json:"count" validate:"min=1"`
+}
+
+type ValidatedArgs struct {
+	User  string          `json:"user" validate:"required"`
+	Age   *int            `json:"age" validate:"min=0,max=150"`
+	Code  string          `json:"code" validate:"len=4"`
+	Kind  string          `json:"kind" validate:"oneof=a b"`
+	Items []ValidatedItem `json:"items" validate:"max=3"`
+	From  int             `json:"from"`
+	To    int             `json:"to"`
+}
+
+func (a *ValidatedArgs) Validate() error {
+	if a.From > a.To {
+		return &InvalidArgumentError{Violations: []FieldViolation{{Field: "from", Rule: "range", Message: "must not be greater than to"}}}
+	}
+	return nil
+}
+
+type ValidatedService int
+
+func (s *ValidatedService) Echo(ctx context.Context, args *ValidatedArgs, reply *ValidatedArgs) error {
+	*reply = *args
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	age := 200
+	args := &ValidatedArgs{
+		Age:   &age,
+		Code:  "abc",
+		Kind:  "c",
+		Items: []ValidatedItem{{Name: "ok", Count: 1}, {Name: "too long name", Count: 0}},
+		From:  2,
+		To:    1,
+	}
+
+	err := Validate(args)
+	var iae *InvalidArgumentError
+	if !errors.As(err, &iae) {
+		t.Fatalf("expect InvalidArgumentError but got %v", err)
+	}
+
+	expected := []FieldViolation{
+		{Field: "user", Rule: "required", Message: "is required"},
+		{Field: "age", Rule: "max", Message: "must be at most 150"},
+		{Field: "code", Rule: "len", Message: "length must be 4"},
+		{Field: "kind", Rule: "oneof", Message: "must be one of a b"},
+		{Field: "items[1].name", Rule: "max", Message: "length must be at most 8"},
+		{Field: "items[1].count", Rule: "min", Message: "must be at least 1"},
+		{Field: "from", Rule: "range", Message: "must not be greater than to"},
+	}
+	if !reflect.DeepEqual(iae.Violations, expected) {
+		t.Fatalf("expect %+v but got %+v", expected, iae.Violations)
+	}
+
+	age = 20
+	if err := Validate(&ValidatedArgs{User: "u", Age: &age, Code: "abcd", Kind: "a", Items: []ValidatedItem{{Name: "ok", Count: 1}}}); err != nil {
+		t.Fatalf("expect valid args but got %v", err)
+	}
+}
+
+func TestValidate_UnknownRule(t *testing.T) {
+	// rules of other validators are ignored, and known rules of the same field still apply
+	type args struct {
+		Email string `json:"email" validate:"required,email,max=8"`
+	}
+	if err := Validate(&args{Email: "not an email"}); err == nil || !strings.Contains(err.Error(), "at most 8") {
+		t.Fatalf("expect the max violation but got %v", err)
+	}
+	if err := Validate(&args{Email: "a@b.c"}); err != nil {
+		t.Fatalf("expect the unknown rule is ignored but got %v", err)
+	}
+}
+
+func validatedRequest(t *testing.T, args *ValidatedArgs) *protocol.Message {
+	req := protocol.NewMessage()
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.JSON)
+	req.SetSeq(1)
+	req.ServicePath = "Validated"
+	req.ServiceMethod = "Echo"
+
+	data, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Payload = data
+	return req
+}
+
+type countPreCallPlugin struct {
+	n int
+}
+
+func (p *countPreCallPlugin) PreCall(ctx context.Context, serviceName, methodName string, args interface{}) (interface{}, error) {
+	p.n++
+	return args, nil
+}
+
+func TestHandleRequest_Validation(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("Validated", new(ValidatedService), "")
+
+	res, err := s.handleRequest(context.Background(), validatedRequest(t, &ValidatedArgs{Code: "abcd"}))
+	if _, ok := err.(*InvalidArgumentError); !ok {
+		t.Fatalf("expect InvalidArgumentError but got %v", err)
+	}
+	if res.MessageStatusType() != protocol.Error {
+		t.Fatalf("expect an error response")
+	}
+	var violations []FieldViolation
+	if err := json.Unmarshal([]byte(res.Metadata[share.InvalidArgumentKey]), &violations); err != nil {
+		t.Fatalf("failed to unmarshal violations: %v", err)
+	}
+	if len(violations) != 1 || violations[0].Field != "user" {
+		t.Fatalf("unexpected violations: %+v", violations)
+	}
+
+	// invalid requests are rejected before PreCall plugins
+	pre := &countPreCallPlugin{}
+	s.Plugins.Add(pre)
+	s.handleRequest(context.Background(), validatedRequest(t, &ValidatedArgs{Code: "abcd"}))
+	if pre.n != 0 {
+		t.Errorf("expect PreCall is not called for invalid requests but called %d times", pre.n)
+	}
+
+	s.DisableValidation = true
+	if _, err := s.handleRequest(context.Background(), validatedRequest(t, &ValidatedArgs{Code: "abcd"})); err != nil {
+		t.Fatalf("expect validation is disabled but got %v", err)
+	}
+}
+
+func TestGateway_Validation(t *testing.T) {
+	s := NewServer()
+	s.RegisterName("Validated", new(ValidatedService), "")
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"code":"abcd"}`)))
+	r.Header.Set(XMessageID, "1")
+	r.Header.Set(XServicePath, "Validated")
+	r.Header.Set(XServiceMethod, "Echo")
+	r.Header.Set(XSerializeType, strconv.Itoa(int(protocol.JSON)))
+	w := httptest.NewRecorder()
+	s.handleGatewayRequest(w, r, nil)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expect 400 but got %d", w.Code)
+	}
+	meta, err := url.ParseQuery(w.Header().Get(XMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Get(share.InvalidArgumentKey) == "" {
+		t.Fatalf("expect violations in %s but got %q", XMeta, w.Header().Get(XMeta))
+	}
+}
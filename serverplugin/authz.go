@@ -0,0 +1,246 @@
+package serverplugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrPermissionDenied is returned to clients whose requests are denied by AuthzPlugin.
+var ErrPermissionDenied error = &server.StatusError{Code: http.StatusForbidden, Message: "rpcx: permission denied"}
+
+// AuthzRule matches requests by services, methods, identities of peers, CIDRs and metadata.
+// Empty fields match any requests, and a request matches the rule only if it matches all fields.
+// Services, methods and identities support "*" wildcards that match any characters,
+// for example "spiffe://example.org/ns/prod/*".
+type AuthzRule struct {
+	Name     string   `yaml:"name" json:"name"`
+	Services []string `yaml:"services" json:"services"`
+	Methods  []string `yaml:"methods" json:"methods"`
+	// Identities are SPIFFE IDs or CNs of client certificates.
+	Identities []string `yaml:"identities" json:"identities"`
+	// CIDRs are networks of remote addresses, for example 10.0.0.0/8 or 127.0.0.1/32.
+	CIDRs []string `yaml:"cidrs" json:"cidrs"`
+	// Metadata are key-values in request metadata, for example role: admin.
+	// Metadata are set by clients and can be spoofed, so they should be combined with Identities or CIDRs
+	// unless they are verified by an auth function of the server.
+	Metadata map[string]string `yaml:"metadata" json:"metadata"`
+
+	nets []*net.IPNet
+}
+
+// AuthzPolicy is a declarative authorization policy.
+// Requests matching any Deny rule are denied. Otherwise, requests matching any Allow rule are allowed,
+// and others are denied unless DefaultAllow is true.
+type AuthzPolicy struct {
+	Allow        []*AuthzRule `yaml:"allow" json:"allow"`
+	Deny         []*AuthzRule `yaml:"deny" json:"deny"`
+	DefaultAllow bool         `yaml:"default_allow" json:"default_allow"`
+}
+
+// AuthzDecision is an authorization decision for audit.
+type AuthzDecision struct {
+	Allowed       bool
+	Rule          string // name of the matched rule, empty if no rule matches
+	ServicePath   string
+	ServiceMethod string
+	Identity      string
+	RemoteAddr    string
+}
+
+// ParseAuthzPolicy parses a YAML or JSON policy.
+func ParseAuthzPolicy(data []byte) (*AuthzPolicy, error) {
+	var policy AuthzPolicy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// AuthzPlugin authorizes calls by AuthzPolicy, with identities from the mutual TLS certificates of peers.
+// Denied calls fail with ErrPermissionDenied, and all decisions are audited.
+type AuthzPlugin struct {
+	policy *AuthzPolicy
+	// Audit receives all decisions. If it is nil, denied decisions are logged as warnings and allowed ones as debug logs.
+	Audit func(ctx context.Context, decision *AuthzDecision)
+}
+
+// NewAuthzPlugin creates an AuthzPlugin. It returns an error if the policy contains invalid CIDRs.
+func NewAuthzPlugin(policy *AuthzPolicy) (*AuthzPlugin, error) {
+	for _, rules := range [][]*AuthzRule{policy.Allow, policy.Deny} {
+		for _, rule := range rules {
+			if err := rule.init(); err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", rule.Name, err)
+			}
+		}
+	}
+	return &AuthzPlugin{policy: policy}, nil
+}
+
+// NewAuthzPluginFromFile creates an AuthzPlugin by the policy in a YAML or JSON file.
+func NewAuthzPluginFromFile(file string) (*AuthzPlugin, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseAuthzPolicy(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthzPlugin(policy)
+}
+
+func (r *AuthzRule) init() error {
+	r.nets = r.nets[:0]
+	for _, cidr := range r.CIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		r.nets = append(r.nets, n)
+	}
+	return nil
+}
+
+// matchPattern reports whether s matches pattern, in which "*" matches any characters.
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchPattern(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AuthzRule) match(servicePath, serviceMethod string, peer *server.Peer, meta map[string]string) bool {
+	if !matchAny(r.Services, servicePath) || !matchAny(r.Methods, serviceMethod) {
+		return false
+	}
+
+	if len(r.Identities) > 0 {
+		if peer == nil || peer.Certificate == nil {
+			return false
+		}
+		if !matchAny(r.Identities, peer.SPIFFEID) && !matchAny(r.Identities, peer.CommonName) {
+			return false
+		}
+	}
+
+	if len(r.nets) > 0 {
+		if peer == nil || peer.Addr == nil {
+			return false
+		}
+		host, _, err := net.SplitHostPort(peer.Addr.String())
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		matched := false
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for k, v := range r.Metadata {
+		if value, ok := meta[k]; !ok || (v != "*" && value != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authorize returns the decision of a call.
+func (p *AuthzPlugin) Authorize(ctx context.Context, servicePath, serviceMethod string) *AuthzDecision {
+	peer, _ := server.PeerFromContext(ctx)
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+
+	d := &AuthzDecision{ServicePath: servicePath, ServiceMethod: serviceMethod, Allowed: p.policy.DefaultAllow}
+	if peer != nil {
+		d.Identity = peer.Identity()
+		if peer.Addr != nil {
+			d.RemoteAddr = peer.Addr.String()
+		}
+	}
+
+	for _, rule := range p.policy.Deny {
+		if rule.match(servicePath, serviceMethod, peer, meta) {
+			d.Allowed, d.Rule = false, rule.Name
+			return d
+		}
+	}
+	for _, rule := range p.policy.Allow {
+		if rule.match(servicePath, serviceMethod, peer, meta) {
+			d.Allowed, d.Rule = true, rule.Name
+			return d
+		}
+	}
+	return d
+}
+
+// PreCall authorizes calls.
+func (p *AuthzPlugin) PreCall(ctx context.Context, serviceName, methodName string, args interface{}) (interface{}, error) {
+	d := p.Authorize(ctx, serviceName, methodName)
+	p.audit(ctx, d)
+	if !d.Allowed {
+		return args, ErrPermissionDenied
+	}
+	return args, nil
+}
+
+func (p *AuthzPlugin) audit(ctx context.Context, d *AuthzDecision) {
+	if p.Audit != nil {
+		p.Audit(ctx, d)
+		return
+	}
+
+	rule := d.Rule
+	if rule == "" {
+		rule = "default"
+	}
+	identity := d.Identity
+	if identity == "" {
+		identity = "anonymous"
+	}
+	msg := fmt.Sprintf("authz: %s.%s from %s (%s) by rule %s", d.ServicePath, d.ServiceMethod, identity, d.RemoteAddr, rule)
+	if d.Allowed {
+		log.Debugf("%s is allowed", msg)
+	} else {
+		log.Warnf("%s is denied", msg)
+	}
+}
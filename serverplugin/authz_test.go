@@ -0,0 +1,264 @@
+package serverplugin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/caser789/rpcj/_testutils"
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+)
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// newTestPKI returns the pool of a test CA, and certificates of the server and the client signed by it.
+// The client certificate has the CN web and a SPIFFE ID.
+func newTestPKI(t *testing.T) (pool *x509.CertPool, serverCert, clientCert tls.Certificate, spiffeID *url.URL) {
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	pool = x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	serverCert = newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "arith"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	spiffeID, _ = url.Parse("spiffe://example.org/ns/prod/sa/web")
+	clientCert = newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "web"},
+		URIs:        []*url.URL{spiffeID},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	return pool, serverCert, clientCert, spiffeID
+}
+
+func TestAuthzPlugin(t *testing.T) {
+	pool, serverCert, clientCert, spiffeID := newTestPKI(t)
+
+	policy, err := ParseAuthzPolicy([]byte(`
+deny:
+  - name: no-admin
+    services: [Admin]
+allow:
+  - name: prod
+    services: [Arith, Admin]
+    identities: ["spiffe://example.org/ns/prod/*"]
+  - name: admin
+    metadata: {role: admin}
+    cidrs: [127.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewAuthzPlugin(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var decisions []*AuthzDecision
+	p.Audit = func(ctx context.Context, d *AuthzDecision) {
+		mu.Lock()
+		decisions = append(decisions, d)
+		mu.Unlock()
+	}
+
+	var peer *server.Peer
+	s := server.NewServer(server.WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}))
+	s.Plugins.Add(p)
+	s.RegisterName("Arith", new(Arith), "")
+	s.RegisterName("Admin", new(Arith), "")
+	s.RegisterFunctionName("Peer", "Get", func(ctx context.Context, args *Args, reply *Reply) error {
+		peer, _ = server.PeerFromContext(ctx)
+		return nil
+	}, "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+	addr := "tcp@" + s.Address().String()
+
+	newXClient := func(servicePath string, certs []tls.Certificate) client.XClient {
+		opt := client.DefaultOption
+		opt.TLSConfig = &tls.Config{RootCAs: pool, Certificates: certs}
+		d, _ := client.NewPeer2PeerDiscovery(addr, "")
+		return client.NewXClient(servicePath, client.Failfast, client.RandomSelect, d, opt)
+	}
+
+	xclient := newXClient("Arith", []tls.Certificate{clientCert})
+	defer xclient.Close()
+	reply := &Reply{}
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err != nil {
+		t.Fatalf("expect the call is allowed: %v", err)
+	}
+	adminClient := newXClient("Admin", []tls.Certificate{clientCert})
+	defer adminClient.Close()
+	if err := adminClient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err == nil || !strings.Contains(err.Error(), ErrPermissionDenied.Error()) {
+		t.Fatalf("expect the call is denied but got %v", err)
+	}
+
+	// without certificates
+	anonymous := newXClient("Arith", nil)
+	defer anonymous.Close()
+	if err := anonymous.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err == nil {
+		t.Fatal("expect the anonymous call is denied")
+	}
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{"role": "admin"})
+	if err := anonymous.Call(ctx, "Mul", &Args{A: 10, B: 20}, reply); err != nil {
+		t.Fatalf("expect the admin call is allowed: %v", err)
+	}
+
+	// functions are authorized too, and get the peer
+	peerClient := newXClient("Peer", []tls.Certificate{clientCert})
+	defer peerClient.Close()
+	if err := peerClient.Call(context.Background(), "Get", &Args{}, reply); err == nil {
+		t.Fatal("expect the call of functions is denied")
+	}
+	if err := peerClient.Call(ctx, "Get", &Args{}, reply); err != nil {
+		t.Fatalf("expect the admin call is allowed: %v", err)
+	}
+	if peer == nil || peer.SPIFFEID != spiffeID.String() || peer.CommonName != "web" || peer.TLS == nil {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var rules []string
+	for _, d := range decisions {
+		rules = append(rules, d.Rule)
+	}
+	if got := strings.Join(rules, ","); got != "prod,no-admin,,admin,,admin" {
+		t.Errorf("unexpected decisions: %s", got)
+	}
+	if decisions[0].Identity != spiffeID.String() || decisions[0].RemoteAddr == "" {
+		t.Errorf("unexpected decision: %+v", decisions[0])
+	}
+}
+
+// gatewayCall calls serviceMethod by the http gateway with JSON args and metadata.
+func gatewayCall(t *testing.T, addr, serviceMethod, body string, meta url.Values) *http.Response {
+	dot := strings.LastIndex(serviceMethod, ".")
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/", strings.NewReader(body))
+	req.Header.Set(server.XMessageID, "1")
+	req.Header.Set(server.XServicePath, serviceMethod[:dot])
+	req.Header.Set(server.XServiceMethod, serviceMethod[dot+1:])
+	req.Header.Set(server.XSerializeType, "1")
+	if meta != nil {
+		req.Header.Set(server.XMeta, meta.Encode())
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestAuthzPlugin_Gateway(t *testing.T) {
+	p, err := NewAuthzPlugin(&AuthzPolicy{
+		Deny:         []*AuthzRule{{Name: "local", CIDRs: []string{"127.0.0.0/8"}}},
+		DefaultAllow: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.NewServer()
+	s.Plugins.Add(p)
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	res := gatewayCall(t, s.Address().String(), "Arith.Mul", `{"A":10,"B":20}`, nil)
+	if msg := res.Header.Get(server.XErrorMessage); res.StatusCode != http.StatusForbidden || !strings.Contains(msg, ErrPermissionDenied.Error()) {
+		t.Fatalf("expect the gateway request is denied but got %d %q", res.StatusCode, msg)
+	}
+}
+
+func TestAuthzPlugin_GRPC(t *testing.T) {
+	pool, serverCert, clientCert, spiffeID := newTestPKI(t)
+	p, err := NewAuthzPlugin(&AuthzPolicy{
+		Allow: []*AuthzRule{{Name: "prod", Identities: []string{"spiffe://example.org/ns/prod/*"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peer *server.Peer
+	s := server.NewServer(server.WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}))
+	s.Plugins.Add(p)
+	s.RegisterFunctionName("Peer", "Get", func(ctx context.Context, args *testutils.ProtoArgs, reply *testutils.ProtoReply) error {
+		peer, _ = server.PeerFromContext(ctx)
+		return nil
+	}, "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	call := func(certs []tls.Certificate) error {
+		opt := client.DefaultOption
+		opt.TLSConfig = &tls.Config{RootCAs: pool, Certificates: certs}
+		c := client.NewGRPCClient(opt)
+		if err := c.Connect("tcp", s.Address().String()); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.Call(context.Background(), "Peer", "Get", &testutils.ProtoArgs{A: 1}, &testutils.ProtoReply{})
+	}
+
+	if err := call([]tls.Certificate{clientCert}); err != nil {
+		t.Fatalf("expect the grpc call is allowed: %v", err)
+	}
+	if peer == nil || peer.TLS == nil || peer.SPIFFEID != spiffeID.String() || peer.CommonName != "web" {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+	if err := call(nil); err == nil || !strings.Contains(err.Error(), ErrPermissionDenied.Error()) {
+		t.Fatalf("expect the anonymous grpc call is denied but got %v", err)
+	}
+}
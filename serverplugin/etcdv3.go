@@ -0,0 +1,349 @@
+// +build etcd
+
+package serverplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	metrics "github.com/rcrowley/go-metrics"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdV3RegisterPlugin implements etcd v3 registry.
+// Services are put with a lease kept alive by the etcd client, so they are removed soon after the server dies.
+// If the lease is lost, for example after a long partition, a new lease is granted and services are put again.
+type EtcdV3RegisterPlugin struct {
+	// service address, for example, tcp@127.0.0.1:8972, quic@127.0.0.1:1234
+	ServiceAddress string
+	// etcd addresses
+	EtcdServers []string
+	// base path for rpcx server, for example com/example/rpcx
+	BasePath string
+	Metrics  metrics.Registry
+	// Registered services
+	Services  []string
+	metasLock sync.RWMutex
+	metas     map[string]string
+	// UpdateInterval is the interval of updating metrics in metadata of services. Zero disables it.
+	UpdateInterval time.Duration
+	// LeaseTTL is the TTL of the lease. Default is 10s.
+	LeaseTTL time.Duration
+
+	// Config is used to connect etcd, for example to set TLS and authentication. Its Endpoints is replaced by EtcdServers.
+	Config *clientv3.Config
+	client *clientv3.Client
+
+	leaseMu sync.Mutex
+	leaseID clientv3.LeaseID
+
+	dying chan struct{}
+	done  chan struct{}
+}
+
+// Start starts to connect etcd cluster
+func (p *EtcdV3RegisterPlugin) Start() error {
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	if p.dying == nil {
+		p.dying = make(chan struct{})
+	}
+
+	if err := p.connect(); err != nil {
+		return err
+	}
+	if _, err := p.lease(); err != nil {
+		log.Errorf("cannot grant etcd lease: %v", err)
+		return err
+	}
+
+	go p.keepAlive()
+	return nil
+}
+
+func (p *EtcdV3RegisterPlugin) connect() error {
+	if p.client != nil {
+		return nil
+	}
+
+	cfg := clientv3.Config{DialTimeout: 5 * time.Second}
+	if p.Config != nil {
+		cfg = *p.Config
+	}
+	cfg.Endpoints = p.EtcdServers
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		log.Errorf("cannot create etcd registry: %v", err)
+		return err
+	}
+	p.client = client
+
+	p.BasePath = "/" + strings.Trim(p.BasePath, "/")
+	return nil
+}
+
+// lease returns the current lease, and grants a new one if there is no lease.
+func (p *EtcdV3RegisterPlugin) lease() (clientv3.LeaseID, error) {
+	p.leaseMu.Lock()
+	defer p.leaseMu.Unlock()
+
+	if p.leaseID != clientv3.NoLease {
+		return p.leaseID, nil
+	}
+
+	ttl := p.LeaseTTL
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := p.client.Grant(ctx, int64((ttl+time.Second-1)/time.Second))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	p.leaseID = resp.ID
+	return p.leaseID, nil
+}
+
+// keepAlive keeps the lease alive, re-registers services when the lease is lost,
+// and updates metrics in metadata every UpdateInterval.
+func (p *EtcdV3RegisterPlugin) keepAlive() {
+	defer close(p.done)
+
+	var tick <-chan time.Time
+	if p.UpdateInterval > 0 {
+		ticker := time.NewTicker(p.UpdateInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		leaseID, err := p.lease()
+		var ch <-chan *clientv3.LeaseKeepAliveResponse
+		if err == nil {
+			ch, err = p.client.KeepAlive(ctx, leaseID)
+		}
+		if err != nil {
+			log.Warnf("cannot keep etcd lease alive, will retry: %v", err)
+			select {
+			case <-p.dying:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+	keepAlive:
+		for {
+			select {
+			case <-p.dying:
+				return
+			case _, ok := <-ch:
+				if !ok {
+					break keepAlive
+				}
+			case <-tick:
+				p.putServices(p.extra())
+			}
+		}
+
+		// the lease has expired or the client can't reach etcd before the lease expires
+		log.Warnf("etcd lease %x is lost, will register services again", leaseID)
+		p.leaseMu.Lock()
+		if p.leaseID == leaseID {
+			p.leaseID = clientv3.NoLease
+		}
+		p.leaseMu.Unlock()
+		if _, err := p.lease(); err == nil {
+			p.putServices(p.extra())
+		}
+	}
+}
+
+func (p *EtcdV3RegisterPlugin) extra() map[string]string {
+	extra := make(map[string]string)
+	if p.Metrics != nil {
+		extra["calls"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("calls", p.Metrics).RateMean())
+		extra["connections"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("connections", p.Metrics).RateMean())
+	}
+	return extra
+}
+
+// putServices puts all registered services with extra metadata.
+func (p *EtcdV3RegisterPlugin) putServices(extra map[string]string) {
+	p.metasLock.RLock()
+	metas := make(map[string]string, len(p.metas))
+	for name, meta := range p.metas {
+		metas[name] = meta
+	}
+	p.metasLock.RUnlock()
+
+	for name, meta := range metas {
+		if len(extra) > 0 {
+			v, _ := url.ParseQuery(meta)
+			for key, value := range extra {
+				v.Set(key, value)
+			}
+			meta = v.Encode()
+		}
+		if err := p.put(name, meta); err != nil {
+			log.Errorf("cannot put etcd path %s: %v", p.nodePath(name), err)
+		}
+	}
+}
+
+func (p *EtcdV3RegisterPlugin) nodePath(name string) string {
+	return fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+}
+
+// put puts the service with the current lease, and with a new lease if the current one has expired.
+func (p *EtcdV3RegisterPlugin) put(name, metadata string) error {
+	for i := 0; ; i++ {
+		leaseID, err := p.lease()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = p.client.Put(ctx, p.nodePath(name), metadata, clientv3.WithLease(leaseID))
+		cancel()
+		if err != rpctypes.ErrLeaseNotFound || i > 0 {
+			return err
+		}
+
+		p.leaseMu.Lock()
+		if p.leaseID == leaseID {
+			p.leaseID = clientv3.NoLease
+		}
+		p.leaseMu.Unlock()
+	}
+}
+
+// Stop unregister all services.
+func (p *EtcdV3RegisterPlugin) Stop() error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	// stop keeping alive first, so services are not registered again after the lease is revoked
+	if p.dying != nil {
+		close(p.dying)
+		<-p.done
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, name := range p.Services {
+		nodePath := p.nodePath(name)
+		if _, err := p.client.Delete(ctx, nodePath); err != nil {
+			log.Errorf("cannot delete path %s: %v", nodePath, err)
+			continue
+		}
+		log.Infof("delete path %s", nodePath)
+	}
+
+	p.leaseMu.Lock()
+	if p.leaseID != clientv3.NoLease {
+		p.client.Revoke(ctx, p.leaseID)
+		p.leaseID = clientv3.NoLease
+	}
+	p.leaseMu.Unlock()
+
+	return p.client.Close()
+}
+
+// HandleConnAccept handles connections from clients
+func (p *EtcdV3RegisterPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	if p.Metrics != nil {
+		metrics.GetOrRegisterMeter("connections", p.Metrics).Mark(1)
+	}
+	return conn, true
+}
+
+// PreCall handles rpc call from clients
+func (p *EtcdV3RegisterPlugin) PreCall(_ context.Context, _, _ string, args interface{}) (interface{}, error) {
+	if p.Metrics != nil {
+		metrics.GetOrRegisterMeter("calls", p.Metrics).Mark(1)
+	}
+	return args, nil
+}
+
+// Register handles registering event.
+// this service is registered at BASE/serviceName/thisIpAddress node
+func (p *EtcdV3RegisterPlugin) Register(name string, rcvr interface{}, metadata string) (err error) {
+	if strings.TrimSpace(name) == "" {
+		err = errors.New("Register service `name` can't be empty")
+		return
+	}
+
+	if err = p.connect(); err != nil {
+		return err
+	}
+	if err = p.put(name, metadata); err != nil {
+		log.Errorf("cannot create etcd path %s: %v", p.nodePath(name), err)
+		return err
+	}
+
+	p.Services = append(p.Services, name)
+
+	p.metasLock.Lock()
+	if p.metas == nil {
+		p.metas = make(map[string]string)
+	}
+	p.metas[name] = metadata
+	p.metasLock.Unlock()
+	return
+}
+
+func (p *EtcdV3RegisterPlugin) RegisterFunction(serviceName, fname string, fn interface{}, metadata string) error {
+	return p.Register(serviceName, fn, metadata)
+}
+
+func (p *EtcdV3RegisterPlugin) Unregister(name string) (err error) {
+	if len(p.Services) == 0 {
+		return nil
+	}
+	if strings.TrimSpace(name) == "" {
+		err = errors.New("Unregister service `name` can't be empty")
+		return
+	}
+
+	if err = p.connect(); err != nil {
+		return err
+	}
+
+	nodePath := p.nodePath(name)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err = p.client.Delete(ctx, nodePath); err != nil {
+		log.Errorf("cannot delete etcd path %s: %v", nodePath, err)
+		return err
+	}
+
+	var services = make([]string, 0, len(p.Services)-1)
+	for _, s := range p.Services {
+		if s != name {
+			services = append(services, s)
+		}
+	}
+	p.Services = services
+
+	p.metasLock.Lock()
+	if p.metas == nil {
+		p.metas = make(map[string]string)
+	}
+	delete(p.metas, name)
+	p.metasLock.Unlock()
+	return
+}
@@ -0,0 +1,120 @@
+// +build etcd
+
+package serverplugin
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/server"
+	metrics "github.com/rcrowley/go-metrics"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEmbeddedEtcd starts an etcd server for tests and returns its client address.
+func startEmbeddedEtcd(t *testing.T) (string, func()) {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://" + freeAddr(t))
+	peerURL, _ := url.Parse("http://" + freeAddr(t))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + peerURL.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("etcd is not ready")
+	}
+	return clientURL.Host, e.Close
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestEtcdV3Registry(t *testing.T) {
+	addr, stop := startEmbeddedEtcd(t)
+	defer stop()
+
+	s := server.NewServer()
+	r := &EtcdV3RegisterPlugin{
+		ServiceAddress: "tcp@127.0.0.1:8972",
+		EtcdServers:    []string{addr},
+		BasePath:       "/rpcx_test",
+		Metrics:        metrics.NewRegistry(),
+		UpdateInterval: 100 * time.Millisecond,
+		LeaseTTL:       2 * time.Second,
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s.Plugins.Add(r)
+	if err := s.RegisterName("Arith", new(Arith), "weight=10"); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{addr}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	get := func() (string, int64) {
+		resp, err := cli.Get(context.Background(), "/rpcx_test/Arith/tcp@127.0.0.1:8972")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) == 0 {
+			return "", 0
+		}
+		return string(resp.Kvs[0].Value), resp.Kvs[0].Lease
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	meta, lease := get()
+	if v, _ := url.ParseQuery(meta); v.Get("weight") != "10" || v.Get("calls") == "" {
+		t.Errorf("expected metadata with metrics, got %q", meta)
+	}
+	if lease == 0 {
+		t.Fatal("expected the service to be put with a lease")
+	}
+
+	// the lease is kept alive beyond its TTL
+	time.Sleep(3 * time.Second)
+	if meta, _ := get(); meta == "" {
+		t.Fatal("expected the service to be kept alive")
+	}
+
+	// services are registered again after the lease is lost
+	if _, err := cli.Revoke(context.Background(), clientv3.LeaseID(lease)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	meta, newLease := get()
+	if meta == "" || newLease == lease {
+		t.Fatalf("expected the service to be registered with a new lease, got %q with lease %x", meta, newLease)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := get(); meta != "" {
+		t.Errorf("expected the service to be deleted, got %q", meta)
+	}
+}
@@ -0,0 +1,453 @@
+package serverplugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+)
+
+var (
+	// ErrInvalidToken is returned if a token is missing, malformed, expired, or has invalid signature or claims.
+	ErrInvalidToken error = &server.StatusError{Code: http.StatusUnauthorized, Message: "rpcx: invalid token"}
+	// ErrInsufficientScope is returned if a token has no scopes required by the method.
+	ErrInsufficientScope error = &server.StatusError{Code: http.StatusForbidden, Message: "rpcx: insufficient scope"}
+)
+
+// JWTOption contains options of JWTPlugin.
+type JWTOption struct {
+	// Issuer is the expected iss claim. Empty means any issuer.
+	Issuer string
+	// Audience is the expected aud claim. Empty means any audience.
+	Audience string
+	// ClockSkew is the tolerance of exp, nbf and iat claims. Default is 1 minute.
+	ClockSkew time.Duration
+
+	// JWKSURL is the URL of the JWKS, for example the jwks_uri of an OIDC provider.
+	JWKSURL string
+	// JWKSRefresh is the interval of refreshing the JWKS. Default is 1 hour.
+	// The JWKS is also refreshed when a token is signed by an unknown key, at most once every 30 seconds.
+	JWKSRefresh time.Duration
+	// HTTPClient is used to get the JWKS. Default is http.DefaultClient.
+	HTTPClient *http.Client
+	// Keys is a static keyset by key IDs, for example for tests. It is used if JWKSURL is empty.
+	// Keys can be parsed from a JWKS by ParseJWKS.
+	Keys map[string]crypto.PublicKey
+
+	// Scopes are required scopes of services and methods. Keys are "Service.Method", or "Service" for all methods.
+	// Tokens must have all scopes of the method and its service, in the scope or scp claim.
+	Scopes map[string][]string
+	// Optional makes calls without tokens allowed, unless their methods require scopes.
+	Optional bool
+}
+
+// JWTClaims are claims of a validated token.
+type JWTClaims map[string]interface{}
+
+// Subject returns the sub claim.
+func (c JWTClaims) Subject() string {
+	s, _ := c["sub"].(string)
+	return s
+}
+
+// Scopes returns scopes in the scope claim, which is space-separated, or the scp claim, which can be a list.
+func (c JWTClaims) Scopes() []string {
+	return append(claimStrings(c["scope"]), claimStrings(c["scp"])...)
+}
+
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var ss []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+type jwtClaimsKey struct{}
+
+// JWTClaimsFromContext returns claims validated by JWTPlugin in the context of handlers.
+func JWTClaimsFromContext(ctx context.Context) (JWTClaims, bool) {
+	claims, ok := ctx.Value(jwtClaimsKey{}).(JWTClaims)
+	return claims, ok
+}
+
+// JWTPlugin authenticates calls by JWT bearer tokens in share.AuthKey metadata,
+// which are set by XClient.Auth and by the Authorization header of the HTTP gateway.
+// RS256, ES256 and EdDSA tokens are supported.
+type JWTPlugin struct {
+	opt JWTOption
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+	// refreshedAt is the time of the last refresh for unknown keys, successful or not,
+	// so tokens with random key IDs can't make the plugin get the JWKS repeatedly.
+	refreshedAt time.Time
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewJWTPlugin creates a JWTPlugin. If JWKSURL is set, it returns an error if the JWKS can't be got.
+func NewJWTPlugin(opt JWTOption) (*JWTPlugin, error) {
+	if opt.ClockSkew <= 0 {
+		opt.ClockSkew = time.Minute
+	}
+	if opt.JWKSRefresh <= 0 {
+		opt.JWKSRefresh = time.Hour
+	}
+	if opt.HTTPClient == nil {
+		opt.HTTPClient = http.DefaultClient
+	}
+
+	p := &JWTPlugin{opt: opt, keys: opt.Keys, stopCh: make(chan struct{})}
+	if opt.JWKSURL == "" {
+		if len(opt.Keys) == 0 {
+			return nil, errors.New("JWKSURL or Keys must be set")
+		}
+		return p, nil
+	}
+
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	go p.refreshLoop()
+	return p, nil
+}
+
+// ParseJWKS parses RSA, EC P-256 and Ed25519 keys of a JWKS. Keys for encryption are skipped.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			key = pub
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid Ed25519 key %q", k.Kid)
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue // unsupported keys
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (p *JWTPlugin) refreshKeys() error {
+	resp, err := p.opt.HTTPClient.Get(p.opt.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get JWKS: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys in JWKS")
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *JWTPlugin) refreshLoop() {
+	ticker := time.NewTicker(p.opt.JWKSRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			// keep the last keys on failures, since keys are rotated slowly
+			if err := p.refreshKeys(); err != nil {
+				log.Warnf("failed to refresh JWKS %s: %v", p.opt.JWKSURL, err)
+			}
+		}
+	}
+}
+
+// key returns the key of kid, and refreshes the JWKS if kid is unknown because keys may have been rotated.
+func (p *JWTPlugin) key(kid string) crypto.PublicKey {
+	p.mu.RLock()
+	key := p.lookup(kid)
+	p.mu.RUnlock()
+	if key != nil || p.opt.JWKSURL == "" {
+		return key
+	}
+
+	p.mu.Lock()
+	refreshable := time.Since(p.refreshedAt) > 30*time.Second
+	if refreshable {
+		p.refreshedAt = time.Now()
+	}
+	p.mu.Unlock()
+	if !refreshable {
+		return nil
+	}
+
+	if err := p.refreshKeys(); err != nil {
+		log.Warnf("failed to refresh JWKS %s: %v", p.opt.JWKSURL, err)
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lookup(kid)
+}
+
+// lookup returns the key of kid, or the only key if kid is empty. p.mu must be held.
+func (p *JWTPlugin) lookup(kid string) crypto.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// Validate validates the signature and claims of token, and returns its claims.
+func (p *JWTPlugin) Validate(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key := p.key(header.Kid)
+	if key == nil || !verifyJWT(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := p.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWT verifies the signature by alg. The key type must match alg, so tokens can't choose weaker algorithms.
+func verifyJWT(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		return ecdsa.Verify(pub, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
+
+func (p *JWTPlugin) validateClaims(claims JWTClaims) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(p.opt.ClockSkew)) {
+		return ErrInvalidToken
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(p.opt.ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return ErrInvalidToken
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(p.opt.ClockSkew).Before(time.Unix(int64(iat), 0)) {
+		return ErrInvalidToken
+	}
+
+	if p.opt.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != p.opt.Issuer {
+			return ErrInvalidToken
+		}
+	}
+	if p.opt.Audience != "" {
+		found := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			if aud == p.opt.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrInvalidToken
+		}
+	}
+	return nil
+}
+
+func (p *JWTPlugin) requiredScopes(serviceName, methodName string) []string {
+	var scopes []string
+	scopes = append(scopes, p.opt.Scopes[serviceName]...)
+	return append(scopes, p.opt.Scopes[serviceName+"."+methodName]...)
+}
+
+func bearerToken(meta map[string]string) string {
+	token := meta[share.AuthKey]
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+	return token
+}
+
+// PostReadRequest puts claims of valid tokens into the context when requests are read,
+// so plugins added after JWTPlugin can use them before PreCall. Invalid tokens are rejected by PreCall.
+func (p *JWTPlugin) PostReadRequest(ctx context.Context, r *protocol.Message, e error) error {
+	sctx, ok := ctx.(*share.Context)
+	if !ok || e != nil || r == nil {
+		return nil
+	}
+	token := bearerToken(r.Metadata)
+	if token == "" {
+		return nil
+	}
+	if claims, err := p.Validate(token); err == nil {
+		sctx.SetValue(jwtClaimsKey{}, claims)
+	}
+	return nil
+}
+
+// PreCall validates tokens and scopes, and puts claims into the context.
+func (p *JWTPlugin) PreCall(ctx context.Context, serviceName, methodName string, args interface{}) (interface{}, error) {
+	required := p.requiredScopes(serviceName, methodName)
+
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	token := bearerToken(meta)
+	if token == "" {
+		if p.opt.Optional && len(required) == 0 {
+			return args, nil
+		}
+		return args, ErrInvalidToken
+	}
+
+	// tokens have been validated if they are read by the server
+	claims, ok := JWTClaimsFromContext(ctx)
+	if !ok {
+		var err error
+		if claims, err = p.Validate(token); err != nil {
+			return args, err
+		}
+	}
+
+	scopes := make(map[string]bool)
+	for _, scope := range claims.Scopes() {
+		scopes[scope] = true
+	}
+	for _, scope := range required {
+		if !scopes[scope] {
+			return args, ErrInsufficientScope
+		}
+	}
+
+	if sctx, ok := ctx.(*share.Context); ok {
+		sctx.SetValue(jwtClaimsKey{}, claims)
+	}
+	return args, nil
+}
+
+// Close stops refreshing the JWKS.
+func (p *JWTPlugin) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+}
@@ -0,0 +1,242 @@
+package serverplugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+)
+
+// signJWT signs claims by key, whose type determines the algorithm.
+func signJWT(t *testing.T, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	var alg string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		alg = "ES256"
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, h[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwk(kid string, key crypto.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": enc(key.N.Bytes()), "e": enc(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": enc(x), "y": enc(y)}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": enc(key)}
+	}
+	return nil
+}
+
+func TestJWTPlugin(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	// the JWKS has only the RSA key at first, and other keys are rotated in later
+	var rotated int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]string{jwk("rsa", rsaKey.Public())}
+		if atomic.LoadInt32(&rotated) == 1 {
+			keys = append(keys, jwk("ec", ecKey.Public()), jwk("ed", edKey.Public()))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	p, err := NewJWTPlugin(JWTOption{
+		Issuer:   "https://issuer.example.org",
+		Audience: "arith",
+		JWKSURL:  jwks.URL,
+		Scopes:   map[string][]string{"Arith.Mul": {"arith:mul"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://issuer.example.org",
+			"aud":   []string{"arith", "other"},
+			"sub":   "alice",
+			"scope": "arith:mul arith:div",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	if _, err := p.Validate(signJWT(t, "rsa", rsaKey, claims(nil))); err != nil {
+		t.Fatalf("expect the RS256 token is valid: %v", err)
+	}
+	atomic.StoreInt32(&rotated, 1)
+	if _, err := p.Validate(signJWT(t, "ec", ecKey, claims(nil))); err != nil {
+		t.Fatalf("expect the ES256 token is valid after rotation: %v", err)
+	}
+	if c, err := p.Validate(signJWT(t, "ed", edKey, claims(nil))); err != nil || c.Subject() != "alice" {
+		t.Fatalf("expect the EdDSA token is valid: %v", err)
+	}
+
+	invalid := map[string]string{
+		"expired":        signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+		"no exp":         signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+		"not yet valid":  signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})),
+		"wrong issuer":   signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.org"})),
+		"wrong audience": signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+		"wrong key":      signJWT(t, "ec", rsaKey, claims(nil)),
+		"unknown key":    signJWT(t, "unknown", rsaKey, claims(nil)),
+		"malformed":      "a.b",
+	}
+	for name, token := range invalid {
+		if _, err := p.Validate(token); err != ErrInvalidToken {
+			t.Errorf("expect the %s token is invalid but got %v", name, err)
+		}
+	}
+	// clock skew
+	if _, err := p.Validate(signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}))); err != nil {
+		t.Errorf("expect the token is valid within clock skew: %v", err)
+	}
+
+	// claims are put into the context when requests are read
+	msg := protocol.NewMessage()
+	msg.Metadata = map[string]string{share.AuthKey: "Bearer " + signJWT(t, "rsa", rsaKey, claims(nil))}
+	ctx := share.NewContext(context.Background())
+	if err := p.PostReadRequest(ctx, msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := JWTClaimsFromContext(ctx); !ok || c.Subject() != "alice" {
+		t.Errorf("expect claims in the context after the request is read")
+	}
+
+	// end to end with TokenRefresher
+	var sub string
+	s := server.NewServer()
+	s.Plugins.Add(p)
+	s.RegisterName("Arith", new(Arith), "")
+	s.RegisterFunctionName("Claims", "Get", func(ctx context.Context, args *Args, reply *Reply) error {
+		c, _ := JWTClaimsFromContext(ctx)
+		sub = c.Subject()
+		return nil
+	}, "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	d, _ := client.NewPeer2PeerDiscovery("tcp@"+s.Address().String(), "")
+	xclient := client.NewXClient("Arith", client.Failfast, client.RandomSelect, d, client.DefaultOption)
+	defer xclient.Close()
+	claimsClient := client.NewXClient("Claims", client.Failfast, client.RandomSelect, d, client.DefaultOption)
+	defer claimsClient.Close()
+
+	reply := &Reply{}
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err == nil || !strings.Contains(err.Error(), ErrInvalidToken.Error()) {
+		t.Fatalf("expect the call without tokens fails but got %v", err)
+	}
+
+	// the http gateway responds 401 for invalid tokens and 403 for insufficient scopes
+	if res := gatewayCall(t, s.Address().String(), "Arith.Mul", `{"A":10,"B":20}`, nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expect 401 without tokens but got %d", res.StatusCode)
+	}
+	divToken := signJWT(t, "rsa", rsaKey, claims(map[string]interface{}{"scope": "arith:div"}))
+	meta := url.Values{share.AuthKey: {"Bearer " + divToken}}
+	if res := gatewayCall(t, s.Address().String(), "Arith.Mul", `{"A":10,"B":20}`, meta); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expect 403 without scopes but got %d", res.StatusCode)
+	}
+
+	var mu sync.Mutex
+	var issued int
+	scope := "arith:div"
+	src := client.TokenSourceFunc(func() (*client.Token, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		issued++
+		expiry := time.Now().Add(2 * time.Second)
+		token := signJWT(t, "ed", edKey, claims(map[string]interface{}{"sub": fmt.Sprintf("alice-%d", issued), "scope": scope, "exp": expiry.Unix()}))
+		return &client.Token{AccessToken: token, Expiry: expiry}, nil
+	})
+	r, err := client.NewTokenRefresher(src, xclient, claimsClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err == nil || !strings.Contains(err.Error(), ErrInsufficientScope.Error()) {
+		t.Fatalf("expect the call fails without scopes but got %v", err)
+	}
+
+	mu.Lock()
+	scope = "arith:mul"
+	mu.Unlock()
+	time.Sleep(1500 * time.Millisecond) // refreshed at the half of the lifetime
+	if err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply); err != nil || reply.C != 200 {
+		t.Fatalf("expect the call succeeds with refreshed tokens: %v", err)
+	}
+	if err := claimsClient.Call(context.Background(), "Get", &Args{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sub, "alice-") || sub == "alice-1" {
+		t.Errorf("expect claims of the refreshed token in the context but got %q", sub)
+	}
+}
@@ -0,0 +1,320 @@
+package serverplugin
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caser789/rpcj/log"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrRateLimited is returned to clients whose requests are rate limited by KeyedRateLimitingPlugin.
+// The response metadata contains share.RetryAfterKey.
+var ErrRateLimited error = &server.StatusError{Code: http.StatusTooManyRequests, Message: "rpcx: rate limited"}
+
+// RateLimitQuota is a token bucket quota.
+type RateLimitQuota struct {
+	// Rate is the number of requests per second. Zero or negative means no limit.
+	Rate float64 `yaml:"rate" json:"rate"`
+	// Burst is the bucket size. Default is the rate, and at least 1.
+	Burst int64 `yaml:"burst" json:"burst"`
+}
+
+func (q RateLimitQuota) burst() int64 {
+	if q.Burst > 0 {
+		return q.Burst
+	}
+	if b := int64(math.Ceil(q.Rate)); b > 1 {
+		return b
+	}
+	return 1
+}
+
+// RateLimitKeyFunc returns the key of buckets of a request. Requests with empty keys are not limited.
+type RateLimitKeyFunc func(ctx context.Context, servicePath, serviceMethod string) string
+
+// RateLimitByRemoteIP keys requests by remote IPs.
+func RateLimitByRemoteIP() RateLimitKeyFunc {
+	return func(ctx context.Context, _, _ string) string {
+		peer, ok := server.PeerFromContext(ctx)
+		if !ok || peer.Addr == nil {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(peer.Addr.String())
+		if err != nil {
+			return peer.Addr.String()
+		}
+		return host
+	}
+}
+
+// RateLimitByIdentity keys requests by identities of clients:
+// subjects of JWTs validated by JWTPlugin, or identities of mutual TLS certificates.
+// JWTPlugin must be added before KeyedRateLimitingPlugin, so subjects are known when requests are read.
+func RateLimitByIdentity() RateLimitKeyFunc {
+	return func(ctx context.Context, _, _ string) string {
+		if claims, ok := JWTClaimsFromContext(ctx); ok && claims.Subject() != "" {
+			return claims.Subject()
+		}
+		if peer, ok := server.PeerFromContext(ctx); ok {
+			return peer.Identity()
+		}
+		return ""
+	}
+}
+
+// RateLimitByMethod keys requests by "Service.Method".
+func RateLimitByMethod() RateLimitKeyFunc {
+	return func(_ context.Context, servicePath, serviceMethod string) string {
+		return servicePath + "." + serviceMethod
+	}
+}
+
+// RateLimitByMetadata keys requests by a key in request metadata, for example a tenant ID.
+func RateLimitByMetadata(key string) RateLimitKeyFunc {
+	return func(ctx context.Context, _, _ string) string {
+		meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+		return meta[key]
+	}
+}
+
+// RateLimitKeys keys requests by all keys joined with "|", for example the identity and the method.
+// Requests are not limited if any key is empty.
+func RateLimitKeys(fns ...RateLimitKeyFunc) RateLimitKeyFunc {
+	return func(ctx context.Context, servicePath, serviceMethod string) string {
+		keys := make([]string, len(fns))
+		for i, fn := range fns {
+			if keys[i] = fn(ctx, servicePath, serviceMethod); keys[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(keys, "|")
+	}
+}
+
+// RateLimitStore stores token buckets.
+type RateLimitStore interface {
+	// Take takes a token of the bucket of key. If there are no tokens, it returns false and when a token is available.
+	Take(ctx context.Context, key string, quota RateLimitQuota) (ok bool, retryAfter time.Duration, err error)
+}
+
+// KeyedRateLimitOption contains options of KeyedRateLimitingPlugin.
+type KeyedRateLimitOption struct {
+	// Key returns keys of requests. Default is RateLimitByRemoteIP.
+	Key RateLimitKeyFunc
+	// Default is the quota of keys not in Quotas.
+	Default RateLimitQuota
+	// Quotas are quotas of keys.
+	Quotas map[string]RateLimitQuota
+	// Store stores buckets. Default is a local store of 10000 buckets, which evicts least recently used buckets.
+	// Buckets are shared by servers with NewRedisRateLimitStore.
+	Store RateLimitStore
+}
+
+// KeyedRateLimitingPlugin limits requests by token buckets of keys, such as clients, tenants or methods.
+// Unlike ReqRateLimitingPlugin, it runs after requests are read, so keys can be from requests.
+// Tokens are taken when requests are read, so requests rejected before PreCall, such as invalid ones, are limited too.
+// Limited requests fail with ErrRateLimited, and responses have share.RetryAfterKey in metadata.
+// If the store fails, requests are not limited.
+type KeyedRateLimitingPlugin struct {
+	opt KeyedRateLimitOption
+}
+
+// NewKeyedRateLimitingPlugin creates a KeyedRateLimitingPlugin.
+func NewKeyedRateLimitingPlugin(opt KeyedRateLimitOption) *KeyedRateLimitingPlugin {
+	if opt.Key == nil {
+		opt.Key = RateLimitByRemoteIP()
+	}
+	if opt.Store == nil {
+		opt.Store = NewLocalRateLimitStore(10000)
+	}
+	return &KeyedRateLimitingPlugin{opt: opt}
+}
+
+// rateLimitDecision is taken when a request is read, and applied by PreCall.
+type rateLimitDecision struct {
+	limited    bool
+	retryAfter time.Duration
+}
+
+type rateLimitDecisionKey struct{}
+
+// take takes a token of the request. It returns false if the request has no key.
+func (p *KeyedRateLimitingPlugin) take(ctx context.Context, serviceName, methodName string) (d rateLimitDecision, keyed bool) {
+	key := p.opt.Key(ctx, serviceName, methodName)
+	if key == "" {
+		return d, false
+	}
+	quota, ok := p.opt.Quotas[key]
+	if !ok {
+		quota = p.opt.Default
+	}
+	if quota.Rate <= 0 {
+		return d, true
+	}
+
+	ok, retryAfter, err := p.opt.Store.Take(ctx, key, quota)
+	if err != nil {
+		log.Warnf("failed to take rate limit token of %s: %v", key, err)
+		return d, true
+	}
+	return rateLimitDecision{limited: !ok, retryAfter: retryAfter}, true
+}
+
+// PostReadRequest takes tokens of requests. Limited requests fail in PreCall.
+func (p *KeyedRateLimitingPlugin) PostReadRequest(ctx context.Context, r *protocol.Message, e error) error {
+	sctx, ok := ctx.(*share.Context)
+	if !ok || e != nil || r == nil || r.IsHeartbeat() {
+		return nil
+	}
+
+	// request metadata is put into the context after requests are read
+	mctx := share.WithValue(ctx, share.ReqMetaDataKey, r.Metadata)
+	if d, keyed := p.take(mctx, r.ServicePath, r.ServiceMethod); keyed {
+		sctx.SetValue(rateLimitDecisionKey{}, &d)
+	}
+	return nil
+}
+
+// PreCall limits requests. Requests without keys when they are read, for example without JWTs, take tokens here.
+func (p *KeyedRateLimitingPlugin) PreCall(ctx context.Context, serviceName, methodName string, args interface{}) (interface{}, error) {
+	d, ok := ctx.Value(rateLimitDecisionKey{}).(*rateLimitDecision)
+	if !ok {
+		taken, _ := p.take(ctx, serviceName, methodName)
+		d = &taken
+	}
+	if !d.limited {
+		return args, nil
+	}
+	retryAfter := d.retryAfter
+
+	if resMeta, ok := ctx.Value(share.ResMetaDataKey).(map[string]string); ok {
+		ms := (retryAfter + time.Millisecond - 1) / time.Millisecond
+		resMeta[share.RetryAfterKey] = strconv.FormatInt(int64(ms), 10)
+	}
+	return args, ErrRateLimited
+}
+
+// tokenBucket is refilled lazily when tokens are taken.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(quota RateLimitQuota, now time.Time) (bool, time.Duration) {
+	burst := float64(quota.burst())
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*quota.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / quota.Rate * float64(time.Second))
+}
+
+// LocalRateLimitStore stores buckets in memory, and evicts least recently used buckets.
+type LocalRateLimitStore struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List // of *tokenBucket, most recently used first
+	buckets map[string]*list.Element
+}
+
+// NewLocalRateLimitStore creates a LocalRateLimitStore of at most size buckets.
+// Evicted buckets are full when they are used again, so size should be larger than the number of active keys.
+func NewLocalRateLimitStore(size int) *LocalRateLimitStore {
+	return &LocalRateLimitStore{size: size, lru: list.New(), buckets: make(map[string]*list.Element)}
+}
+
+// Take takes a token of the bucket of key.
+func (s *LocalRateLimitStore) Take(_ context.Context, key string, quota RateLimitQuota) (bool, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.buckets[key]
+	if ok {
+		s.lru.MoveToFront(e)
+	} else {
+		if s.lru.Len() >= s.size {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		e = s.lru.PushFront(&tokenBucket{key: key, tokens: float64(quota.burst()), last: now})
+		s.buckets[key] = e
+	}
+	ok, retryAfter := e.Value.(*tokenBucket).take(quota, now)
+	return ok, retryAfter, nil
+}
+
+// Len returns the number of buckets.
+func (s *LocalRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// redisTokenBucket takes a token atomically. Buckets expire after they are full.
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+// RedisRateLimitStore stores buckets in Redis, so servers share buckets.
+// Clocks of servers should be synchronized, since buckets are refilled by the time of servers.
+type RedisRateLimitStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisRateLimitStore creates a RedisRateLimitStore. Keys of buckets are prefixed with prefix.
+func NewRedisRateLimitStore(client redis.UniversalClient, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: prefix}
+}
+
+// Take takes a token of the bucket of key.
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, quota RateLimitQuota) (bool, time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	result, err := redisTokenBucket.Run(ctx, s.client, []string{s.prefix + key}, quota.Rate, quota.burst(), now).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, errors.New("unexpected result of redis script")
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,184 @@
+package serverplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+	"github.com/go-redis/redis/v8"
+)
+
+func rateLimitContext(ip, tenant string) (*share.Context, map[string]string) {
+	resMeta := make(map[string]string)
+	ctx := share.WithValue(context.Background(), server.PeerContextKey, &server.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+	ctx = share.WithLocalValue(ctx, share.ReqMetaDataKey, map[string]string{"tenant": tenant})
+	ctx = share.WithLocalValue(ctx, share.ResMetaDataKey, resMeta)
+	return ctx, resMeta
+}
+
+func testKeyedRateLimiting(t *testing.T, store RateLimitStore) {
+	p := NewKeyedRateLimitingPlugin(KeyedRateLimitOption{
+		Key:     RateLimitKeys(RateLimitByMetadata("tenant"), RateLimitByMethod()),
+		Default: RateLimitQuota{Rate: 1, Burst: 2},
+		Quotas:  map[string]RateLimitQuota{"vip|Arith.Mul": {Rate: 100}},
+		Store:   store,
+	})
+
+	// the noisy tenant is limited after its burst
+	for i := 0; i < 2; i++ {
+		ctx, _ := rateLimitContext("127.0.0.1", "noisy")
+		if _, err := p.PreCall(ctx, "Arith", "Mul", nil); err != nil {
+			t.Fatalf("expect the request %d is allowed: %v", i, err)
+		}
+	}
+	ctx, resMeta := rateLimitContext("127.0.0.1", "noisy")
+	if _, err := p.PreCall(ctx, "Arith", "Mul", nil); err != ErrRateLimited {
+		t.Fatalf("expect the request is rate limited but got %v", err)
+	}
+	if retryAfter := resMeta[share.RetryAfterKey]; retryAfter == "" || retryAfter == "0" {
+		t.Errorf("expect retry after in metadata but got %q", retryAfter)
+	}
+
+	// other tenants, methods and quotas are not affected
+	for _, c := range []struct{ tenant, method string }{{"quiet", "Mul"}, {"noisy", "Add"}, {"vip", "Mul"}, {"vip", "Mul"}, {"vip", "Mul"}, {"", "Mul"}} {
+		ctx, _ := rateLimitContext("127.0.0.1", c.tenant)
+		if _, err := p.PreCall(ctx, "Arith", c.method, nil); err != nil {
+			t.Errorf("expect the request of %s.%s is allowed: %v", c.tenant, c.method, err)
+		}
+	}
+
+	// refilled
+	time.Sleep(1100 * time.Millisecond)
+	ctx, _ = rateLimitContext("127.0.0.1", "noisy")
+	if _, err := p.PreCall(ctx, "Arith", "Mul", nil); err != nil {
+		t.Errorf("expect the request is allowed after refilled: %v", err)
+	}
+}
+
+func TestKeyedRateLimitingPlugin(t *testing.T) {
+	testKeyedRateLimiting(t, nil)
+
+	// LRU
+	store := NewLocalRateLimitStore(2)
+	p := NewKeyedRateLimitingPlugin(KeyedRateLimitOption{Default: RateLimitQuota{Rate: 1}, Store: store})
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		ctx, _ := rateLimitContext(ip, "")
+		p.PreCall(ctx, "Arith", "Mul", nil)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("expect 2 buckets but got %d", store.Len())
+	}
+	// 10.0.0.1 is recently used so it is limited, and 10.0.0.2 has been evicted
+	for ip, limited := range map[string]bool{"10.0.0.1": true, "10.0.0.2": false} {
+		ctx, _ := rateLimitContext(ip, "")
+		if _, err := p.PreCall(ctx, "Arith", "Mul", nil); (err == ErrRateLimited) != limited {
+			t.Errorf("unexpected result of %s: %v", ip, err)
+		}
+	}
+}
+
+func TestKeyedRateLimitingPlugin_PostReadRequest(t *testing.T) {
+	p := NewKeyedRateLimitingPlugin(KeyedRateLimitOption{
+		Key:     RateLimitByMetadata("tenant"),
+		Default: RateLimitQuota{Rate: 0.001, Burst: 1},
+	})
+	read := func() (*share.Context, map[string]string) {
+		msg := protocol.NewMessage()
+		msg.ServicePath, msg.ServiceMethod = "Arith", "Mul"
+		msg.Metadata = map[string]string{"tenant": "noisy"}
+		ctx, resMeta := rateLimitContext("127.0.0.1", "noisy")
+		if err := p.PostReadRequest(ctx, msg, nil); err != nil {
+			t.Fatal(err)
+		}
+		return ctx, resMeta
+	}
+
+	// tokens are taken once when requests are read
+	ctx, _ := read()
+	if _, err := p.PreCall(ctx, "Arith", "Mul", nil); err != nil {
+		t.Fatalf("expect the request is allowed: %v", err)
+	}
+	ctx, resMeta := read()
+	if _, err := p.PreCall(ctx, "Arith", "Mul", nil); err != ErrRateLimited {
+		t.Fatalf("expect the request is rate limited but got %v", err)
+	}
+	if resMeta[share.RetryAfterKey] == "" {
+		t.Error("expect retry after in metadata")
+	}
+}
+
+func TestKeyedRateLimitingPlugin_Redis(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	testKeyedRateLimiting(t, NewRedisRateLimitStore(client, "rpcx:ratelimit:"))
+
+	if !mr.Exists("rpcx:ratelimit:noisy|Arith.Mul") {
+		t.Error("expect buckets are in redis")
+	}
+
+	// requests are not limited if redis fails
+	mr.Close()
+	p := NewKeyedRateLimitingPlugin(KeyedRateLimitOption{Default: RateLimitQuota{Rate: 1}, Store: NewRedisRateLimitStore(client, "")})
+	for i := 0; i < 3; i++ {
+		ctx, _ := rateLimitContext("127.0.0.1", "")
+		if _, err := p.PreCall(ctx, "Arith", "Mul", nil); err != nil {
+			t.Fatalf("expect requests are allowed without redis: %v", err)
+		}
+	}
+}
+
+type LimitedArgs struct {
+	A int `validate:"min=1"`
+}
+
+type LimitedService struct{}
+
+func (LimitedService) Echo(ctx context.Context, args *LimitedArgs, reply *LimitedArgs) error {
+	*reply = *args
+	return nil
+}
+
+func TestKeyedRateLimitingPlugin_Gateway(t *testing.T) {
+	s := server.NewServer()
+	s.Plugins.Add(NewKeyedRateLimitingPlugin(KeyedRateLimitOption{
+		Key:     RateLimitByRemoteIP(),
+		Default: RateLimitQuota{Rate: 0.001, Burst: 2},
+	}))
+	s.RegisterName("Limited", new(LimitedService), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	call := func(body string) (int, string) {
+		res := gatewayCall(t, s.Address().String(), "Limited.Echo", body, nil)
+		return res.StatusCode, res.Header.Get(server.XErrorMessage)
+	}
+
+	// invalid requests consume tokens too
+	if code, _ := call(`{"A":0}`); code != http.StatusBadRequest {
+		t.Fatalf("expect the invalid request is rejected but got %d", code)
+	}
+	if code, msg := call(`{"A":1}`); code != http.StatusOK {
+		t.Fatalf("expect the request is allowed but got %d %q", code, msg)
+	}
+	res := gatewayCall(t, s.Address().String(), "Limited.Echo", `{"A":1}`, nil)
+	if res.StatusCode != http.StatusTooManyRequests || !strings.Contains(res.Header.Get(server.XErrorMessage), ErrRateLimited.Error()) {
+		t.Fatalf("expect the request is rate limited but got %d %q", res.StatusCode, res.Header.Get(server.XErrorMessage))
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("expect Retry-After of the rate limited request")
+	}
+}
@@ -0,0 +1,171 @@
+package serverplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caser789/rpcj/protocol"
+	"github.com/caser789/rpcj/server"
+	"github.com/caser789/rpcj/share"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type prometheusInflightKey struct{}
+
+// PrometheusPlugin collects metrics of a rpc server and exposes them in the Prometheus format.
+// Requests are labeled by service, method and code ("OK" or "Error").
+//
+// The collected metrics can be served on the http gateway:
+//
+//	p := serverplugin.NewPrometheusPlugin("rpcx", nil)
+//	s.Plugins.Add(p)
+//	s.HandleGateway("/metrics", p.Handler())
+type PrometheusPlugin struct {
+	Registry *prometheus.Registry
+
+	requests     *prometheus.CounterVec
+	latency      *prometheus.HistogramVec
+	inflight     *prometheus.GaugeVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	connections  prometheus.Gauge
+	services     prometheus.Gauge
+}
+
+// NewPrometheusPlugin creates a new PrometheusPlugin and registers its collectors in registry.
+// If registry is nil, a new registry is created.
+func NewPrometheusPlugin(namespace string, registry *prometheus.Registry) *PrometheusPlugin {
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+
+	p := &PrometheusPlugin{
+		Registry: registry,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "handled_total",
+			Help:      "Total number of requests handled by the server.",
+		}, []string{"service", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "handling_seconds",
+			Help:      "Latency of requests handled by the server.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service", "method", "code"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "inflight_requests",
+			Help:      "Number of requests being handled by the server.",
+		}, []string{"service", "method"}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "request_size_bytes",
+			Help:      "Payload size of requests received by the server.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"service", "method"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "response_size_bytes",
+			Help:      "Payload size of responses sent by the server.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"service", "method"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "connections",
+			Help:      "Number of active client connections.",
+		}),
+		services: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "services",
+			Help:      "Number of registered services.",
+		}),
+	}
+
+	registry.MustRegister(p.requests, p.latency, p.inflight, p.requestSize, p.responseSize, p.connections, p.services)
+
+	return p
+}
+
+// Handler returns a http.Handler that serves the collected metrics.
+func (p *PrometheusPlugin) Handler() http.Handler {
+	return promhttp.HandlerFor(p.Registry, promhttp.HandlerOpts{})
+}
+
+// Register handles registering event.
+func (p *PrometheusPlugin) Register(name string, rcvr interface{}, metadata string) error {
+	p.services.Inc()
+	return nil
+}
+
+// Unregister handles unregistering event.
+func (p *PrometheusPlugin) Unregister(name string) error {
+	p.services.Dec()
+	return nil
+}
+
+// HandleConnAccept counts connections from clients.
+func (p *PrometheusPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	p.connections.Inc()
+	return conn, true
+}
+
+// HandleConnClose counts closed connections.
+func (p *PrometheusPlugin) HandleConnClose(conn net.Conn) bool {
+	p.connections.Dec()
+	return true
+}
+
+// PostReadRequest counts in-flight requests and request sizes.
+func (p *PrometheusPlugin) PostReadRequest(ctx context.Context, r *protocol.Message, e error) error {
+	if e != nil || r == nil || r.ServicePath == "" {
+		return nil
+	}
+
+	p.requestSize.WithLabelValues(r.ServicePath, r.ServiceMethod).Observe(float64(len(r.Payload)))
+
+	if rpcxContext, ok := ctx.(*share.Context); ok {
+		p.inflight.WithLabelValues(r.ServicePath, r.ServiceMethod).Inc()
+		rpcxContext.SetValue(prometheusInflightKey{}, true)
+	}
+	return nil
+}
+
+// PostWriteResponse counts handled requests, their latency and response sizes.
+func (p *PrometheusPlugin) PostWriteResponse(ctx context.Context, req *protocol.Message, res *protocol.Message, e error) error {
+	if req == nil || req.ServicePath == "" {
+		return nil
+	}
+	sp := req.ServicePath
+	sm := req.ServiceMethod
+
+	if rpcxContext, ok := ctx.(*share.Context); ok && rpcxContext.Value(prometheusInflightKey{}) != nil {
+		p.inflight.WithLabelValues(sp, sm).Dec()
+		rpcxContext.SetValue(prometheusInflightKey{}, nil)
+	}
+
+	code := "OK"
+	if e != nil || (res != nil && res.MessageStatusType() == protocol.Error) {
+		code = "Error"
+	}
+	p.requests.WithLabelValues(sp, sm, code).Inc()
+
+	if res != nil {
+		p.responseSize.WithLabelValues(sp, sm).Observe(float64(len(res.Payload)))
+	}
+
+	if t, ok := ctx.Value(server.StartRequestContextKey).(int64); ok && t > 0 {
+		d := time.Duration(time.Now().UnixNano() - t)
+		p.latency.WithLabelValues(sp, sm, code).Observe(d.Seconds())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package serverplugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caser789/rpcj/client"
+	"github.com/caser789/rpcj/server"
+)
+
+func TestPrometheusPlugin(t *testing.T) {
+	s := server.NewServer()
+	p := NewPrometheusPlugin("rpcx", nil)
+	s.Plugins.Add(p)
+	s.HandleGateway("/metrics", p.Handler())
+	s.RegisterName("Arith", new(Arith), "")
+	go s.Serve("tcp", "127.0.0.1:0")
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	addr := s.Address().String()
+
+	d, _ := client.NewPeer2PeerDiscovery("tcp@"+addr, "")
+	xclient := client.NewXClient("Arith", client.Failfast, client.RandomSelect, d, client.DefaultOption)
+	defer xclient.Close()
+
+	reply := &Reply{}
+	err := xclient.Call(context.Background(), "Mul", &Args{A: 10, B: 20}, reply)
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	metrics := string(data)
+
+	expected := []string{
+		`rpcx_server_handled_total{code="OK",method="Mul",service="Arith"} 1`,
+		`rpcx_server_inflight_requests{method="Mul",service="Arith"} 0`,
+		`rpcx_server_handling_seconds_count{code="OK",method="Mul",service="Arith"} 1`,
+		`rpcx_server_services 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(metrics, e) {
+			t.Errorf("expect %s in metrics but got:\n%s", e, metrics)
+		}
+	}
+
+	// failed gateway requests are counted, and are not in flight after they are handled
+	if res := gatewayCall(t, addr, "Arith.Missing", `{}`, nil); res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expect the gateway request fails but got %d", res.StatusCode)
+	}
+	resp, err = http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ = ioutil.ReadAll(resp.Body)
+	metrics = string(data)
+	for _, e := range []string{
+		`rpcx_server_handled_total{code="Error",method="Missing",service="Arith"} 1`,
+		`rpcx_server_inflight_requests{method="Missing",service="Arith"} 0`,
+	} {
+		if !strings.Contains(metrics, e) {
+			t.Errorf("expect %s in metrics but got:\n%s", e, metrics)
+		}
+	}
+}
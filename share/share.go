@@ -1,6 +1,8 @@
 package share
 
 import (
+	"sync/atomic"
+
 	"github.com/caser789/rpcj/codec"
 	"github.com/caser789/rpcj/protocol"
 )
@@ -18,6 +20,17 @@ const (
 	// ServerAddress is used to get address of the server by client
 	ServerAddress = "__ServerAddress"
 
+	// HashKey is used in metadata to route requests by it in hash based select modes.
+	HashKey = "__HashKey"
+
+	// MirrorKey is set in metadata of calls mirrored by clients.
+	MirrorKey = "__Mirror"
+
+	// RetryAfterKey is set in metadata of responses of rate limited requests, in milliseconds.
+	RetryAfterKey = "__RetryAfter"
+	// InvalidArgumentKey is set in metadata of responses of requests with invalid args. Its value is violations in JSON.
+	InvalidArgumentKey = "__InvalidArgument"
+
 	// OpentracingSpanServerKey key in service context
 	OpentracingSpanServerKey = "opentracing_span_server_key"
 	// OpentracingSpanClientKey key in client context
@@ -40,8 +53,32 @@ const (
 // Trace is a flag to write a trace log or not.
 // You should not enable this flag ofr product environment and enable it only for test.
 // It writes trace log with logger Debug level.
+// Trace is read without synchronization, so use SetTrace to toggle it while serving.
 var Trace bool
 
+// traceFlag overrides Trace after SetTrace is called: 1 disables and 2 enables trace logs.
+var traceFlag int32
+
+// SetTrace enables or disables trace logs. It is safe to call it concurrently with requests.
+func SetTrace(enable bool) {
+	flag := int32(1)
+	if enable {
+		flag = 2
+	}
+	atomic.StoreInt32(&traceFlag, flag)
+}
+
+// TraceEnabled returns whether trace logs are enabled by SetTrace, or by Trace if SetTrace is never called.
+func TraceEnabled() bool {
+	switch atomic.LoadInt32(&traceFlag) {
+	case 1:
+		return false
+	case 2:
+		return true
+	}
+	return Trace
+}
+
 // Codecs are codecs supported by rpcx. You can add customized codecs in Codecs.
 var Codecs = map[protocol.SerializeType]codec.Codec{
 	protocol.SerializeNone: &codec.ByteCodec{},
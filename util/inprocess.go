@@ -0,0 +1,131 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InprocessNetwork is the network of in-process connections, which connect servers and clients in a process without sockets.
+const InprocessNetwork = "inprocess"
+
+var (
+	// ErrInprocessListenerClosed is returned by Accept of closed in-process listeners.
+	ErrInprocessListenerClosed = errors.New("inprocess: listener closed")
+
+	errInprocessRefused = errors.New("connection refused")
+	errInprocessTimeout = errors.New("i/o timeout")
+
+	inprocessMu        sync.Mutex
+	inprocessListeners = make(map[string]*inprocessListener)
+	inprocessSeq       uint64
+)
+
+// InprocessAddr is the address of in-process connections.
+type InprocessAddr string
+
+// Network returns "inprocess".
+func (a InprocessAddr) Network() string { return InprocessNetwork }
+
+// String returns the address.
+func (a InprocessAddr) String() string { return string(a) }
+
+// inprocessConn is a side of a net.Pipe with addresses.
+type inprocessConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *inprocessConn) LocalAddr() net.Addr  { return c.local }
+func (c *inprocessConn) RemoteAddr() net.Addr { return c.remote }
+
+type inprocessListener struct {
+	addr  InprocessAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (ln *inprocessListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, ErrInprocessListenerClosed
+	}
+}
+
+func (ln *inprocessListener) Close() error {
+	ln.once.Do(func() {
+		inprocessMu.Lock()
+		if inprocessListeners[string(ln.addr)] == ln {
+			delete(inprocessListeners, string(ln.addr))
+		}
+		inprocessMu.Unlock()
+		close(ln.done)
+	})
+	return nil
+}
+
+func (ln *inprocessListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// ListenInprocess listens in-process connections on the address, which is any unique name in the process.
+// A unique address is generated if address is empty.
+func ListenInprocess(address string) (net.Listener, error) {
+	inprocessMu.Lock()
+	defer inprocessMu.Unlock()
+
+	if address == "" {
+		address = fmt.Sprintf("inprocess-%d", atomic.AddUint64(&inprocessSeq, 1))
+	}
+	if _, ok := inprocessListeners[address]; ok {
+		return nil, fmt.Errorf("inprocess: address %s is already in use", address)
+	}
+	ln := &inprocessListener{
+		addr:  InprocessAddr(address),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	inprocessListeners[address] = ln
+	return ln, nil
+}
+
+// DialInprocess connects to the in-process listener on the address.
+// It waits until the connection is accepted, or the timeout is reached if timeout is positive.
+func DialInprocess(address string, timeout time.Duration) (net.Conn, error) {
+	inprocessMu.Lock()
+	ln := inprocessListeners[address]
+	inprocessMu.Unlock()
+	if ln == nil {
+		return nil, &net.OpError{Op: "dial", Net: InprocessNetwork, Addr: InprocessAddr(address), Err: errInprocessRefused}
+	}
+
+	client, server := net.Pipe()
+	remote := InprocessAddr(fmt.Sprintf("%s#%d", address, atomic.AddUint64(&inprocessSeq, 1)))
+	clientConn := &inprocessConn{Conn: client, local: remote, remote: ln.addr}
+	serverConn := &inprocessConn{Conn: server, local: ln.addr, remote: remote}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case ln.conns <- serverConn:
+		return clientConn, nil
+	case <-ln.done:
+		err = errInprocessRefused
+	case <-expired:
+		err = errInprocessTimeout
+	}
+	client.Close()
+	server.Close()
+	return nil, &net.OpError{Op: "dial", Net: InprocessNetwork, Addr: ln.addr, Err: err}
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestInprocess(t *testing.T) {
+	ln, err := ListenInprocess("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	if ln.Addr().Network() != InprocessNetwork || addr == "" {
+		t.Fatalf("unexpected address %v", ln.Addr())
+	}
+	if _, err := ListenInprocess(addr); err == nil {
+		t.Fatal("expect an error of the address in use")
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialInprocess(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != addr || conn.LocalAddr().String() == addr {
+		t.Errorf("unexpected addresses %v -> %v", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+
+	// nobody accepts
+	if _, err := DialInprocess(addr, 10*time.Millisecond); err == nil {
+		t.Error("expect a timeout")
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); err != ErrInprocessListenerClosed {
+		t.Errorf("expect ErrInprocessListenerClosed but got %v", err)
+	}
+	if _, err := DialInprocess(addr, time.Second); err == nil {
+		t.Error("expect refused connections after closed")
+	}
+	if ln, err = ListenInprocess(addr); err != nil {
+		t.Fatalf("expect the address is released: %v", err)
+	}
+	ln.Close()
+}